@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -24,6 +26,7 @@ type AllocationRequest struct {
     SecurityDomain   string `json:"security_domain"`
     AttestationRequired bool   `json:"attestation_required,omitempty"`
     AttestationTicket   string `json:"attestation_ticket,omitempty"`
+    FromSnapshot        string `json:"from_snapshot,omitempty"`
 }
 
 // FFMHandle represents a Free-Form Memory allocation
@@ -37,10 +40,13 @@ type FFMHandle struct {
 	SecurityDomain   string    `json:"security_domain"`
 	CreatedAt        time.Time `json:"created_at"`
 	PolicyLeaseTTL   int       `json:"policy_lease_ttl_s"`
+	LeaseExpiresAt   time.Time `json:"lease_expires_at"`
 	FileDescriptors  []string  `json:"fds"`
 	AchievedBandwidth uint64   `json:"achieved_GBs"`
 	MovedPages       uint64    `json:"moved_pages"`
 	TailP99Ms        float64   `json:"tail_p99_ms"`
+	State            string    `json:"state"`
+	RefCount         int       `json:"refcount"`
 }
 
 // TelemetryResponse represents telemetry data
@@ -53,6 +59,13 @@ type TelemetryResponse struct {
 	Utilization  float64 `json:"utilization_percent"`
 }
 
+// TelemetryEvent is one streamed telemetry sample
+type TelemetryEvent struct {
+	HandleID string    `json:"handle_id"`
+	At       time.Time `json:"at"`
+	TelemetryResponse
+}
+
 // BandwidthAdjustRequest represents a bandwidth adjustment request
 type BandwidthAdjustRequest struct {
 	FloorGBs uint64 `json:"floor_GBs"`
@@ -63,6 +76,46 @@ type LatencyClassAdjustRequest struct {
 	Target string `json:"target"`
 }
 
+// Migration represents an asynchronous tier migration
+type Migration struct {
+	ID         string  `json:"id"`
+	HandleID   string  `json:"handle_id"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	TotalPages uint64  `json:"total_pages"`
+	MovedPages uint64  `json:"moved_pages"`
+	RateGBs    uint64  `json:"rate_GBs"`
+	State      string  `json:"state"`
+	ETASeconds float64 `json:"eta_s"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// SyncResult reports a completed sync of an allocation
+type SyncResult struct {
+	HandleID    string    `json:"handle_id"`
+	Persistence string    `json:"persistence"`
+	Method      string    `json:"method"`
+	SyncedAt    time.Time `json:"synced_at"`
+	DurationMs  float64   `json:"duration_ms"`
+}
+
+// Snapshot is a durable copy of an allocation's memory
+type Snapshot struct {
+	ID             string    `json:"id"`
+	Label          string    `json:"label,omitempty"`
+	SourceHandle   string    `json:"source_handle"`
+	Tier           string    `json:"tier"`
+	SecurityDomain string    `json:"security_domain"`
+	Bytes          uint64    `json:"bytes"`
+	Checksum       string    `json:"checksum"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// RenewRequest represents a lease renewal request
+type RenewRequest struct {
+	TTLSeconds int `json:"ttl_s,omitempty"`
+}
+
 var (
     memqosdURL = "http://localhost:8081"
     verbose    bool
@@ -92,6 +145,11 @@ func main() {
 	rootCmd.AddCommand(bandwidthCmd)
 	rootCmd.AddCommand(migrateCmd)
 	rootCmd.AddCommand(statCmd)
+	rootCmd.AddCommand(renewCmd)
+	rootCmd.AddCommand(freeCmd)
+	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(watchCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -161,11 +219,51 @@ var statCmd = &cobra.Command{
 	Run:   runStat,
 }
 
+var renewCmd = &cobra.Command{
+	Use:   "renew <allocation_id>",
+	Short: "Renew allocation lease",
+	Long:  "Renew the policy lease of an allocation before it expires",
+	Args:  cobra.ExactArgs(1),
+	Run:   runRenew,
+}
+
+var freeCmd = &cobra.Command{
+	Use:   "free <allocation_id>",
+	Short: "Free an allocation",
+	Long:  "Release an FFM allocation and return its capacity to the tier",
+	Args:  cobra.ExactArgs(1),
+	Run:   runFree,
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <allocation_id>",
+	Short: "Flush an allocation to persistent storage",
+	Long:  "Checkpoint a write-back allocation or flush a write-through or durable one",
+	Args:  cobra.ExactArgs(1),
+	Run:   runSync,
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot <allocation_id>",
+	Short: "Snapshot an allocation's memory",
+	Long:  "Copy an allocation's memory into a durable snapshot that new allocations can be cloned from with ffm-alloc --from-snapshot",
+	Args:  cobra.ExactArgs(1),
+	Run:   runSnapshot,
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [allocation_id]",
+	Short: "Stream allocation telemetry",
+	Long:  "Stream live telemetry for an allocation, or for every allocation in a security domain with --domain",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   runWatch,
+}
+
 func init() {
 	// Allocation command flags
 	allocCmd.Flags().String("tier", "T2", "Latency tier (T0=HBM, T1=DRAM, T2=CXL, T3=persistent)")
 	allocCmd.Flags().Uint64("bw-floor", 150, "Bandwidth floor in Gbps")
-	allocCmd.Flags().String("persistence", "none", "Persistence level (none, write-back, write-through)")
+	allocCmd.Flags().String("persistence", "none", "Persistence level (none, write-back, write-through, durable)")
 	allocCmd.Flags().Bool("shareable", true, "Allow sharing between processes")
 	allocCmd.Flags().String("domain", "default", "Security domain")
 
@@ -173,9 +271,26 @@ func init() {
 	ffmAllocCmd.Flags().Uint64("bytes", 274877906944, "Bytes to allocate (default: 256GB)")
 	ffmAllocCmd.Flags().String("tier", "T2", "Latency tier (T0=HBM, T1=DRAM, T2=CXL, T3=persistent)")
 	ffmAllocCmd.Flags().Uint64("bw-floor", 150, "Bandwidth floor in Gbps")
-	ffmAllocCmd.Flags().String("persistence", "none", "Persistence level (none, write-back, write-through)")
+	ffmAllocCmd.Flags().String("persistence", "none", "Persistence level (none, write-back, write-through, durable)")
 	ffmAllocCmd.Flags().Bool("shareable", true, "Allow sharing between processes")
 	ffmAllocCmd.Flags().String("domain", "default", "Security domain")
+	ffmAllocCmd.Flags().String("from-snapshot", "", "Clone contents from this snapshot (size, tier and domain default to the snapshot's)")
+
+	// snapshot command flags
+	snapshotCmd.Flags().String("label", "", "Label to record with the snapshot")
+
+	// Migrate command flags
+	migrateCmd.Flags().Bool("wait", false, "Wait for the migration to finish")
+
+	// Renew command flags
+	renewCmd.Flags().Int("ttl", 0, "New lease TTL in seconds (default: keep current TTL)")
+
+	// Free command flags
+	freeCmd.Flags().Bool("force", false, "Release even if other consumers are still attached")
+
+	// Watch command flags
+	watchCmd.Flags().Duration("interval", time.Second, "Sample interval")
+	watchCmd.Flags().String("domain", "", "Watch every allocation in this security domain")
 }
 
 func runAlloc(cmd *cobra.Command, args []string) {
@@ -229,6 +344,20 @@ func runFFMAlloc(cmd *cobra.Command, args []string) {
 	persistence, _ := cmd.Flags().GetString("persistence")
 	shareable, _ := cmd.Flags().GetBool("shareable")
 	domain, _ := cmd.Flags().GetString("domain")
+	fromSnapshot, _ := cmd.Flags().GetString("from-snapshot")
+
+	// A clone takes size, tier and domain from its snapshot unless given
+	if fromSnapshot != "" {
+		if !cmd.Flags().Changed("bytes") {
+			bytes = 0
+		}
+		if !cmd.Flags().Changed("tier") {
+			tier = ""
+		}
+		if !cmd.Flags().Changed("domain") {
+			domain = ""
+		}
+	}
 
 	req := AllocationRequest{
 		Bytes:          bytes,
@@ -239,6 +368,7 @@ func runFFMAlloc(cmd *cobra.Command, args []string) {
 		SecurityDomain: domain,
 		AttestationRequired: ffmAttReq,
 		AttestationTicket:   ffmAttTicket,
+		FromSnapshot:        fromSnapshot,
 	}
 
 	handle, err := allocateFFM(req)
@@ -298,6 +428,7 @@ func runGet(cmd *cobra.Command, args []string) {
 	fmt.Printf("FFM Allocation Details:\n")
 	fmt.Printf("  ID: %s\n", alloc.ID)
 	fmt.Printf("  Size: %s\n", formatBytes(alloc.Bytes))
+	fmt.Printf("  State: %s\n", alloc.State)
 	fmt.Printf("  Tier: %s\n", alloc.LatencyClass)
 	fmt.Printf("  Bandwidth Floor: %d Gbps\n", alloc.BandwidthFloor)
 	fmt.Printf("  Achieved Bandwidth: %d Gbps\n", alloc.AchievedBandwidth)
@@ -306,6 +437,7 @@ func runGet(cmd *cobra.Command, args []string) {
 	fmt.Printf("  Security Domain: %s\n", alloc.SecurityDomain)
 	fmt.Printf("  File Descriptors: %v\n", alloc.FileDescriptors)
 	fmt.Printf("  Policy Lease TTL: %d seconds\n", alloc.PolicyLeaseTTL)
+	fmt.Printf("  Lease Expires: %s\n", alloc.LeaseExpiresAt.Format("2006-01-02 15:04:05"))
 	fmt.Printf("  Moved Pages: %d\n", alloc.MovedPages)
 	fmt.Printf("  Tail P99: %.2f ms\n", alloc.TailP99Ms)
 	fmt.Printf("  Created: %s\n", alloc.CreatedAt.Format("2006-01-02 15:04:05"))
@@ -373,13 +505,35 @@ func runMigrate(cmd *cobra.Command, args []string) {
 		Target: tier,
 	}
 
-	err := migrateTier(allocationID, req)
+	migration, err := migrateTier(allocationID, req)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error migrating tier: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Allocation %s migrated to tier %s\n", allocationID, tier)
+	fmt.Printf("Migration %s started: %s %s -> %s (%d pages at %d GB/s, ETA %.1fs)\n",
+		migration.ID, allocationID, migration.From, migration.To,
+		migration.TotalPages, migration.RateGBs, migration.ETASeconds)
+
+	wait, _ := cmd.Flags().GetBool("wait")
+	for wait && migration.State == "running" {
+		time.Sleep(500 * time.Millisecond)
+		migration, err = getMigration(allocationID, migration.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting migration: %v\n", err)
+			os.Exit(1)
+		}
+		if verbose {
+			fmt.Printf("  %d/%d pages, ETA %.1fs\n", migration.MovedPages, migration.TotalPages, migration.ETASeconds)
+		}
+	}
+	if wait {
+		if migration.State != "completed" {
+			fmt.Fprintf(os.Stderr, "Migration %s %s: %s\n", migration.ID, migration.State, migration.Error)
+			os.Exit(1)
+		}
+		fmt.Printf("Allocation %s migrated to tier %s\n", allocationID, tier)
+	}
 }
 
 func runStat(cmd *cobra.Command, args []string) {
@@ -414,6 +568,99 @@ func runStat(cmd *cobra.Command, args []string) {
 	fmt.Printf("  Age: %s\n", time.Since(alloc.CreatedAt).Round(time.Second))
 }
 
+func runRenew(cmd *cobra.Command, args []string) {
+	allocationID := args[0]
+	ttl, _ := cmd.Flags().GetInt("ttl")
+
+	handle, err := renewFFM(allocationID, RenewRequest{TTLSeconds: ttl})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error renewing lease: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Lease renewed for allocation %s\n", handle.ID)
+	fmt.Printf("Policy Lease TTL: %d seconds\n", handle.PolicyLeaseTTL)
+	fmt.Printf("Lease Expires: %s\n", handle.LeaseExpiresAt.Format("2006-01-02 15:04:05"))
+}
+
+func runFree(cmd *cobra.Command, args []string) {
+	allocationID := args[0]
+	force, _ := cmd.Flags().GetBool("force")
+
+	handle, err := freeFFM(allocationID, force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error freeing allocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Allocation %s %s (%s returned to tier %s)\n",
+		handle.ID, handle.State, formatBytes(handle.Bytes), handle.LatencyClass)
+}
+
+func runSync(cmd *cobra.Command, args []string) {
+	result, err := syncFFM(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error syncing allocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Allocation %s synced (%s, %s) in %.1f ms\n",
+		result.HandleID, result.Persistence, result.Method, result.DurationMs)
+}
+
+func runSnapshot(cmd *cobra.Command, args []string) {
+	label, _ := cmd.Flags().GetString("label")
+
+	snap, err := snapshotFFM(args[0], label)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error snapshotting allocation: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Snapshot %s of %s created (%s on %s)\n",
+		snap.ID, snap.SourceHandle, formatBytes(snap.Bytes), snap.Tier)
+	fmt.Printf("Checksum: %s\n", snap.Checksum)
+}
+
+func runWatch(cmd *cobra.Command, args []string) {
+	interval, _ := cmd.Flags().GetDuration("interval")
+	domain, _ := cmd.Flags().GetString("domain")
+
+	query := url.Values{"interval": {interval.String()}}
+	var streamURL string
+	switch {
+	case len(args) == 1 && domain == "":
+		streamURL = memqosdURL + "/v1/ffm/" + args[0] + "/telemetry/stream?" + query.Encode()
+		fmt.Printf("Watching telemetry for %s (Ctrl+C to stop)...\n", args[0])
+	case len(args) == 0 && domain != "":
+		query.Set("security_domain", domain)
+		streamURL = memqosdURL + "/v1/ffm/telemetry/stream?" + query.Encode()
+		fmt.Printf("Watching telemetry for security domain %s (Ctrl+C to stop)...\n", domain)
+	default:
+		fmt.Fprintln(os.Stderr, "Error: specify either an allocation ID or --domain")
+		os.Exit(1)
+	}
+
+	err := streamTelemetry(streamURL, func(event string, data []byte) {
+		switch event {
+		case "telemetry":
+			var t TelemetryEvent
+			if err := json.Unmarshal(data, &t); err != nil {
+				return
+			}
+			fmt.Printf("[%s] %s | BW: %d GB/s | P99: %.2f ms | Temp: %.1f°C | Power: %.1f W | Util: %.1f%%\n",
+				t.At.Format("15:04:05"), t.HandleID, t.AchievedGBs, t.TailP99Ms,
+				t.Temperature, t.PowerW, t.Utilization)
+		case "end", "shutdown":
+			fmt.Printf("Stream ended: %s\n", data)
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error watching telemetry: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 // HTTP client functions
 func allocateFFM(req AllocationRequest) (*FFMHandle, error) {
 	jsonData, err := json.Marshal(req)
@@ -483,6 +730,111 @@ func getFFM(id string) (*FFMHandle, error) {
 	return &handle, err
 }
 
+func renewFFM(id string, req RenewRequest) (*FFMHandle, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(memqosdURL+"/v1/ffm/"+id+"/renew", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	var handle FFMHandle
+	err = json.Unmarshal(body, &handle)
+	return &handle, err
+}
+
+func freeFFM(id string, force bool) (*FFMHandle, error) {
+	url := memqosdURL + "/v1/ffm/" + id
+	if force {
+		url += "?force=true"
+	}
+
+	httpReq, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	var handle FFMHandle
+	err = json.Unmarshal(body, &handle)
+	return &handle, err
+}
+
+func syncFFM(id string) (*SyncResult, error) {
+	resp, err := http.Post(memqosdURL+"/v1/ffm/"+id+"/sync", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result SyncResult
+	err = json.Unmarshal(body, &result)
+	return &result, err
+}
+
+func snapshotFFM(id, label string) (*Snapshot, error) {
+	jsonData, err := json.Marshal(map[string]string{"label": label})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(memqosdURL+"/v1/ffm/"+id+"/snapshot", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	var snap Snapshot
+	err = json.Unmarshal(body, &snap)
+	return &snap, err
+}
+
 func getTelemetry(id string) (*TelemetryResponse, error) {
 	resp, err := http.Get(memqosdURL + "/v1/ffm/" + id + "/telemetry")
 	if err != nil {
@@ -504,6 +856,40 @@ func getTelemetry(id string) (*TelemetryResponse, error) {
 	return &telemetry, err
 }
 
+// streamTelemetry reads a Server-Sent Events stream and calls onEvent for
+// each event until the server closes it
+func streamTelemetry(streamURL string, onEvent func(event string, data []byte)) error {
+	resp, err := http.Get(streamURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var event string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data != nil {
+				onEvent(event, data)
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		}
+	}
+	return scanner.Err()
+}
+
 func adjustBandwidth(id string, req BandwidthAdjustRequest) error {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
@@ -531,31 +917,58 @@ func adjustBandwidth(id string, req BandwidthAdjustRequest) error {
 	return nil
 }
 
-func migrateTier(id string, req LatencyClassAdjustRequest) error {
+func migrateTier(id string, req LatencyClassAdjustRequest) (*Migration, error) {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	httpReq, err := http.NewRequest("PATCH", memqosdURL+"/v1/ffm/"+id+"/latency_class", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	var migration Migration
+	err = json.Unmarshal(body, &migration)
+	return &migration, err
+}
+
+func getMigration(id, migrationID string) (*Migration, error) {
+	resp, err := http.Get(memqosdURL + "/v1/ffm/" + id + "/migrations/" + migrationID)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
 	}
 
-	return nil
+	var migration Migration
+	err = json.Unmarshal(body, &migration)
+	return &migration, err
 }
 
 // Helper functions
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -34,6 +35,7 @@ type AttestationResult struct {
 	PQCSignature   string    `json:"pqc_signature"`
 	IssuedAt       time.Time `json:"issued_at"`
 	ExpiresAt      time.Time `json:"expires_at"`
+	Ticket         string    `json:"ticket,omitempty"` // signed, for offline verification
 	Error          string    `json:"error,omitempty"`
 }
 
@@ -74,15 +76,17 @@ type AttestationService struct {
 	spdmSessions map[string]*SPDMResponse
 	mutex        sync.RWMutex
 	nextID       int
+	signer       *ticketSigner
 }
 
 // NewAttestationService creates a new attestation service
-func NewAttestationService() *AttestationService {
+func NewAttestationService(signer *ticketSigner) *AttestationService {
 	service := &AttestationService{
 		attestations: make(map[string]*AttestationResult),
 		measuredBoot: make(map[string]*MeasuredBoot),
 		spdmSessions: make(map[string]*SPDMResponse),
 		nextID:       1,
+		signer:       signer,
 	}
 
 	// Initialize with some mock measured boot data
@@ -138,6 +142,7 @@ func (s *AttestationService) AttestDevice(req AttestationRequest) (*AttestationR
 	}
 
 	// Create attestation result
+	now := time.Now()
 	result := &AttestationResult{
 		DeviceID:      req.DeviceID,
 		AttestationID: attestationID,
@@ -146,8 +151,26 @@ func (s *AttestationService) AttestDevice(req AttestationRequest) (*AttestationR
 		FirmwareValid: firmwareValid,
 		ConfigValid:   configValid,
 		PQCSignature:  pqcSignature,
-		IssuedAt:      time.Now(),
-		ExpiresAt:     time.Now().Add(24 * time.Hour),
+		IssuedAt:      now,
+		ExpiresAt:     now.Add(24 * time.Hour),
+	}
+
+	// Only passing attestations get a ticket
+	if result.Valid {
+		ticket, err := s.signer.Sign(TicketClaims{
+			AttestationID: attestationID,
+			DeviceID:      req.DeviceID,
+			FirmwareHash:  req.FirmwareHash,
+			ConfigHash:    req.ConfigHash,
+			TrustLevel:    trustLevel,
+			Valid:         true,
+			IssuedAt:      result.IssuedAt,
+			ExpiresAt:     result.ExpiresAt,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sign ticket: %v", err)
+		}
+		result.Ticket = ticket
 	}
 
 	s.attestations[attestationID] = result
@@ -335,8 +358,15 @@ func (s *AttestationService) handleHealth(w http.ResponseWriter, r *http.Request
 }
 
 func main() {
+	// Tickets are signed with a key kept in ATTESTD_KEY_FILE, when set
+	signer, err := newTicketSigner(os.Getenv("ATTESTD_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("Failed to load ticket signing key: %v", err)
+	}
+	log.Printf("Signing tickets with ed25519 key %s", signer.keyID)
+
 	// Create attestation service
-	service := NewAttestationService()
+	service := NewAttestationService(signer)
 
 	// Set up HTTP router
 	router := mux.NewRouter()
@@ -344,6 +374,7 @@ func main() {
 
 	// Attestation endpoints
 	api.HandleFunc("/device", service.handleAttestDevice).Methods("POST")
+	api.HandleFunc("/keys", service.handleGetKeys).Methods("GET")
 	api.HandleFunc("/{attestation_id}", service.handleGetAttestation).Methods("GET")
 	api.HandleFunc("/measured-boot/{device_id}", service.handleGetMeasuredBoot).Methods("GET")
 	api.HandleFunc("/spdm", service.handleSPDMAttest).Methods("POST")
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TicketClaims is the signed payload of an attestation ticket. Services
+// such as memqosd verify tickets offline with attestd's public key; the
+// measurements bind a ticket to the firmware and configuration attested.
+type TicketClaims struct {
+	AttestationID string    `json:"attestation_id"`
+	DeviceID      string    `json:"device_id"`
+	FirmwareHash  string    `json:"firmware_hash,omitempty"`
+	ConfigHash    string    `json:"config_hash,omitempty"`
+	TrustLevel    string    `json:"trust_level"`
+	Valid         bool      `json:"valid"`
+	IssuedAt      time.Time `json:"issued_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	KeyID         string    `json:"kid"`
+}
+
+// PublicKey is a published ticket verification key
+type PublicKey struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	PublicKey string `json:"public_key"` // base64
+}
+
+// ticketSigner signs attestation tickets with an Ed25519 key
+type ticketSigner struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// newTicketSigner loads the signing key seed from path, creating it on first
+// use so tickets stay verifiable across restarts. An empty path uses a key
+// that lives only as long as the process.
+func newTicketSigner(path string) (*ticketSigner, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if path == "" {
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+	} else if data, err := os.ReadFile(path); err == nil {
+		seed, err = hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("signing key %s is not a hex Ed25519 seed", path)
+		}
+	} else if os.IsNotExist(err) {
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("write signing key: %v", err)
+		}
+	} else {
+		return nil, fmt.Errorf("read signing key: %v", err)
+	}
+
+	key := ed25519.NewKeyFromSeed(seed)
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return &ticketSigner{keyID: hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+// Sign returns a ticket of the form base64url(claims).base64url(signature)
+func (t *ticketSigner) Sign(claims TicketClaims) (string, error) {
+	claims.KeyID = t.keyID
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(t.key, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// PublicKey returns the key verifiers should use
+func (t *ticketSigner) PublicKey() PublicKey {
+	return PublicKey{
+		KeyID:     t.keyID,
+		Algorithm: "ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(t.key.Public().(ed25519.PublicKey)),
+	}
+}
+
+func (s *AttestationService) handleGetKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Verifiers may cache the key set; it only changes when attestd restarts
+	// without a persistent key
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(map[string][]PublicKey{"keys": {s.signer.PublicKey()}})
+}
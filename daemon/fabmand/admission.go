@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Path priorities, from QoSConfig.Priority
+const (
+	PriorityGold   = "gold"
+	PrioritySilver = "silver"
+	PriorityBronze = "bronze"
+)
+
+// priorityRank orders priorities; a path may only preempt lower-ranked ones
+var priorityRank = map[string]int{
+	PriorityGold:   3,
+	PrioritySilver: 2,
+	PriorityBronze: 1,
+}
+
+// errOversubscribed is returned when a device cannot carry a path's
+// guaranteed bandwidth
+var errOversubscribed = errors.New("oversubscribed")
+
+// normalizePriority validates a QoS priority; paths without one are bronze
+func normalizePriority(priority string) (string, error) {
+	if priority == "" {
+		return PriorityBronze, nil
+	}
+	if _, ok := priorityRank[priority]; !ok {
+		return "", fmt.Errorf("invalid priority: %s (want gold, silver or bronze)", priority)
+	}
+	return priority, nil
+}
+
+// availableBandwidth returns the device bandwidth not reserved by paths
+func (d *CXLDevice) availableBandwidth() uint64 {
+	if d.ReservedBandwidth >= d.Bandwidth {
+		return 0
+	}
+	return d.Bandwidth - d.ReservedBandwidth
+}
+
+// resources returns the devices and links a path reserves bandwidth on
+func (p *FabricPath) resources() []string {
+	return append([]string{p.SourceDevice, p.TargetDevice}, p.Links...)
+}
+
+// reservePathLocked reserves a path's bandwidth on its devices and links;
+// callers must hold s.mutex
+func (s *FabricManagerService) reservePathLocked(p *FabricPath) {
+	s.devices[p.SourceDevice].ReservedBandwidth += p.Bandwidth
+	s.devices[p.TargetDevice].ReservedBandwidth += p.Bandwidth
+	for _, id := range p.Links {
+		s.links[id].ReservedGbps += p.Bandwidth
+	}
+}
+
+// releasePathLocked returns a path's bandwidth to its devices and links;
+// callers must hold s.mutex
+func (s *FabricManagerService) releasePathLocked(p *FabricPath) {
+	release := func(reserved *uint64) {
+		if *reserved < p.Bandwidth {
+			*reserved = 0
+			return
+		}
+		*reserved -= p.Bandwidth
+	}
+	if dev, ok := s.devices[p.SourceDevice]; ok {
+		release(&dev.ReservedBandwidth)
+	}
+	if dev, ok := s.devices[p.TargetDevice]; ok {
+		release(&dev.ReservedBandwidth)
+	}
+	for _, id := range p.Links {
+		if l, ok := s.links[id]; ok {
+			release(&l.ReservedGbps)
+		}
+	}
+}
+
+// tryAdmitLocked checks both devices are active, attested where a policy
+// requires it, and can carry demand, and routes it, counting reclaim (keyed
+// by device or link ID) as available. Every admission, including reroutes
+// and restores, goes through here. Callers must hold s.mutex.
+func (s *FabricManagerService) tryAdmitLocked(req PathRequest, demand, maxLatency uint64, reclaim map[string]uint64) (*Route, error) {
+	now := time.Now()
+	for _, id := range []string{req.SourceDevice, req.TargetDevice} {
+		dev := s.devices[id]
+		if dev.Status != "active" {
+			return nil, fmt.Errorf("%w: device %s is %s", errNoRoute, id, dev.Status)
+		}
+		if s.requiresAttestationLocked(id) {
+			if err := s.checkTicketLocked(dev, now); err != nil {
+				return nil, err
+			}
+		}
+		if avail := dev.availableBandwidth() + reclaim[id]; avail < demand {
+			return nil, fmt.Errorf("%w: device %s has %d of %d Gbps available, %d requested", errOversubscribed, id, avail, dev.Bandwidth, demand)
+		}
+	}
+	return s.computeRouteLocked(req, demand, maxLatency, reclaim)
+}
+
+// admitLocked admits a path of demand Gbps. If it does not fit and the
+// request allows preemption, bronze paths below the request's priority,
+// other than self, are counted as free; the route is then returned with the
+// paths that must be preempted to make room for it. Callers must hold
+// s.mutex.
+func (s *FabricManagerService) admitLocked(req PathRequest, demand, maxLatency uint64, self string) (*Route, []*FabricPath, error) {
+	route, err := s.tryAdmitLocked(req, demand, maxLatency, nil)
+	if err == nil || !req.Preempt || priorityRank[req.QoS.Priority] <= priorityRank[PriorityBronze] {
+		return route, nil, err
+	}
+	if !errors.Is(err, errNoRoute) && !errors.Is(err, errOversubscribed) {
+		return nil, nil, err
+	}
+
+	var candidates []*FabricPath
+	reclaim := make(map[string]uint64)
+	for _, p := range s.paths {
+		if p.ID == self || p.Status != "active" || p.QoS.Priority != PriorityBronze {
+			continue
+		}
+		candidates = append(candidates, p)
+		for _, id := range p.resources() {
+			reclaim[id] += p.Bandwidth
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, err
+	}
+	route, perr := s.tryAdmitLocked(req, demand, maxLatency, reclaim)
+	if perr != nil {
+		// Preemption would not help; report why the path does not fit as is
+		return nil, nil, err
+	}
+
+	// Shortfall on each device and link of the route
+	deficit := make(map[string]int64)
+	for _, id := range []string{req.SourceDevice, req.TargetDevice} {
+		if d := int64(demand) - int64(s.devices[id].availableBandwidth()); d > 0 {
+			deficit[id] = d
+		}
+	}
+	for _, id := range route.Links {
+		if d := int64(demand) - int64(s.links[id].available()); d > 0 {
+			deficit[id] = d
+		}
+	}
+
+	// Preempt the newest bronze paths first, only where they free capacity
+	// the route still lacks
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].CreatedAt.Equal(candidates[j].CreatedAt) {
+			return candidates[i].CreatedAt.After(candidates[j].CreatedAt)
+		}
+		return candidates[i].ID > candidates[j].ID
+	})
+	var victims []*FabricPath
+	for _, p := range candidates {
+		if len(deficit) == 0 {
+			break
+		}
+		helps := false
+		for _, id := range p.resources() {
+			if deficit[id] > 0 {
+				helps = true
+			}
+		}
+		if !helps {
+			continue
+		}
+		victims = append(victims, p)
+		for _, id := range p.resources() {
+			if d, ok := deficit[id]; ok {
+				if d -= int64(p.Bandwidth); d > 0 {
+					deficit[id] = d
+				} else {
+					delete(deficit, id)
+				}
+			}
+		}
+	}
+	return route, victims, nil
+}
+
+// preemptLocked releases a path's reservations in favour of another path;
+// callers must hold s.mutex
+func (s *FabricManagerService) preemptLocked(p *FabricPath, by string) {
+	s.releasePathLocked(p)
+	p.PreemptedBy = by
+	s.setPathStatusLocked(p, "preempted", "preempted by "+by)
+	log.Printf("Path %s (%s, %d Gbps) preempted by %s", p.ID, p.QoS.Priority, p.Bandwidth, by)
+}
+
+// ResourceUtilization is the bandwidth reserved on one device or link
+type ResourceUtilization struct {
+	ID            string            `json:"id"`
+	CapacityGbps  uint64            `json:"capacity_gbps"`
+	ReservedGbps  uint64            `json:"reserved_gbps"`
+	AvailableGbps uint64            `json:"available_gbps"`
+	Utilization   float64           `json:"utilization"` // reserved / capacity
+	ByPriority    map[string]uint64 `json:"by_priority_gbps"`
+	Paths         []string          `json:"paths"`
+}
+
+// Utilization reports fabric bandwidth reservations
+type Utilization struct {
+	Devices        []ResourceUtilization `json:"devices"`
+	Links          []ResourceUtilization `json:"links"`
+	ActivePaths    int                   `json:"active_paths"`
+	DegradedPaths  int                   `json:"degraded_paths"`
+	PreemptedPaths int                   `json:"preempted_paths"`
+}
+
+// GetUtilization returns the bandwidth reserved on every device and link
+func (s *FabricManagerService) GetUtilization() Utilization {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := make(map[string]*ResourceUtilization)
+	entry := func(id string, capacity, reserved uint64) *ResourceUtilization {
+		u := &ResourceUtilization{
+			ID:           id,
+			CapacityGbps: capacity,
+			ReservedGbps: reserved,
+			ByPriority:   map[string]uint64{PriorityGold: 0, PrioritySilver: 0, PriorityBronze: 0},
+			Paths:        []string{},
+		}
+		if reserved < capacity {
+			u.AvailableGbps = capacity - reserved
+		}
+		if capacity > 0 {
+			u.Utilization = float64(reserved) / float64(capacity)
+		}
+		entries[id] = u
+		return u
+	}
+
+	util := Utilization{Devices: []ResourceUtilization{}, Links: []ResourceUtilization{}}
+	for _, d := range s.devices {
+		entry(d.ID, d.Bandwidth, d.ReservedBandwidth)
+	}
+	for _, l := range s.links {
+		entry(l.ID, l.CapacityGbps, l.ReservedGbps)
+	}
+	for _, p := range s.paths {
+		switch p.Status {
+		case "active":
+			util.ActivePaths++
+		case "degraded":
+			util.DegradedPaths++
+			continue
+		case "preempted":
+			util.PreemptedPaths++
+			continue
+		default:
+			continue
+		}
+		for _, id := range p.resources() {
+			if u, ok := entries[id]; ok {
+				u.ByPriority[p.QoS.Priority] += p.Bandwidth
+				u.Paths = append(u.Paths, p.ID)
+			}
+		}
+	}
+
+	for _, d := range s.devices {
+		u := entries[d.ID]
+		sort.Strings(u.Paths)
+		util.Devices = append(util.Devices, *u)
+	}
+	for _, l := range s.links {
+		u := entries[l.ID]
+		sort.Strings(u.Paths)
+		util.Links = append(util.Links, *u)
+	}
+	sort.Slice(util.Devices, func(i, j int) bool { return util.Devices[i].ID < util.Devices[j].ID })
+	sort.Slice(util.Links, func(i, j int) bool { return util.Links[i].ID < util.Links[j].ID })
+	return util
+}
+
+func (s *FabricManagerService) handleUtilization(w http.ResponseWriter, r *http.Request) {
+	util := s.GetUtilization()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(util)
+}
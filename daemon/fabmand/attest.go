@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// attestTimeout bounds one request to attestd
+	attestTimeout = 5 * time.Second
+	// keyRefreshInterval limits how often an unknown key ID refetches keys
+	keyRefreshInterval = 30 * time.Second
+)
+
+var (
+	// errUnattested is returned when a device has no valid attestation
+	errUnattested = errors.New("attestation required")
+	// errAttestd is returned when attestd cannot be reached or misbehaves
+	errAttestd = errors.New("attestd unavailable")
+)
+
+// ticketClaims is the signed payload of an attestd ticket
+type ticketClaims struct {
+	AttestationID string    `json:"attestation_id"`
+	DeviceID      string    `json:"device_id"`
+	FirmwareHash  string    `json:"firmware_hash"`
+	ConfigHash    string    `json:"config_hash"`
+	TrustLevel    string    `json:"trust_level"`
+	Valid         bool      `json:"valid"`
+	IssuedAt      time.Time `json:"issued_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	KeyID         string    `json:"kid"`
+}
+
+// attestClient asks attestd to attest devices and verifies the signed
+// tickets it returns against attestd's published keys
+type attestClient struct {
+	baseURL string
+	client  *http.Client
+
+	mu            sync.Mutex
+	keys          map[string]ed25519.PublicKey
+	keysFetchedAt time.Time
+}
+
+// attestdURL returns attestd's address from ATTESTD_URL
+func attestdURL() string {
+	if v := os.Getenv("ATTESTD_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:8084"
+}
+
+func newAttestClient(baseURL string) *attestClient {
+	return &attestClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: attestTimeout},
+		keys:    make(map[string]ed25519.PublicKey),
+	}
+}
+
+// deviceMeasurements returns the firmware and configuration digests a
+// device is attested with. The discovery backends do not collect SPDM
+// measurements, so these are digests of the identity and configuration the
+// device reports; any change to them invalidates its ticket.
+func deviceMeasurements(dev *CXLDevice) (firmware, config string) {
+	fw := sha256.Sum256([]byte(strings.Join([]string{dev.VendorID, dev.DeviceID, dev.FirmwareVer}, ":")))
+	cfg := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", dev.Type, dev.SerialNumber, dev.Capacity)))
+	return hex.EncodeToString(fw[:]), hex.EncodeToString(cfg[:])
+}
+
+// Attest submits a device's measurements to attestd and returns the
+// verified claims and signed ticket. A device attestd does not trust wraps
+// errUnattested; attestd failures wrap errAttestd.
+func (c *attestClient) Attest(ctx context.Context, dev *CXLDevice, requirePQC bool) (*ticketClaims, string, error) {
+	firmware, config := deviceMeasurements(dev)
+	body, err := json.Marshal(map[string]interface{}{
+		"device_id":     dev.ID,
+		"device_type":   dev.Type,
+		"firmware_hash": firmware,
+		"config_hash":   config,
+		"require_pqc":   requirePQC,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var result struct {
+		Valid      bool   `json:"valid"`
+		TrustLevel string `json:"trust_level"`
+		Ticket     string `json:"ticket"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/attest/device", body, &result); err != nil {
+		return nil, "", err
+	}
+	if !result.Valid || result.Ticket == "" {
+		return nil, "", fmt.Errorf("%w: attestd rejected device %s (trust level %s)", errUnattested, dev.ID, result.TrustLevel)
+	}
+
+	claims, err := c.verify(ctx, result.Ticket)
+	if err != nil {
+		return nil, "", err
+	}
+	// A ticket is only worth keeping if it vouches for what was measured
+	if claims.DeviceID != dev.ID || claims.FirmwareHash != firmware || claims.ConfigHash != config {
+		return nil, "", fmt.Errorf("%w: attestd ticket does not match device %s", errAttestd, dev.ID)
+	}
+	if !claims.Valid || !time.Now().Before(claims.ExpiresAt) {
+		return nil, "", fmt.Errorf("%w: attestd issued an invalid or expired ticket for %s", errAttestd, dev.ID)
+	}
+	return claims, result.Ticket, nil
+}
+
+// verify checks a base64url(claims).base64url(signature) ticket's signature
+func (c *attestClient) verify(ctx context.Context, ticket string) (*ticketClaims, error) {
+	payloadPart, sigPart, _ := strings.Cut(ticket, ".")
+	payload, err1 := base64.RawURLEncoding.DecodeString(payloadPart)
+	sig, err2 := base64.RawURLEncoding.DecodeString(sigPart)
+	var claims ticketClaims
+	if err1 != nil || err2 != nil || json.Unmarshal(payload, &claims) != nil {
+		return nil, fmt.Errorf("%w: malformed attestation ticket", errAttestd)
+	}
+
+	key, err := c.key(ctx, claims.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return nil, fmt.Errorf("%w: attestation ticket signature invalid", errAttestd)
+	}
+	return &claims, nil
+}
+
+// key returns the public key with ID kid, refetching attestd's key set when
+// the ID is unknown, e.g. after attestd restarted with a new key
+func (c *attestClient) key(ctx context.Context, kid string) (ed25519.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.keysFetchedAt) >= keyRefreshInterval
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("%w: attestation ticket signed by unknown key %q", errAttestd, kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyID     string `json:"kid"`
+			Algorithm string `json:"alg"`
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/attest/keys", nil, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if k.Algorithm != "ed25519" || err != nil || len(raw) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.KeyID] = ed25519.PublicKey(raw)
+	}
+	c.mu.Lock()
+	c.keys, c.keysFetchedAt = keys, time.Now()
+	c.mu.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: attestation ticket signed by unknown key %q", errAttestd, kid)
+	}
+	return key, nil
+}
+
+// do sends a request to attestd and decodes a 2xx JSON response into out
+func (c *attestClient) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAttestd, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s %s returned HTTP %d", errAttestd, method, path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%w: invalid response to %s %s: %v", errAttestd, method, path, err)
+	}
+	return nil
+}
+
+// newTicketID returns a random attestation ticket ID
+func newTicketID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ticket-" + hex.EncodeToString(b), nil
+}
+
+// AttestDevice has attestd attest a device's current measurements and
+// records the signed ticket as the device's attestation, replacing any
+// earlier one. attestd is called without holding s.mutex.
+func (s *FabricManagerService) AttestDevice(req AttestationRequest) (*AttestationTicket, error) {
+	s.mutex.RLock()
+	dev, ok := s.devices[req.DeviceID]
+	var snapshot CXLDevice
+	if ok {
+		snapshot = *dev
+	}
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("device %s %w", req.DeviceID, errNotFound)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*attestTimeout)
+	defer cancel()
+	claims, token, err := s.attest.Attest(ctx, &snapshot, req.RequirePQC)
+	if err != nil {
+		return nil, err
+	}
+	ticketID, err := newTicketID()
+	if err != nil {
+		return nil, err
+	}
+	_, sig, _ := strings.Cut(token, ".")
+	ticket := &AttestationTicket{
+		DeviceID:      req.DeviceID,
+		TicketID:      ticketID,
+		AttestationID: claims.AttestationID,
+		TrustLevel:    claims.TrustLevel,
+		FirmwareHash:  claims.FirmwareHash,
+		ConfigHash:    claims.ConfigHash,
+		Signature:     sig,
+		Ticket:        token,
+		IssuedAt:      claims.IssuedAt,
+		ExpiresAt:     claims.ExpiresAt,
+		Valid:         true,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dev, ok = s.devices[req.DeviceID]
+	if !ok {
+		return nil, fmt.Errorf("device %s %w", req.DeviceID, errNotFound)
+	}
+	// Rediscovery may have changed the device while attestd was asked
+	if firmware, config := deviceMeasurements(dev); firmware != ticket.FirmwareHash || config != ticket.ConfigHash {
+		return nil, fmt.Errorf("%w: device %s changed during attestation", errUnattested, req.DeviceID)
+	}
+	delete(s.attestations, dev.Attestation)
+	s.attestations[ticketID] = ticket
+	dev.Attestation = ticketID
+	log.Printf("Device %s attested by attestd (%s, trust level %s)", dev.ID, claims.AttestationID, claims.TrustLevel)
+	// Paths held back for want of a valid ticket can be restored now
+	s.restoreLocked()
+
+	out := *ticket
+	return &out, nil
+}
+
+// VerifyAttestation returns a ticket with Valid reflecting whether it is
+// unexpired, still the device's attestation, and still matches the
+// device's measurements
+func (s *FabricManagerService) VerifyAttestation(ticketID string) (*AttestationTicket, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ticket, exists := s.attestations[ticketID]
+	if !exists {
+		return nil, fmt.Errorf("attestation ticket %s %w", ticketID, errNotFound)
+	}
+	out := *ticket
+	out.Valid = s.checkTicketLocked(s.devices[ticket.DeviceID], time.Now()) == nil
+	return &out, nil
+}
+
+// checkTicketLocked returns nil if a device holds a valid, unexpired ticket
+// bound to its current measurements; callers must hold s.mutex
+func (s *FabricManagerService) checkTicketLocked(dev *CXLDevice, now time.Time) error {
+	if dev == nil {
+		return fmt.Errorf("%w: unknown device", errUnattested)
+	}
+	ticket, ok := s.attestations[dev.Attestation]
+	if !ok {
+		return fmt.Errorf("%w: device %s has no attestation ticket", errUnattested, dev.ID)
+	}
+	if !ticket.Valid || !now.Before(ticket.ExpiresAt) {
+		return fmt.Errorf("%w: attestation ticket for device %s expired", errUnattested, dev.ID)
+	}
+	if firmware, config := deviceMeasurements(dev); firmware != ticket.FirmwareHash || config != ticket.ConfigHash {
+		return fmt.Errorf("%w: device %s changed since it was attested", errUnattested, dev.ID)
+	}
+	return nil
+}
+
+// requiresAttestationLocked reports whether an enabled device policy demands
+// attestation of a device, either by ID or for all devices with target "*";
+// callers must hold s.mutex
+func (s *FabricManagerService) requiresAttestationLocked(deviceID string) bool {
+	for _, p := range s.policies {
+		if p.Enabled && p.Match == "device" && p.RequireAttestation && (p.TargetID == deviceID || p.TargetID == "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FabricManagerService) handleAttestDevice(w http.ResponseWriter, r *http.Request) {
+	var req AttestationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := s.AttestDevice(req)
+	if err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ticket)
+}
+
+func (s *FabricManagerService) handleVerifyAttestation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ticketID := vars["ticket_id"]
+
+	ticket, err := s.VerifyAttestation(ticketID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
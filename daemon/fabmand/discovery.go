@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultDiscoveryInterval is how often the fabric is rediscovered
+const defaultDiscoveryInterval = 30 * time.Second
+
+// Inventory is the fabric a discoverer found: devices, and the switches and
+// links connecting them
+type Inventory struct {
+	Devices  []*CXLDevice
+	Switches []*FabricSwitch
+	Links    []*FabricLink
+}
+
+// DeviceDiscoverer finds the CXL devices and fabric topology of a host
+type DeviceDiscoverer interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Discover returns the fabric as it is now
+	Discover() (*Inventory, error)
+}
+
+// discovererFromEnv picks the discovery backend from FABMAND_DISCOVERY:
+// "sysfs" reads FABMAND_SYSFS_ROOT (default /sys), "simulator" generates
+// FABMAND_SIM_DEVICES devices, and "inventory" (the default) loads
+// FABMAND_INVENTORY or the built-in lab fabric
+func discovererFromEnv() (DeviceDiscoverer, error) {
+	switch backend := os.Getenv("FABMAND_DISCOVERY"); backend {
+	case "", "inventory":
+		return NewInventoryDiscoverer(os.Getenv("FABMAND_INVENTORY")), nil
+	case "sysfs":
+		root := os.Getenv("FABMAND_SYSFS_ROOT")
+		if root == "" {
+			root = "/sys"
+		}
+		return NewSysfsDiscoverer(root), nil
+	case "simulator":
+		devices := defaultSimDevices
+		if v := os.Getenv("FABMAND_SIM_DEVICES"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid FABMAND_SIM_DEVICES %q", v)
+			}
+			devices = n
+		}
+		var seed int64 = 1
+		if v := os.Getenv("FABMAND_SIM_SEED"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FABMAND_SIM_SEED %q", v)
+			}
+			seed = n
+		}
+		return NewSimulatorDiscoverer(devices, seed), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %q (want inventory, sysfs or simulator)", backend)
+	}
+}
+
+// Rediscover runs the discoverer once and applies what it found
+func (s *FabricManagerService) Rediscover(d DeviceDiscoverer) error {
+	inv, err := d.Discover()
+	if err != nil {
+		return fmt.Errorf("%s discovery: %v", d.Name(), err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.applyInventoryLocked(inv, time.Now())
+	return nil
+}
+
+// applyInventoryLocked merges a discovered inventory into the fabric.
+// Devices, switches and links seen again keep their reservations and
+// administrative status; missing ones go offline (links down) and their
+// paths fail over. Callers must hold s.mutex.
+func (s *FabricManagerService) applyInventoryLocked(inv *Inventory, now time.Time) {
+	var lost []string
+	returned := false
+	// Log devices one by one only after the initial discovery
+	initial := len(s.devices) == 0
+
+	seen := make(map[string]bool, len(inv.Devices))
+	for _, d := range inv.Devices {
+		seen[d.ID] = true
+		cur, ok := s.devices[d.ID]
+		if !ok {
+			d.Status = "active"
+			d.ReservedBandwidth = 0
+			d.LastSeen = now
+			s.devices[d.ID] = d
+			if !initial {
+				log.Printf("Discovered device %s (%s)", d.ID, d.Type)
+			}
+			returned = true
+			continue
+		}
+		cur.Type = d.Type
+		cur.VendorID = d.VendorID
+		cur.DeviceID = d.DeviceID
+		cur.SerialNumber = d.SerialNumber
+		cur.FirmwareVer = d.FirmwareVer
+		cur.Capacity = d.Capacity
+		cur.Latency = d.Latency
+		cur.Bandwidth = d.Bandwidth
+		cur.Regions = d.Regions
+		cur.LastSeen = now
+		if cur.Status == "offline" {
+			if cur.adminStatus != "" {
+				cur.Status, cur.adminStatus = cur.adminStatus, ""
+				log.Printf("Device %s is back, in %s", cur.ID, cur.Status)
+				continue
+			}
+			cur.Status = "active"
+			log.Printf("Device %s is back", cur.ID)
+			returned = true
+		}
+	}
+	for id, cur := range s.devices {
+		if !seen[id] && cur.Status != "offline" {
+			if cur.Status != "active" {
+				cur.adminStatus = cur.Status
+			}
+			cur.Status = "offline"
+			log.Printf("Device %s is missing, marked offline", id)
+			lost = append(lost, id)
+		}
+	}
+
+	seen = make(map[string]bool, len(inv.Switches))
+	for _, sw := range inv.Switches {
+		seen[sw.ID] = true
+		cur, ok := s.switches[sw.ID]
+		if !ok {
+			sw.Status = "active"
+			s.switches[sw.ID] = sw
+			returned = true
+			continue
+		}
+		cur.Ports = sw.Ports
+		cur.LatencyNs = sw.LatencyNs
+		if cur.Status == "offline" {
+			cur.Status = "active"
+			log.Printf("Switch %s is back", cur.ID)
+			returned = true
+		}
+	}
+	for id, cur := range s.switches {
+		if !seen[id] && cur.Status != "offline" {
+			cur.Status = "offline"
+			log.Printf("Switch %s is missing, marked offline", id)
+			lost = append(lost, id)
+		}
+	}
+
+	seen = make(map[string]bool, len(inv.Links))
+	for _, l := range inv.Links {
+		seen[l.ID] = true
+		cur, ok := s.links[l.ID]
+		if !ok {
+			l.Status = "up"
+			l.ReservedGbps = 0
+			s.links[l.ID] = l
+			returned = true
+			continue
+		}
+		cur.CapacityGbps = l.CapacityGbps
+		cur.LatencyNs = l.LatencyNs
+		if cur.Status == "down" {
+			cur.Status = "up"
+			log.Printf("Link %s is back", cur.ID)
+			returned = true
+		}
+	}
+	for id, cur := range s.links {
+		if !seen[id] && cur.Status != "down" {
+			cur.Status = "down"
+			log.Printf("Link %s is missing, marked down", id)
+			lost = append(lost, id)
+		}
+	}
+
+	// Fail over only once everything missing is out of service, so that
+	// paths are not rerouted onto another missing switch or link
+	for _, id := range lost {
+		status := "offline"
+		if _, ok := s.links[id]; ok {
+			status = "down"
+		}
+		s.failoverLocked(id, status)
+	}
+	if returned {
+		s.restoreLocked()
+	}
+}
+
+// runDiscovery rediscovers the fabric every interval until stop is closed.
+// A failed discovery leaves the fabric as it was.
+func (s *FabricManagerService) runDiscovery(d DeviceDiscoverer, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.Rediscover(d); err != nil {
+				log.Printf("Rediscovery failed: %v", err)
+			}
+		}
+	}
+}
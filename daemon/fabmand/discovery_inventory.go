@@ -0,0 +1,143 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// labInventory is the built-in fabric used when no inventory file is set
+//
+//go:embed lab_inventory.yaml
+var labInventory []byte
+
+// InventoryFile mirrors the layout of a static inventory YAML file
+type InventoryFile struct {
+	Devices  []InventoryDevice `yaml:"devices"`
+	Switches []InventorySwitch `yaml:"switches"`
+	Links    []InventoryLink   `yaml:"links"`
+}
+
+// InventoryDevice describes one CXL device in an inventory file
+type InventoryDevice struct {
+	ID              string   `yaml:"id"`
+	Type            string   `yaml:"type"`
+	VendorID        string   `yaml:"vendor_id"`
+	DeviceID        string   `yaml:"device_id"`
+	SerialNumber    string   `yaml:"serial_number"`
+	FirmwareVersion string   `yaml:"firmware_version"`
+	CapacityBytes   uint64   `yaml:"capacity_bytes"`
+	LatencyNs       uint64   `yaml:"latency_ns"`
+	BandwidthGbps   uint64   `yaml:"bandwidth_gbps"`
+	Regions         []string `yaml:"regions"`
+}
+
+// InventorySwitch describes one switch in an inventory file
+type InventorySwitch struct {
+	ID        string `yaml:"id"`
+	Ports     int    `yaml:"ports"`
+	LatencyNs uint64 `yaml:"latency_ns"`
+}
+
+// InventoryLink describes one link in an inventory file
+type InventoryLink struct {
+	ID           string `yaml:"id"`
+	A            string `yaml:"a"`
+	B            string `yaml:"b"`
+	CapacityGbps uint64 `yaml:"capacity_gbps"`
+	LatencyNs    uint64 `yaml:"latency_ns"`
+}
+
+// inventoryDiscoverer reads a static inventory of a lab machine. The file
+// is reread on every discovery, so editing it adds or retires devices.
+type inventoryDiscoverer struct {
+	path string // empty for the built-in lab fabric
+}
+
+// NewInventoryDiscoverer reads the inventory at path, or the built-in lab
+// fabric when path is empty
+func NewInventoryDiscoverer(path string) DeviceDiscoverer {
+	return inventoryDiscoverer{path: path}
+}
+
+func (d inventoryDiscoverer) Name() string {
+	if d.path == "" {
+		return "inventory (built-in lab fabric)"
+	}
+	return "inventory " + d.path
+}
+
+func (d inventoryDiscoverer) Discover() (*Inventory, error) {
+	data := labInventory
+	if d.path != "" {
+		var err error
+		if data, err = os.ReadFile(d.path); err != nil {
+			return nil, fmt.Errorf("read inventory: %v", err)
+		}
+	}
+	var file InventoryFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse inventory %s: %v", d.path, err)
+	}
+	return file.inventory()
+}
+
+// inventory validates the file and converts it into an Inventory
+func (f *InventoryFile) inventory() (*Inventory, error) {
+	inv := &Inventory{}
+	ids := make(map[string]bool)
+	nodes := make(map[string]bool) // devices and switches links may join
+	claim := func(kind, id string) error {
+		if id == "" {
+			return fmt.Errorf("%s without id", kind)
+		}
+		if ids[id] {
+			return fmt.Errorf("duplicate id %q", id)
+		}
+		ids[id] = true
+		return nil
+	}
+
+	for _, d := range f.Devices {
+		if err := claim("device", d.ID); err != nil {
+			return nil, err
+		}
+		switch d.Type {
+		case "Type-1", "Type-2", "Type-3":
+		default:
+			return nil, fmt.Errorf("device %s: invalid type %q (want Type-1, Type-2 or Type-3)", d.ID, d.Type)
+		}
+		nodes[d.ID] = true
+		inv.Devices = append(inv.Devices, &CXLDevice{
+			ID:           d.ID,
+			Type:         d.Type,
+			VendorID:     d.VendorID,
+			DeviceID:     d.DeviceID,
+			SerialNumber: d.SerialNumber,
+			FirmwareVer:  d.FirmwareVersion,
+			Capacity:     d.CapacityBytes,
+			Latency:      d.LatencyNs,
+			Bandwidth:    d.BandwidthGbps,
+			Regions:      d.Regions,
+		})
+	}
+	for _, sw := range f.Switches {
+		if err := claim("switch", sw.ID); err != nil {
+			return nil, err
+		}
+		nodes[sw.ID] = true
+		inv.Switches = append(inv.Switches, &FabricSwitch{ID: sw.ID, Ports: sw.Ports, LatencyNs: sw.LatencyNs})
+	}
+	for _, l := range f.Links {
+		if err := claim("link", l.ID); err != nil {
+			return nil, err
+		}
+		if !nodes[l.A] || !nodes[l.B] || l.A == l.B {
+			return nil, fmt.Errorf("link %s: must join two distinct devices or switches, got %q and %q", l.ID, l.A, l.B)
+		}
+		inv.Links = append(inv.Links, &FabricLink{ID: l.ID, A: l.A, B: l.B, CapacityGbps: l.CapacityGbps, LatencyNs: l.LatencyNs})
+	}
+	return inv, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// defaultSimDevices is the size of a simulated fabric
+	defaultSimDevices = 16
+	// simDevicesPerLeaf is how many devices share one leaf switch
+	simDevicesPerLeaf = 8
+	// simSpines is the number of spine switches joining the leaves
+	simSpines = 2
+)
+
+// simulatorDiscoverer generates a synthetic leaf-spine fabric for scale
+// tests. The same device count and seed always give the same fabric, so
+// rediscovery finds nothing missing.
+type simulatorDiscoverer struct {
+	devices int
+	seed    int64
+}
+
+// NewSimulatorDiscoverer generates a fabric of n devices, devices split
+// across leaf switches that each connect to every spine
+func NewSimulatorDiscoverer(n int, seed int64) DeviceDiscoverer {
+	return simulatorDiscoverer{devices: n, seed: seed}
+}
+
+func (d simulatorDiscoverer) Name() string {
+	return fmt.Sprintf("simulator (%d devices, seed %d)", d.devices, d.seed)
+}
+
+func (d simulatorDiscoverer) Discover() (*Inventory, error) {
+	rng := rand.New(rand.NewSource(d.seed))
+	inv := &Inventory{}
+	linkID := 0
+	link := func(a, b string, capacity, latency uint64) {
+		linkID++
+		inv.Links = append(inv.Links, &FabricLink{
+			ID:           fmt.Sprintf("sim-link-%05d", linkID),
+			A:            a,
+			B:            b,
+			CapacityGbps: capacity,
+			LatencyNs:    latency,
+		})
+	}
+
+	leaves := (d.devices + simDevicesPerLeaf - 1) / simDevicesPerLeaf
+	for i := 0; i < simSpines && leaves > 1; i++ {
+		inv.Switches = append(inv.Switches, &FabricSwitch{ID: fmt.Sprintf("sim-spine-%d", i), Ports: 64, LatencyNs: 25})
+	}
+	for l := 0; l < leaves; l++ {
+		leaf := fmt.Sprintf("sim-leaf-%03d", l)
+		inv.Switches = append(inv.Switches, &FabricSwitch{ID: leaf, Ports: simDevicesPerLeaf + simSpines, LatencyNs: 25})
+		for i := 0; i < simSpines && leaves > 1; i++ {
+			link(leaf, fmt.Sprintf("sim-spine-%d", i), 256, 40)
+		}
+	}
+
+	for i := 0; i < d.devices; i++ {
+		dev := &CXLDevice{
+			ID:           fmt.Sprintf("sim-dev-%04d", i),
+			VendorID:     "0x8086",
+			DeviceID:     "0x0b5a",
+			SerialNumber: fmt.Sprintf("SIM%08d", i),
+			FirmwareVer:  "1.2.3",
+			Type:         "Type-3",
+			Capacity:     uint64(128<<rng.Intn(3)) << 30, // 128, 256 or 512 GiB
+			Latency:      80 + uint64(rng.Intn(81)),      // 80-160 ns
+			Bandwidth:    64,
+		}
+		// Every eighth device is an accelerator
+		if i%simDevicesPerLeaf == simDevicesPerLeaf-1 {
+			dev.Type = "Type-2"
+			dev.VendorID, dev.DeviceID = "0x10de", "0x2204"
+			dev.Capacity = 0
+			dev.Latency = 40 + uint64(rng.Intn(21))
+			dev.Bandwidth = 128
+		}
+		inv.Devices = append(inv.Devices, dev)
+		link(dev.ID, fmt.Sprintf("sim-leaf-%03d", i/simDevicesPerLeaf), dev.Bandwidth, 20)
+	}
+	return inv, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysfs does not report CDAT performance data, so devices, ports and links
+// found there get these nominal figures
+const (
+	sysfsDeviceLatencyNs = 150
+	sysfsDeviceGbps      = 64
+	sysfsPortLatencyNs   = 25
+	sysfsLinkLatencyNs   = 20
+)
+
+// sysfsDiscoverer reads the Linux CXL bus under root (normally /sys).
+// Memdevs become Type-3 devices; root and switch ports become switches,
+// linked along the port hierarchy; regions are attributed to the memdevs
+// whose endpoint decoders they interleave. Pointing root at a fixture tree
+// makes the parsing testable without CXL hardware; testdata/sys is one.
+type sysfsDiscoverer struct {
+	root string
+}
+
+// NewSysfsDiscoverer reads /bus/cxl/devices under root
+func NewSysfsDiscoverer(root string) DeviceDiscoverer {
+	return sysfsDiscoverer{root: root}
+}
+
+func (d sysfsDiscoverer) Name() string {
+	return "sysfs " + d.root
+}
+
+func (d sysfsDiscoverer) Discover() (*Inventory, error) {
+	dir := filepath.Join(d.root, "bus", "cxl", "devices")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read CXL devices: %v", err)
+	}
+
+	inv := &Inventory{}
+	devices := make(map[string]*CXLDevice)
+	endpoints := make(map[string]string) // endpoint port number -> memdev
+	var decoders, regions []string
+	regionsOf := make(map[string]map[string]bool)
+	addRegion := func(memdev, region string) {
+		if _, ok := devices[memdev]; !ok || region == "" {
+			return
+		}
+		if regionsOf[memdev] == nil {
+			regionsOf[memdev] = make(map[string]bool)
+		}
+		regionsOf[memdev][region] = true
+	}
+
+	// Memdevs first, so endpoints and regions can refer to them
+	for _, e := range entries {
+		if !isSysfsDevice(e.Name(), "mem") {
+			continue
+		}
+		dev, err := readSysfsMemdev(dir, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		devices[dev.ID] = dev
+		inv.Devices = append(inv.Devices, dev)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case isSysfsDevice(name, "root"), isSysfsDevice(name, "port"):
+			inv.Switches = append(inv.Switches, &FabricSwitch{ID: name, LatencyNs: sysfsPortLatencyNs})
+			if parent := sysfsParentPort(dir, name); parent != "" {
+				inv.Links = append(inv.Links, &FabricLink{
+					ID:           fmt.Sprintf("link-%s-%s", name, parent),
+					A:            name,
+					B:            parent,
+					CapacityGbps: sysfsDeviceGbps,
+					LatencyNs:    sysfsLinkLatencyNs,
+				})
+			}
+		case isSysfsDevice(name, "endpoint"):
+			// The endpoint's upstream port is its memdev
+			target, err := filepath.EvalSymlinks(filepath.Join(dir, name, "uport"))
+			if err != nil {
+				continue
+			}
+			memdev := filepath.Base(target)
+			dev, ok := devices[memdev]
+			if !ok {
+				continue
+			}
+			endpoints[strings.TrimPrefix(name, "endpoint")] = memdev
+			if parent := sysfsParentPort(dir, name); parent != "" {
+				inv.Links = append(inv.Links, &FabricLink{
+					ID:           fmt.Sprintf("link-%s-%s", memdev, parent),
+					A:            memdev,
+					B:            parent,
+					CapacityGbps: dev.Bandwidth,
+					LatencyNs:    sysfsLinkLatencyNs,
+				})
+			}
+		case strings.HasPrefix(name, "decoder"):
+			decoders = append(decoders, name)
+		case strings.HasPrefix(name, "region"):
+			regions = append(regions, name)
+		}
+	}
+
+	// Endpoint decoders name the region they are committed to; regions list
+	// their endpoint decoders as targetN
+	for _, name := range decoders {
+		port, _, _ := strings.Cut(strings.TrimPrefix(name, "decoder"), ".")
+		if memdev, ok := endpoints[port]; ok {
+			addRegion(memdev, readSysfsAttr(filepath.Join(dir, name), "region"))
+		}
+	}
+	for _, region := range regions {
+		ways, _ := strconv.Atoi(readSysfsAttr(filepath.Join(dir, region), "interleave_ways"))
+		for i := 0; i < ways; i++ {
+			decoder := readSysfsAttr(filepath.Join(dir, region), fmt.Sprintf("target%d", i))
+			port, _, _ := strings.Cut(strings.TrimPrefix(decoder, "decoder"), ".")
+			addRegion(endpoints[port], region)
+		}
+	}
+	for memdev, set := range regionsOf {
+		for region := range set {
+			devices[memdev].Regions = append(devices[memdev].Regions, region)
+		}
+		sort.Strings(devices[memdev].Regions)
+	}
+	return inv, nil
+}
+
+// readSysfsMemdev reads a memdev and the PCI device it sits on
+func readSysfsMemdev(dir, name string) (*CXLDevice, error) {
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %v", name, err)
+	}
+	dev := &CXLDevice{
+		ID:          name,
+		Type:        "Type-3",
+		FirmwareVer: readSysfsAttr(path, "firmware_version"),
+		Capacity:    readSysfsHex(path, "ram/size") + readSysfsHex(path, "pmem/size"),
+		Latency:     sysfsDeviceLatencyNs,
+		Bandwidth:   sysfsDeviceGbps,
+	}
+	if serial := readSysfsHex(path, "serial"); serial != 0 {
+		dev.SerialNumber = fmt.Sprintf("0x%016x", serial)
+	}
+	pci := filepath.Dir(path)
+	dev.VendorID = readSysfsAttr(pci, "vendor")
+	dev.DeviceID = readSysfsAttr(pci, "device")
+	return dev, nil
+}
+
+// sysfsParentPort returns the root or switch port above a port or endpoint,
+// from where its device directory sits in the hierarchy
+func sysfsParentPort(dir, name string) string {
+	path, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	for p := filepath.Dir(path); p != filepath.Dir(p); p = filepath.Dir(p) {
+		base := filepath.Base(p)
+		if isSysfsDevice(base, "root") || isSysfsDevice(base, "port") {
+			return base
+		}
+	}
+	return ""
+}
+
+// isSysfsDevice reports whether name is a CXL bus device of a kind, such as
+// port3 for "port"
+func isSysfsDevice(name, kind string) bool {
+	_, err := strconv.Atoi(strings.TrimPrefix(name, kind))
+	return strings.HasPrefix(name, kind) && err == nil
+}
+
+// readSysfsAttr returns a trimmed sysfs attribute, or "" if unreadable
+func readSysfsAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readSysfsHex parses a numeric sysfs attribute such as a 0x-prefixed size,
+// or returns 0
+func readSysfsHex(dir, name string) uint64 {
+	n, err := strconv.ParseUint(readSysfsAttr(dir, name), 0, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSysfsDiscoverer(t *testing.T) {
+	inv, err := NewSysfsDiscoverer(filepath.Join("testdata", "sys")).Discover()
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+
+	devices := make(map[string]*CXLDevice)
+	for _, d := range inv.Devices {
+		devices[d.ID] = d
+	}
+	wantDevices := []struct {
+		id       string
+		serial   string
+		firmware string
+		deviceID string
+		capacity uint64
+		regions  []string
+	}{
+		{"mem0", "0x000000001a2b3c4d", "BWFW 1.4.2", "0x0d93", 16 << 30, []string{"region0"}},
+		{"mem1", "0x000000005e6f7081", "BWFW 1.5.0", "0x0d93", 24 << 30, []string{"region0", "region1"}},
+	}
+	if len(devices) != len(wantDevices) {
+		t.Errorf("found %d devices, want %d", len(devices), len(wantDevices))
+	}
+	for _, want := range wantDevices {
+		d, ok := devices[want.id]
+		if !ok {
+			t.Errorf("memdev %s not found", want.id)
+			continue
+		}
+		if d.Type != "Type-3" || d.VendorID != "0x8086" || d.DeviceID != want.deviceID {
+			t.Errorf("%s: type %q vendor %q device %q", want.id, d.Type, d.VendorID, d.DeviceID)
+		}
+		if d.SerialNumber != want.serial || d.FirmwareVer != want.firmware {
+			t.Errorf("%s: serial %q firmware %q, want %q %q", want.id, d.SerialNumber, d.FirmwareVer, want.serial, want.firmware)
+		}
+		if d.Capacity != want.capacity {
+			t.Errorf("%s: capacity %d, want %d", want.id, d.Capacity, want.capacity)
+		}
+		if !reflect.DeepEqual(d.Regions, want.regions) {
+			t.Errorf("%s: regions %v, want %v", want.id, d.Regions, want.regions)
+		}
+	}
+
+	var switches []string
+	for _, sw := range inv.Switches {
+		switches = append(switches, sw.ID)
+	}
+	sort.Strings(switches)
+	if want := []string{"port1", "root0"}; !reflect.DeepEqual(switches, want) {
+		t.Errorf("switches %v, want %v", switches, want)
+	}
+
+	// Ports link to the port above them and memdevs to their endpoint's
+	// parent port
+	links := make(map[string]string)
+	for _, l := range inv.Links {
+		links[l.A] = l.B
+	}
+	wantLinks := map[string]string{"port1": "root0", "mem0": "port1", "mem1": "root0"}
+	if !reflect.DeepEqual(links, wantLinks) {
+		t.Errorf("links %v, want %v", links, wantLinks)
+	}
+}
+
+func TestIsSysfsDevice(t *testing.T) {
+	tests := []struct {
+		name, kind string
+		want       bool
+	}{
+		{"port3", "port", true},
+		{"root0", "root", true},
+		{"root", "root", false},
+		{"portal", "port", false},
+		{"endpoint12", "endpoint", true},
+		{"decoder2.0", "decoder", false},
+	}
+	for _, tt := range tests {
+		if got := isSysfsDevice(tt.name, tt.kind); got != tt.want {
+			t.Errorf("isSysfsDevice(%q, %q) = %v, want %v", tt.name, tt.kind, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testInventory returns a fabric of two devices joined through two switches,
+// leaving out the named devices, switches and links. Each call returns new
+// objects, as a discoverer does.
+func testInventory(missing ...string) *Inventory {
+	gone := make(map[string]bool, len(missing))
+	for _, id := range missing {
+		gone[id] = true
+	}
+
+	inv := &Inventory{}
+	for _, id := range []string{"dev-a", "dev-b"} {
+		if !gone[id] {
+			inv.Devices = append(inv.Devices, &CXLDevice{ID: id, Type: "Type-3", Latency: 100, Bandwidth: 64})
+		}
+	}
+	for _, id := range []string{"sw-0", "sw-1"} {
+		if !gone[id] {
+			inv.Switches = append(inv.Switches, &FabricSwitch{ID: id, Ports: 8, LatencyNs: 20})
+		}
+	}
+	for _, l := range []FabricLink{
+		{ID: "link-a0", A: "dev-a", B: "sw-0"},
+		{ID: "link-0b", A: "sw-0", B: "dev-b"},
+		{ID: "link-a1", A: "dev-a", B: "sw-1"},
+		{ID: "link-1b", A: "sw-1", B: "dev-b"},
+	} {
+		if !gone[l.ID] {
+			l.CapacityGbps, l.LatencyNs = 64, 10
+			link := l
+			inv.Links = append(inv.Links, &link)
+		}
+	}
+	return inv
+}
+
+func TestApplyInventory(t *testing.T) {
+	s := NewFabricManagerService()
+	start := time.Now()
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(), start)
+	s.mutex.Unlock()
+	for id, d := range s.devices {
+		if d.Status != "active" || !d.LastSeen.Equal(start) {
+			t.Fatalf("device %s: status %s, last seen %v", id, d.Status, d.LastSeen)
+		}
+	}
+
+	created, err := s.CreatePath(PathRequest{SourceDevice: "dev-a", TargetDevice: "dev-b", PathType: "PBR", Bandwidth: 16})
+	if err != nil {
+		t.Fatalf("CreatePath: %v", err)
+	}
+	path := s.paths[created.ID]
+	used, spare := path.Route[1], "sw-1"
+	if used == "sw-1" {
+		spare = "sw-0"
+	}
+
+	// A missing switch goes offline and the path moves to the other one
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(used), start.Add(time.Minute))
+	s.mutex.Unlock()
+	if got := s.switches[used].Status; got != "offline" {
+		t.Errorf("missing switch %s is %s, want offline", used, got)
+	}
+	if path.Status != "active" || path.Route[1] != spare {
+		t.Errorf("path is %s via %v, want active via %s", path.Status, path.Route, spare)
+	}
+	if s.devices["dev-a"].ReservedBandwidth != 16 {
+		t.Errorf("dev-a reserves %d Gbps after reroute, want 16", s.devices["dev-a"].ReservedBandwidth)
+	}
+
+	// A missing device goes offline, and its links with the missing switch's
+	// stay down; the path cannot be carried
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(used, "dev-b", "link-1b", "link-0b"), start.Add(2*time.Minute))
+	s.mutex.Unlock()
+	if got := s.devices["dev-b"].Status; got != "offline" {
+		t.Errorf("missing device is %s, want offline", got)
+	}
+	if got := s.links["link-0b"].Status; got != "down" {
+		t.Errorf("missing link is %s, want down", got)
+	}
+	if path.Status != "degraded" {
+		t.Errorf("path to missing device is %s, want degraded", path.Status)
+	}
+	if s.devices["dev-a"].ReservedBandwidth != 0 {
+		t.Errorf("degraded path still reserves %d Gbps on dev-a", s.devices["dev-a"].ReservedBandwidth)
+	}
+
+	// Everything returns and the path is restored
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(), start.Add(3*time.Minute))
+	s.mutex.Unlock()
+	for id, d := range s.devices {
+		if d.Status != "active" {
+			t.Errorf("returned device %s is %s", id, d.Status)
+		}
+	}
+	for id, sw := range s.switches {
+		if sw.Status != "active" {
+			t.Errorf("returned switch %s is %s", id, sw.Status)
+		}
+	}
+	if path.Status != "active" {
+		t.Errorf("path is %s after devices returned, want active", path.Status)
+	}
+}
+
+func TestApplyInventoryKeepsAdminStatus(t *testing.T) {
+	s := NewFabricManagerService()
+	start := time.Now()
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(), start)
+	s.mutex.Unlock()
+	created, err := s.CreatePath(PathRequest{SourceDevice: "dev-a", TargetDevice: "dev-b", PathType: "PBR", Bandwidth: 16})
+	if err != nil {
+		t.Fatalf("CreatePath: %v", err)
+	}
+	path := s.paths[created.ID]
+	if _, err := s.SetDeviceState("dev-b", "maintenance"); err != nil {
+		t.Fatalf("SetDeviceState: %v", err)
+	}
+
+	// A device in maintenance that disappears and returns stays in
+	// maintenance, and its paths stay down
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory("dev-b"), start.Add(time.Minute))
+	s.applyInventoryLocked(testInventory(), start.Add(2*time.Minute))
+	s.mutex.Unlock()
+	if got := s.devices["dev-b"].Status; got != "maintenance" {
+		t.Errorf("returned device is %s, want maintenance", got)
+	}
+	if path.Status != "degraded" {
+		t.Errorf("path to a device in maintenance is %s, want degraded", path.Status)
+	}
+
+	// Taken out of maintenance while missing, it comes back active
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory("dev-b"), start.Add(3*time.Minute))
+	s.mutex.Unlock()
+	if _, err := s.SetDeviceState("dev-b", "active"); err != nil {
+		t.Fatalf("SetDeviceState: %v", err)
+	}
+	if got := s.devices["dev-b"].Status; got != "offline" {
+		t.Errorf("missing device is %s after being set active, want offline", got)
+	}
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(), start.Add(4*time.Minute))
+	s.mutex.Unlock()
+	if got := s.devices["dev-b"].Status; got != "active" || path.Status != "active" {
+		t.Errorf("returned device is %s with path %s, want both active", got, path.Status)
+	}
+}
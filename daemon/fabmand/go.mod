@@ -2,4 +2,7 @@ module github.com/corridoros/fabmand
 
 go 1.21
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -13,31 +14,42 @@ import (
 
 // CXLDevice represents a CXL device in the fabric
 type CXLDevice struct {
-	ID           string    `json:"id"`
-	Type         string    `json:"type"` // Type-1, Type-2, Type-3
-	VendorID     string    `json:"vendor_id"`
-	DeviceID     string    `json:"device_id"`
-	SerialNumber string    `json:"serial_number"`
-	FirmwareVer  string    `json:"firmware_version"`
-	Capacity     uint64    `json:"capacity_bytes"`
-	Latency      uint64    `json:"latency_ns"`
-	Bandwidth    uint64    `json:"bandwidth_gbps"`
-	Status       string    `json:"status"`
-	LastSeen     time.Time `json:"last_seen"`
-	Attestation  string    `json:"attestation_ticket"`
+	ID                string    `json:"id"`
+	Type              string    `json:"type"` // Type-1, Type-2, Type-3
+	VendorID          string    `json:"vendor_id"`
+	DeviceID          string    `json:"device_id"`
+	SerialNumber      string    `json:"serial_number"`
+	FirmwareVer       string    `json:"firmware_version"`
+	Capacity          uint64    `json:"capacity_bytes"`
+	Latency           uint64    `json:"latency_ns"`
+	Bandwidth         uint64    `json:"bandwidth_gbps"`
+	ReservedBandwidth uint64    `json:"reserved_bandwidth_gbps"` // held by active paths
+	Regions           []string  `json:"regions,omitempty"`       // memory regions the device backs
+	Status            string    `json:"status"`                  // active, maintenance, disabled, offline
+	LastSeen          time.Time `json:"last_seen"`
+	Attestation       string    `json:"attestation_ticket"`
+
+	// adminStatus is the maintenance or disabled status an offline device
+	// returns to; empty returns it to active
+	adminStatus string
 }
 
 // FabricPath represents a CXL fabric path
 type FabricPath struct {
-	ID           string    `json:"id"`
-	SourceDevice string    `json:"source_device"`
-	TargetDevice string    `json:"target_device"`
-	PathType     string    `json:"path_type"` // PBR, GIM, Direct
-	Bandwidth    uint64    `json:"bandwidth_gbps"`
-	Latency      uint64    `json:"latency_ns"`
-	QoS          QoSConfig `json:"qos"`
-	Status       string    `json:"status"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           string             `json:"id"`
+	SourceDevice string             `json:"source_device"`
+	TargetDevice string             `json:"target_device"`
+	PathType     string             `json:"path_type"`      // PBR, GIM, Direct
+	Routing      string             `json:"routing"`        // shortest_latency, widest_bandwidth
+	Route        []string           `json:"route"`          // devices and switches, source first
+	Links        []string           `json:"links"`          // links carrying the path
+	Bandwidth    uint64             `json:"bandwidth_gbps"` // reserved on every link
+	Latency      uint64             `json:"latency_ns"`     // computed end-to-end latency
+	QoS          QoSConfig          `json:"qos"`
+	Status       string             `json:"status"`                 // active, degraded, preempted
+	PreemptedBy  string             `json:"preempted_by,omitempty"` // path that took the bandwidth
+	History      []PathStatusChange `json:"history"`
+	CreatedAt    time.Time          `json:"created_at"`
 }
 
 // QoSConfig represents Quality of Service configuration
@@ -49,16 +61,20 @@ type QoSConfig struct {
 	ECN          bool   `json:"ecn"`          // Explicit Congestion Notification
 }
 
-// AttestationTicket represents device attestation
+// AttestationTicket is a device's attestation: the attestd-signed ticket
+// and the measurements it binds
 type AttestationTicket struct {
-	DeviceID     string    `json:"device_id"`
-	TicketID     string    `json:"ticket_id"`
-	FirmwareHash string    `json:"firmware_hash"`
-	ConfigHash   string    `json:"config_hash"`
-	Signature    string    `json:"signature"`
-	IssuedAt     time.Time `json:"issued_at"`
-	ExpiresAt    time.Time `json:"expires_at"`
-	Valid        bool      `json:"valid"`
+	DeviceID      string    `json:"device_id"`
+	TicketID      string    `json:"ticket_id"`
+	AttestationID string    `json:"attestation_id"` // attestd's attestation
+	TrustLevel    string    `json:"trust_level"`
+	FirmwareHash  string    `json:"firmware_hash"`
+	ConfigHash    string    `json:"config_hash"`
+	Signature     string    `json:"signature"` // Ed25519, base64url
+	Ticket        string    `json:"ticket"`    // signed, for offline verification
+	IssuedAt      time.Time `json:"issued_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Valid         bool      `json:"valid"`
 }
 
 // PathRequest represents a path creation request
@@ -66,9 +82,11 @@ type PathRequest struct {
 	SourceDevice string    `json:"source_device"`
 	TargetDevice string    `json:"target_device"`
 	PathType     string    `json:"path_type"`
-	Bandwidth    uint64    `json:"bandwidth_gbps"`
-	Latency      uint64    `json:"latency_ns"`
+	Routing      string    `json:"routing,omitempty"` // default shortest_latency
+	Bandwidth    uint64    `json:"bandwidth_gbps"`    // bandwidth to reserve
+	Latency      uint64    `json:"latency_ns"`        // latency bound if qos.max_latency_ns is unset
 	QoS          QoSConfig `json:"qos"`
+	Preempt      bool      `json:"preempt,omitempty"` // gold and silver paths may preempt bronze ones
 }
 
 // AttestationRequest represents an attestation request
@@ -80,25 +98,30 @@ type AttestationRequest struct {
 // FabricManagerService manages CXL fabric
 type FabricManagerService struct {
     devices    map[string]*CXLDevice
+    switches   map[string]*FabricSwitch
+    links      map[string]*FabricLink
     paths      map[string]*FabricPath
     attestations map[string]*AttestationTicket
+    attest     *attestClient
     mutex      sync.RWMutex
     nextPathID int
     policies   map[string]*Policy
 }
 
-// NewFabricManagerService creates a new fabric manager service
+// NewFabricManagerService creates a fabric manager with an empty fabric;
+// Rediscover populates it
 func NewFabricManagerService() *FabricManagerService {
     service := &FabricManagerService{
         devices:      make(map[string]*CXLDevice),
+        switches:     make(map[string]*FabricSwitch),
+        links:        make(map[string]*FabricLink),
         paths:        make(map[string]*FabricPath),
         attestations: make(map[string]*AttestationTicket),
+        attest:       newAttestClient(attestdURL()),
         nextPathID:   1,
         policies:     make(map[string]*Policy),
     }
 
-	// Initialize with some mock devices
-	service.initializeMockDevices()
 	return service
 }
 
@@ -109,61 +132,13 @@ type DeviceStateRequest struct {
 
 // Policy represents a simple QoS policy for device or path
 type Policy struct {
-    Name      string    `json:"name"`
-    Match     string    `json:"match"`      // "device" or "path"
-    TargetID  string    `json:"target_id"`  // deviceID or pathID
-    QoS       QoSConfig `json:"qos"`
-    Enabled   bool      `json:"enabled"`
-    CreatedAt time.Time `json:"created_at"`
-}
-
-// initializeMockDevices creates some mock CXL devices for testing
-func (s *FabricManagerService) initializeMockDevices() {
-	devices := []*CXLDevice{
-		{
-			ID:           "cxl-dev-001",
-			Type:         "Type-3",
-			VendorID:     "0x8086",
-			DeviceID:     "0x0b5a",
-			SerialNumber: "SN123456789",
-			FirmwareVer:  "1.2.3",
-			Capacity:     256 * 1024 * 1024 * 1024, // 256GB
-			Latency:      100,
-			Bandwidth:    64,
-			Status:       "active",
-			LastSeen:     time.Now(),
-		},
-		{
-			ID:           "cxl-dev-002",
-			Type:         "Type-3",
-			VendorID:     "0x8086",
-			DeviceID:     "0x0b5a",
-			SerialNumber: "SN987654321",
-			FirmwareVer:  "1.2.3",
-			Capacity:     512 * 1024 * 1024 * 1024, // 512GB
-			Latency:      120,
-			Bandwidth:    64,
-			Status:       "active",
-			LastSeen:     time.Now(),
-		},
-		{
-			ID:           "cxl-dev-003",
-			Type:         "Type-2",
-			VendorID:     "0x10de",
-			DeviceID:     "0x2204",
-			SerialNumber: "SN555666777",
-			FirmwareVer:  "2.1.0",
-			Capacity:     0, // Type-2 devices don't have memory
-			Latency:      50,
-			Bandwidth:    128,
-			Status:       "active",
-			LastSeen:     time.Now(),
-		},
-	}
-
-	for _, device := range devices {
-		s.devices[device.ID] = device
-	}
+    Name               string    `json:"name"`
+    Match              string    `json:"match"`               // "device" or "path"
+    TargetID           string    `json:"target_id"`           // deviceID or pathID; "*" for all devices
+    QoS                QoSConfig `json:"qos"`
+    Enabled            bool      `json:"enabled"`
+    RequireAttestation bool      `json:"require_attestation"` // device policies: paths need a valid ticket
+    CreatedAt          time.Time `json:"created_at"`
 }
 
 // ListDevices returns all CXL devices
@@ -173,7 +148,8 @@ func (s *FabricManagerService) ListDevices() []*CXLDevice {
 
 	devices := make([]*CXLDevice, 0, len(s.devices))
 	for _, device := range s.devices {
-		devices = append(devices, device)
+		c := *device
+		devices = append(devices, &c)
 	}
 	return devices
 }
@@ -187,64 +163,124 @@ func (s *FabricManagerService) GetDevice(id string) (*CXLDevice, error) {
 	if !exists {
 		return nil, fmt.Errorf("device %s not found", id)
 	}
-	return device, nil
+	c := *device
+	return &c, nil
 }
 
-// CreatePath creates a new fabric path
+// CreatePath computes a route between two devices that meets the request's
+// QoS and reserves its bandwidth on every link along it
 func (s *FabricManagerService) CreatePath(req PathRequest) (*FabricPath, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	// Validate source device
-	_, exists := s.devices[req.SourceDevice]
+	source, exists := s.devices[req.SourceDevice]
 	if !exists {
 		return nil, fmt.Errorf("source device %s not found", req.SourceDevice)
 	}
 
 	// Validate target device
-	_, exists = s.devices[req.TargetDevice]
+	target, exists := s.devices[req.TargetDevice]
 	if !exists {
 		return nil, fmt.Errorf("target device %s not found", req.TargetDevice)
 	}
+	if source.ID == target.ID {
+		return nil, fmt.Errorf("source and target device must differ")
+	}
 
-	// Generate path ID
-	pathID := fmt.Sprintf("path-%04d", s.nextPathID)
-	s.nextPathID++
-
-    // Create path; validate PathType
     switch req.PathType {
     case "PBR", "GIM", "Direct":
     default:
         return nil, fmt.Errorf("unsupported path_type: %s", req.PathType)
     }
+    priority, err := normalizePriority(req.QoS.Priority)
+    if err != nil {
+        return nil, err
+    }
+    req.QoS.Priority = priority
+
+    // Reserve at least the QoS floor; the QoS latency bound takes
+    // precedence over the request's
+    demand := req.Bandwidth
+    if req.QoS.MinBandwidth > demand {
+        demand = req.QoS.MinBandwidth
+    }
+    if demand == 0 {
+        return nil, fmt.Errorf("bandwidth_gbps or qos.min_bandwidth_gbps required")
+    }
+    if req.QoS.MaxLatency == 0 {
+        req.QoS.MaxLatency = req.Latency
+    }
+    route, victims, err := s.admitLocked(req, demand, req.QoS.MaxLatency, "")
+    if err != nil {
+        return nil, err
+    }
+
+	// Generate path ID
+	pathID := fmt.Sprintf("path-%04d", s.nextPathID)
+	s.nextPathID++
+
+    routing := req.Routing
+    if routing == "" {
+        routing = RoutingShortestLatency
+    }
     // Create path
     path := &FabricPath{
         ID:           pathID,
         SourceDevice: req.SourceDevice,
         TargetDevice: req.TargetDevice,
         PathType:     req.PathType,
-        Bandwidth:    req.Bandwidth,
-        Latency:      req.Latency,
+        Routing:      routing,
+        Route:        route.Hops,
+        Links:        route.Links,
+        Bandwidth:    demand,
+        Latency:      route.LatencyNs,
         QoS:          req.QoS,
-        Status:       "active",
         CreatedAt:    time.Now(),
     }
+    s.setPathStatusLocked(path, "active", "created")
 
+    for _, victim := range victims {
+        s.preemptLocked(victim, pathID)
+    }
+    s.reservePathLocked(path)
 	s.paths[pathID] = path
-	return path, nil
+	return copyPath(path), nil
 }
 
-// SetDeviceState updates a device status
+// SetDeviceState updates a device status. Paths ending at a device that
+// leaves service are degraded and restored when it returns.
 func (s *FabricManagerService) SetDeviceState(id string, status string) (*CXLDevice, error) {
     s.mutex.Lock()
     defer s.mutex.Unlock()
     dev, ok := s.devices[id]
     if !ok { return nil, fmt.Errorf("device %s not found", id) }
+    // A missing device stays offline; it takes the status when it returns
+    if dev.Status == "offline" {
+        switch status {
+        case "active":
+            dev.adminStatus = ""
+        case "maintenance", "disabled":
+            dev.adminStatus = status
+        default:
+            return nil, fmt.Errorf("invalid status: %s", status)
+        }
+        c := *dev
+        return &c, nil
+    }
     switch status {
-    case "active", "maintenance", "disabled":
+    case "active":
+        dev.Status = status
+        dev.LastSeen = time.Now()
+        s.restoreLocked()
+        c := *dev
+        return &c, nil
+    case "maintenance", "disabled":
         dev.Status = status
         dev.LastSeen = time.Now()
-        return dev, nil
+        s.failoverLocked(id, status)
+        c := *dev
+        return &c, nil
     default:
         return nil, fmt.Errorf("invalid status: %s", status)
     }
@@ -257,12 +293,27 @@ func (s *FabricManagerService) AddPolicy(p Policy) (*Policy, error) {
     if p.Name == "" { return nil, fmt.Errorf("policy name required") }
     if p.Match != "device" && p.Match != "path" { return nil, fmt.Errorf("match must be 'device' or 'path'") }
     p.CreatedAt = time.Now()
-    s.policies[p.Name] = &p
-    // Apply to existing objects (best-effort)
+    // Apply to existing objects. A path policy changes the path's QoS
+    // through admission like a PATCH would, and is refused if it does not fit.
     if p.Enabled {
         if p.Match == "path" {
             if path, ok := s.paths[p.TargetID]; ok {
-                path.QoS = p.QoS
+                if p.QoS.Priority == "" {
+                    p.QoS.Priority = path.QoS.Priority
+                }
+                priority, err := normalizePriority(p.QoS.Priority)
+                if err != nil {
+                    return nil, err
+                }
+                p.QoS.Priority = priority
+                demand := path.Bandwidth
+                if p.QoS.MinBandwidth > demand {
+                    demand = p.QoS.MinBandwidth
+                }
+                if err := s.applyQoSLocked(path, p.QoS, demand, false, "policy "+p.Name); err != nil {
+                    return nil, err
+                }
+                s.restoreLocked()
             }
         }
         // For device policies, a real system would push QTG; here we mark LastSeen
@@ -272,6 +323,7 @@ func (s *FabricManagerService) AddPolicy(p Policy) (*Policy, error) {
             }
         }
     }
+    s.policies[p.Name] = &p
     return s.policies[p.Name], nil
 }
 
@@ -298,7 +350,7 @@ func (s *FabricManagerService) ListPaths() []*FabricPath {
 
 	paths := make([]*FabricPath, 0, len(s.paths))
 	for _, path := range s.paths {
-		paths = append(paths, path)
+		paths = append(paths, copyPath(path))
 	}
 	return paths
 }
@@ -312,53 +364,7 @@ func (s *FabricManagerService) GetPath(id string) (*FabricPath, error) {
 	if !exists {
 		return nil, fmt.Errorf("path %s not found", id)
 	}
-	return path, nil
-}
-
-// AttestDevice performs device attestation
-func (s *FabricManagerService) AttestDevice(req AttestationRequest) (*AttestationTicket, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Check if device exists
-	device, exists := s.devices[req.DeviceID]
-	if !exists {
-		return nil, fmt.Errorf("device %s not found", req.DeviceID)
-	}
-
-	// Generate attestation ticket
-	ticketID := fmt.Sprintf("attest-%d", time.Now().Unix())
-	ticket := &AttestationTicket{
-		DeviceID:     req.DeviceID,
-		TicketID:     ticketID,
-		FirmwareHash: fmt.Sprintf("sha256:%x", []byte(device.FirmwareVer)),
-		ConfigHash:   fmt.Sprintf("sha256:%x", []byte(device.SerialNumber)),
-		Signature:    fmt.Sprintf("pqc-sig-%x", []byte(ticketID)),
-		IssuedAt:     time.Now(),
-		ExpiresAt:    time.Now().Add(24 * time.Hour),
-		Valid:        true,
-	}
-
-	s.attestations[ticketID] = ticket
-	return ticket, nil
-}
-
-// VerifyAttestation verifies an attestation ticket
-func (s *FabricManagerService) VerifyAttestation(ticketID string) (*AttestationTicket, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	ticket, exists := s.attestations[ticketID]
-	if !exists {
-		return nil, fmt.Errorf("attestation ticket %s not found", ticketID)
-	}
-
-	// Check if ticket is still valid
-	if time.Now().After(ticket.ExpiresAt) {
-		ticket.Valid = false
-	}
-
-	return ticket, nil
+	return copyPath(path), nil
 }
 
 // HTTP handlers
@@ -408,7 +414,7 @@ func (s *FabricManagerService) handleCreatePath(w http.ResponseWriter, r *http.R
 
 	path, err := s.CreatePath(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), pathErrorStatus(err))
 		return
 	}
 
@@ -445,7 +451,7 @@ func (s *FabricManagerService) handleAddPolicy(w http.ResponseWriter, r *http.Re
     }
     pol, err := s.AddPolicy(p)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        http.Error(w, err.Error(), pathErrorStatus(err))
         return
     }
     w.Header().Set("Content-Type", "application/json")
@@ -469,38 +475,6 @@ func (s *FabricManagerService) handleDeletePolicy(w http.ResponseWriter, r *http
     w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *FabricManagerService) handleAttestDevice(w http.ResponseWriter, r *http.Request) {
-	var req AttestationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	ticket, err := s.AttestDevice(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(ticket)
-}
-
-func (s *FabricManagerService) handleVerifyAttestation(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	ticketID := vars["ticket_id"]
-
-	ticket, err := s.VerifyAttestation(ticketID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ticket)
-}
-
 func (s *FabricManagerService) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
@@ -510,6 +484,27 @@ func main() {
 	// Create fabric manager service
 	service := NewFabricManagerService()
 
+	// Discover devices and topology, then keep rediscovering to track
+	// LastSeen and take missing devices offline
+	discoverer, err := discovererFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up discovery: %v", err)
+	}
+	if err := service.Rediscover(discoverer); err != nil {
+		log.Fatalf("Initial discovery failed: %v", err)
+	}
+	log.Printf("Discovered %d devices via %s", len(service.ListDevices()), discoverer.Name())
+	interval := defaultDiscoveryInterval
+	if v := os.Getenv("FABMAND_DISCOVERY_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid FABMAND_DISCOVERY_INTERVAL %q", v)
+		}
+		interval = d
+	}
+	stopDiscovery := make(chan struct{})
+	go service.runDiscovery(discoverer, interval, stopDiscovery)
+
 	// Set up HTTP router
 	router := mux.NewRouter()
 	api := router.PathPrefix("/v1/fabman").Subrouter()
@@ -523,6 +518,13 @@ func main() {
     api.HandleFunc("/paths", service.handleCreatePath).Methods("POST")
     api.HandleFunc("/paths", service.handleListPaths).Methods("GET")
     api.HandleFunc("/paths/{id}", service.handleGetPath).Methods("GET")
+    api.HandleFunc("/paths/{id}", service.handlePatchPath).Methods("PATCH")
+    api.HandleFunc("/paths/{id}", service.handleDeletePath).Methods("DELETE")
+
+    // Topology endpoints
+    api.HandleFunc("/topology", service.handleTopology).Methods("GET")
+    api.HandleFunc("/switches/{id}/state", service.handleSwitchState).Methods("POST")
+    api.HandleFunc("/utilization", service.handleUtilization).Methods("GET")
 
     // Policy endpoints
     api.HandleFunc("/policies", service.handleAddPolicy).Methods("POST")
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPathHistory bounds the status history kept per path
+const maxPathHistory = 64
+
+// errNotFound is returned for unknown paths, devices and switches
+var errNotFound = errors.New("not found")
+
+// PathStatusChange is one entry in a path's status history
+type PathStatusChange struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason"`
+	Route  []string  `json:"route,omitempty"` // route taken, when (re)admitted
+	At     time.Time `json:"at"`
+}
+
+// PathPatch changes a path's bandwidth or QoS. Unset fields are kept.
+type PathPatch struct {
+	Bandwidth *uint64      `json:"bandwidth_gbps,omitempty"`
+	QoS       PathQoSPatch `json:"qos"`
+	Preempt   bool         `json:"preempt,omitempty"`
+}
+
+// PathQoSPatch holds the QoS fields a PathPatch changes
+type PathQoSPatch struct {
+	Priority     *string `json:"priority,omitempty"`
+	MinBandwidth *uint64 `json:"min_bandwidth_gbps,omitempty"`
+	MaxLatency   *uint64 `json:"max_latency_ns,omitempty"`
+	PFC          *bool   `json:"pfc,omitempty"`
+	ECN          *bool   `json:"ecn,omitempty"`
+}
+
+// setPathStatusLocked records a status change in the path's history;
+// callers must hold s.mutex
+func (s *FabricManagerService) setPathStatusLocked(p *FabricPath, status, reason string) {
+	p.Status = status
+	change := PathStatusChange{Status: status, Reason: reason, At: time.Now()}
+	if status == "active" {
+		change.Route = p.Route
+	}
+	p.History = append(p.History, change)
+	if len(p.History) > maxPathHistory {
+		p.History = p.History[len(p.History)-maxPathHistory:]
+	}
+}
+
+// readmitLocked releases a path's reservation and admits it again with qos
+// and demand, possibly over a new route. On failure the path keeps its old
+// route and reservation. Callers must hold s.mutex.
+func (s *FabricManagerService) readmitLocked(p *FabricPath, qos QoSConfig, demand uint64, preempt bool, reason string) error {
+	wasActive := p.Status == "active"
+	if wasActive {
+		s.releasePathLocked(p)
+	}
+	req := PathRequest{
+		SourceDevice: p.SourceDevice,
+		TargetDevice: p.TargetDevice,
+		PathType:     p.PathType,
+		Routing:      p.Routing,
+		QoS:          qos,
+		Preempt:      preempt,
+	}
+	route, victims, err := s.admitLocked(req, demand, qos.MaxLatency, p.ID)
+	if err != nil {
+		if wasActive {
+			s.reservePathLocked(p)
+		}
+		return err
+	}
+
+	for _, victim := range victims {
+		s.preemptLocked(victim, p.ID)
+	}
+	p.Route = route.Hops
+	p.Links = route.Links
+	p.Bandwidth = demand
+	p.Latency = route.LatencyNs
+	p.QoS = qos
+	s.reservePathLocked(p)
+	s.setPathStatusLocked(p, "active", reason)
+	return nil
+}
+
+// degradeLocked releases a path that can no longer be carried; callers must
+// hold s.mutex
+func (s *FabricManagerService) degradeLocked(p *FabricPath, reason string) {
+	if p.Status == "active" {
+		s.releasePathLocked(p)
+	}
+	s.setPathStatusLocked(p, "degraded", reason)
+	log.Printf("Path %s degraded: %s", p.ID, reason)
+}
+
+// failoverLocked reroutes the active paths that use a fabric node or link
+// which is out of service, and degrades those with no alternate route.
+// Paths ending at the node cannot be rerouted. Callers must hold s.mutex.
+func (s *FabricManagerService) failoverLocked(node, status string) {
+	for _, p := range s.sortedPathsLocked() {
+		if p.Status != "active" || !(containsString(p.Route, node) || containsString(p.Links, node)) {
+			continue
+		}
+		reason := fmt.Sprintf("%s is %s", node, status)
+		if p.SourceDevice == node || p.TargetDevice == node {
+			s.degradeLocked(p, reason)
+			continue
+		}
+		if err := s.readmitLocked(p, p.QoS, p.Bandwidth, false, reason+"; rerouted"); err != nil {
+			s.degradeLocked(p, fmt.Sprintf("%s; no alternate route: %v", reason, err))
+			continue
+		}
+		log.Printf("Path %s rerouted around %s via %v", p.ID, node, p.Route)
+	}
+}
+
+// restoreLocked readmits degraded and preempted paths, highest priority
+// first, once their devices are active and capacity allows. Restored paths
+// never preempt others. Callers must hold s.mutex.
+func (s *FabricManagerService) restoreLocked() {
+	for _, p := range s.sortedPathsLocked() {
+		if p.Status != "degraded" && p.Status != "preempted" {
+			continue
+		}
+		if s.devices[p.SourceDevice].Status != "active" || s.devices[p.TargetDevice].Status != "active" {
+			continue
+		}
+		if err := s.readmitLocked(p, p.QoS, p.Bandwidth, false, "restored"); err == nil {
+			p.PreemptedBy = ""
+			log.Printf("Path %s restored via %v", p.ID, p.Route)
+		}
+	}
+}
+
+// sortedPathsLocked returns paths by priority, then age, so that failover
+// and restoration favour gold and older paths; callers must hold s.mutex
+func (s *FabricManagerService) sortedPathsLocked() []*FabricPath {
+	paths := make([]*FabricPath, 0, len(s.paths))
+	for _, p := range s.paths {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		ri, rj := priorityRank[paths[i].QoS.Priority], priorityRank[paths[j].QoS.Priority]
+		if ri != rj {
+			return ri > rj
+		}
+		return paths[i].ID < paths[j].ID
+	})
+	return paths
+}
+
+// copyPath returns a copy of p that stays consistent after s.mutex is
+// released, for callers that encode it
+func copyPath(p *FabricPath) *FabricPath {
+	c := *p
+	c.Route = append([]string(nil), p.Route...)
+	c.Links = append([]string(nil), p.Links...)
+	c.History = append([]PathStatusChange(nil), p.History...)
+	return &c
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// DeletePath tears down a path and returns its bandwidth to the fabric
+func (s *FabricManagerService) DeletePath(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.paths[id]
+	if !ok {
+		return fmt.Errorf("path %s %w", id, errNotFound)
+	}
+	if p.Status == "active" {
+		s.releasePathLocked(p)
+	}
+	delete(s.paths, id)
+	log.Printf("Path %s deleted", id)
+	s.restoreLocked()
+	return nil
+}
+
+// PatchPath changes a path's QoS. A new bandwidth floor or latency bound
+// readmits an active path, which may move it to another route; if it no
+// longer fits the path is left unchanged.
+func (s *FabricManagerService) PatchPath(id string, patch PathPatch) (*FabricPath, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.paths[id]
+	if !ok {
+		return nil, fmt.Errorf("path %s %w", id, errNotFound)
+	}
+
+	qos := p.QoS
+	if patch.QoS.Priority != nil {
+		priority, err := normalizePriority(*patch.QoS.Priority)
+		if err != nil {
+			return nil, err
+		}
+		qos.Priority = priority
+	}
+	if patch.QoS.MinBandwidth != nil {
+		qos.MinBandwidth = *patch.QoS.MinBandwidth
+	}
+	if patch.QoS.MaxLatency != nil {
+		qos.MaxLatency = *patch.QoS.MaxLatency
+	}
+	if patch.QoS.PFC != nil {
+		qos.PFC = *patch.QoS.PFC
+	}
+	if patch.QoS.ECN != nil {
+		qos.ECN = *patch.QoS.ECN
+	}
+	demand := p.Bandwidth
+	if patch.Bandwidth != nil {
+		demand = *patch.Bandwidth
+	}
+	if qos.MinBandwidth > demand {
+		demand = qos.MinBandwidth
+	}
+	if demand == 0 {
+		return nil, fmt.Errorf("bandwidth_gbps must be positive")
+	}
+
+	if err := s.applyQoSLocked(p, qos, demand, patch.Preempt, "qos changed"); err != nil {
+		return nil, err
+	}
+	s.restoreLocked()
+	return copyPath(p), nil
+}
+
+// applyQoSLocked gives a path new QoS and bandwidth. A new bandwidth or
+// latency bound readmits an active path, which may move it to another route;
+// if it no longer fits the path is left unchanged. Callers must hold
+// s.mutex.
+func (s *FabricManagerService) applyQoSLocked(p *FabricPath, qos QoSConfig, demand uint64, preempt bool, reason string) error {
+	if p.Status == "active" && (demand != p.Bandwidth || qos.MaxLatency != p.QoS.MaxLatency) {
+		return s.readmitLocked(p, qos, demand, preempt, reason)
+	}
+	// Degraded and preempted paths take the new values when readmitted
+	p.QoS = qos
+	p.Bandwidth = demand
+	s.setPathStatusLocked(p, p.Status, reason)
+	return nil
+}
+
+// SetSwitchState updates a switch status, rerouting paths around a switch
+// that leaves service
+func (s *FabricManagerService) SetSwitchState(id string, status string) (*FabricSwitch, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sw, ok := s.switches[id]
+	if !ok {
+		return nil, fmt.Errorf("switch %s %w", id, errNotFound)
+	}
+	switch status {
+	case "active":
+		sw.Status = status
+		s.restoreLocked()
+	case "maintenance", "disabled":
+		sw.Status = status
+		s.failoverLocked(id, status)
+	default:
+		return nil, fmt.Errorf("invalid status: %s", status)
+	}
+	c := *sw
+	return &c, nil
+}
+
+// pathErrorStatus maps a path operation error to an HTTP status
+func pathErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNoRoute), errors.Is(err, errOversubscribed):
+		return http.StatusConflict
+	case errors.Is(err, errUnattested):
+		return http.StatusForbidden
+	case errors.Is(err, errAttestd):
+		return http.StatusBadGateway
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (s *FabricManagerService) handleDeletePath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if err := s.DeletePath(id); err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *FabricManagerService) handlePatchPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var patch PathPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	path, err := s.PatchPath(id, patch)
+	if err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(path)
+}
+
+func (s *FabricManagerService) handleSwitchState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req DeviceStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	sw, err := s.SetSwitchState(id, req.Status)
+	if err != nil {
+		http.Error(w, err.Error(), pathErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sw)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreemptedPathRestored(t *testing.T) {
+	s := NewFabricManagerService()
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(), time.Now())
+	s.mutex.Unlock()
+
+	bronze, err := s.CreatePath(PathRequest{SourceDevice: "dev-a", TargetDevice: "dev-b", PathType: "PBR", Bandwidth: 48})
+	if err != nil {
+		t.Fatalf("create bronze path: %v", err)
+	}
+	gold, err := s.CreatePath(PathRequest{
+		SourceDevice: "dev-a",
+		TargetDevice: "dev-b",
+		PathType:     "PBR",
+		Bandwidth:    32,
+		QoS:          QoSConfig{Priority: PriorityGold},
+		Preempt:      true,
+	})
+	if err != nil {
+		t.Fatalf("create gold path: %v", err)
+	}
+	if p, _ := s.GetPath(bronze.ID); p.Status != "preempted" || p.PreemptedBy != gold.ID {
+		t.Fatalf("bronze path is %s (by %q), want preempted by %s", p.Status, p.PreemptedBy, gold.ID)
+	}
+
+	// Freeing the gold path's bandwidth brings the bronze path back
+	if err := s.DeletePath(gold.ID); err != nil {
+		t.Fatalf("DeletePath: %v", err)
+	}
+	p, _ := s.GetPath(bronze.ID)
+	if p.Status != "active" || p.PreemptedBy != "" {
+		t.Errorf("bronze path is %s (by %q) after gold path deleted, want active", p.Status, p.PreemptedBy)
+	}
+	if got := s.devices["dev-a"].ReservedBandwidth; got != 48 {
+		t.Errorf("dev-a reserves %d Gbps, want 48", got)
+	}
+}
+
+func TestRestoreRequiresAttestation(t *testing.T) {
+	s := NewFabricManagerService()
+	start := time.Now()
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory(), start)
+	s.policies["attested"] = &Policy{Name: "attested", Match: "device", TargetID: "*", Enabled: true, RequireAttestation: true}
+	for _, id := range []string{"dev-a", "dev-b"} {
+		dev := s.devices[id]
+		firmware, config := deviceMeasurements(dev)
+		dev.Attestation = "ticket-" + id
+		s.attestations[dev.Attestation] = &AttestationTicket{
+			DeviceID: id, TicketID: dev.Attestation, FirmwareHash: firmware, ConfigHash: config,
+			Valid: true, ExpiresAt: start.Add(time.Hour),
+		}
+	}
+	s.mutex.Unlock()
+
+	created, err := s.CreatePath(PathRequest{SourceDevice: "dev-a", TargetDevice: "dev-b", PathType: "PBR", Bandwidth: 16})
+	if err != nil {
+		t.Fatalf("CreatePath: %v", err)
+	}
+	path := s.paths[created.ID]
+
+	// dev-b leaves and its ticket expires while it is away
+	s.mutex.Lock()
+	s.applyInventoryLocked(testInventory("dev-b"), start.Add(time.Minute))
+	s.attestations["ticket-dev-b"].ExpiresAt = start
+	s.applyInventoryLocked(testInventory(), start.Add(2*time.Minute))
+	s.mutex.Unlock()
+	if path.Status != "degraded" {
+		t.Fatalf("path to a device with an expired ticket is %s, want degraded", path.Status)
+	}
+
+	// A fresh ticket lets the path back, as AttestDevice restores paths
+	s.mutex.Lock()
+	s.attestations["ticket-dev-b"].ExpiresAt = time.Now().Add(time.Hour)
+	s.restoreLocked()
+	s.mutex.Unlock()
+	if path.Status != "active" {
+		t.Errorf("path is %s after re-attestation, want active", path.Status)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Routing strategies for path computation
+const (
+	RoutingShortestLatency = "shortest_latency"
+	RoutingWidestBandwidth = "widest_bandwidth"
+)
+
+// errNoRoute is returned when no route satisfies a path's constraints
+var errNoRoute = errors.New("no route")
+
+// FabricSwitch is a CXL switch. Traversing it adds its port-to-port latency.
+type FabricSwitch struct {
+	ID        string `json:"id"`
+	Ports     int    `json:"ports"`
+	LatencyNs uint64 `json:"latency_ns"`
+	Status    string `json:"status"`
+}
+
+// FabricLink connects two fabric nodes (devices or switches). Capacity is
+// shared by both directions.
+type FabricLink struct {
+	ID           string `json:"id"`
+	A            string `json:"a"`
+	B            string `json:"b"`
+	CapacityGbps uint64 `json:"capacity_gbps"`
+	ReservedGbps uint64 `json:"reserved_gbps"`
+	LatencyNs    uint64 `json:"latency_ns"`
+	Status       string `json:"status"` // up, down
+}
+
+// available returns the unreserved capacity of a link
+func (l *FabricLink) available() uint64 {
+	if l.ReservedGbps >= l.CapacityGbps {
+		return 0
+	}
+	return l.CapacityGbps - l.ReservedGbps
+}
+
+// other returns the node at the far end of the link from node
+func (l *FabricLink) other(node string) string {
+	if l.A == node {
+		return l.B
+	}
+	return l.A
+}
+
+// TopologyNode is a device or switch in the topology graph
+type TopologyNode struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"` // device, switch
+	Type      string `json:"type,omitempty"`
+	LatencyNs uint64 `json:"latency_ns"`
+	Status    string `json:"status"`
+}
+
+// TopologyLink is a link in the topology graph
+type TopologyLink struct {
+	FabricLink
+	AvailableGbps uint64   `json:"available_gbps"`
+	Paths         []string `json:"paths,omitempty"` // paths reserving capacity on the link
+}
+
+// Topology is the fabric graph, for visualisation
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Links []TopologyLink `json:"links"`
+}
+
+// Route is a computed path through the fabric
+type Route struct {
+	Hops           []string // node IDs, source first
+	Links          []string
+	LatencyNs      uint64
+	BottleneckGbps uint64 // least available capacity along the route
+}
+
+// routable reports whether traffic may pass through node; only active
+// switches forward traffic
+func (s *FabricManagerService) routable(node string) bool {
+	sw, ok := s.switches[node]
+	return ok && sw.Status == "active"
+}
+
+// routeQuery is one route search. Reclaim maps link IDs to bandwidth that
+// preempting lower-priority paths would free, counted as available.
+type routeQuery struct {
+	src, dst   string
+	minGbps    uint64
+	maxLatency uint64 // 0 for no limit
+	direct     bool   // use a device-to-device link only
+	reclaim    map[string]uint64
+}
+
+// available returns the bandwidth the query may use on a link
+func (q *routeQuery) available(l *FabricLink) uint64 {
+	return l.available() + q.reclaim[l.ID]
+}
+
+// adjacencyLocked maps each node to the links attached to it, keeping only
+// links that are up with at least minGbps available to q; callers must hold
+// s.mutex
+func (s *FabricManagerService) adjacencyLocked(q *routeQuery, minGbps uint64) map[string][]*FabricLink {
+	adj := make(map[string][]*FabricLink)
+	for _, l := range s.links {
+		if l.Status != "up" || q.available(l) < minGbps {
+			continue
+		}
+		adj[l.A] = append(adj[l.A], l)
+		adj[l.B] = append(adj[l.B], l)
+	}
+	return adj
+}
+
+// shortestRouteLocked finds the lowest-latency route for q over links with
+// at least minGbps available. Latency counts links, traversed switches and
+// the target device. Callers must hold s.mutex.
+func (s *FabricManagerService) shortestRouteLocked(q *routeQuery, minGbps uint64) (*Route, bool) {
+	adj := s.adjacencyLocked(q, minGbps)
+	dist := map[string]uint64{q.src: 0}
+	via := make(map[string]*FabricLink)
+	done := make(map[string]bool)
+	queue := &nodeQueue{{node: q.src}}
+
+	for queue.Len() > 0 {
+		cur := heap.Pop(queue).(nodeDist)
+		if done[cur.node] {
+			continue
+		}
+		done[cur.node] = true
+		if cur.node == q.dst {
+			break
+		}
+		// Only the source and switches forward; other devices are endpoints
+		if cur.node != q.src && (q.direct || !s.routable(cur.node)) {
+			continue
+		}
+		// Sort for deterministic tie-breaking
+		links := adj[cur.node]
+		sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+		for _, l := range links {
+			next := l.other(cur.node)
+			d := cur.dist + l.LatencyNs
+			if sw, ok := s.switches[next]; ok {
+				d += sw.LatencyNs
+			}
+			if old, seen := dist[next]; !seen || d < old {
+				dist[next] = d
+				via[next] = l
+				heap.Push(queue, nodeDist{node: next, dist: d})
+			}
+		}
+	}
+	if !done[q.dst] {
+		return nil, false
+	}
+
+	route := &Route{LatencyNs: dist[q.dst], BottleneckGbps: ^uint64(0)}
+	for node := q.dst; node != q.src; {
+		l := via[node]
+		route.Hops = append([]string{node}, route.Hops...)
+		route.Links = append([]string{l.ID}, route.Links...)
+		if a := q.available(l); a < route.BottleneckGbps {
+			route.BottleneckGbps = a
+		}
+		node = l.other(node)
+	}
+	route.Hops = append([]string{q.src}, route.Hops...)
+	if dev, ok := s.devices[q.dst]; ok {
+		route.LatencyNs += dev.Latency
+	}
+	return route, true
+}
+
+// widestRouteLocked finds the route with the most available bandwidth whose
+// latency is within q.maxLatency, preferring lower latency among equally
+// wide routes. Lowering the bandwidth threshold only adds links, so whether
+// some route fits the latency bound is monotone in the threshold; it binary
+// searches the distinct link capacities for the widest threshold that fits,
+// taking O(log E) shortest-route searches. Callers must hold s.mutex.
+func (s *FabricManagerService) widestRouteLocked(q *routeQuery) (*Route, bool) {
+	seen := make(map[uint64]bool)
+	var thresholds []uint64
+	for _, l := range s.links {
+		if a := q.available(l); a >= q.minGbps && !seen[a] {
+			seen[a] = true
+			thresholds = append(thresholds, a)
+		}
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+
+	routes := make(map[int]*Route)
+	i := sort.Search(len(thresholds), func(i int) bool {
+		route, ok := s.shortestRouteLocked(q, thresholds[i])
+		if !ok || (q.maxLatency > 0 && route.LatencyNs > q.maxLatency) {
+			return false
+		}
+		routes[i] = route
+		return true
+	})
+	if i == len(thresholds) {
+		return nil, false
+	}
+	return routes[i], true
+}
+
+// computeRouteLocked picks a route for req under its QoS constraints,
+// counting reclaim as available; callers must hold s.mutex
+func (s *FabricManagerService) computeRouteLocked(req PathRequest, demand, maxLatency uint64, reclaim map[string]uint64) (*Route, error) {
+	q := &routeQuery{
+		src:        req.SourceDevice,
+		dst:        req.TargetDevice,
+		minGbps:    demand,
+		maxLatency: maxLatency,
+		direct:     req.PathType == "Direct",
+		reclaim:    reclaim,
+	}
+	var route *Route
+	var ok bool
+	switch req.Routing {
+	case "", RoutingShortestLatency:
+		route, ok = s.shortestRouteLocked(q, demand)
+	case RoutingWidestBandwidth:
+		route, ok = s.widestRouteLocked(q)
+	default:
+		return nil, fmt.Errorf("unsupported routing: %s", req.Routing)
+	}
+	if !ok && q.direct {
+		return nil, fmt.Errorf("%w: no direct link from %s to %s with %d Gbps available", errNoRoute, req.SourceDevice, req.TargetDevice, demand)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w from %s to %s with %d Gbps available", errNoRoute, req.SourceDevice, req.TargetDevice, demand)
+	}
+	if maxLatency > 0 && route.LatencyNs > maxLatency {
+		return nil, fmt.Errorf("%w from %s to %s within %d ns (best is %d ns)", errNoRoute, req.SourceDevice, req.TargetDevice, maxLatency, route.LatencyNs)
+	}
+	return route, nil
+}
+
+// GetTopology returns the fabric graph
+func (s *FabricManagerService) GetTopology() Topology {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make(map[string][]string)
+	for _, p := range s.paths {
+		if p.Status != "active" {
+			continue
+		}
+		for _, l := range p.Links {
+			users[l] = append(users[l], p.ID)
+		}
+	}
+
+	topo := Topology{Nodes: []TopologyNode{}, Links: []TopologyLink{}}
+	for _, d := range s.devices {
+		topo.Nodes = append(topo.Nodes, TopologyNode{ID: d.ID, Kind: "device", Type: d.Type, LatencyNs: d.Latency, Status: d.Status})
+	}
+	for _, sw := range s.switches {
+		topo.Nodes = append(topo.Nodes, TopologyNode{ID: sw.ID, Kind: "switch", LatencyNs: sw.LatencyNs, Status: sw.Status})
+	}
+	for _, l := range s.links {
+		paths := users[l.ID]
+		sort.Strings(paths)
+		topo.Links = append(topo.Links, TopologyLink{FabricLink: *l, AvailableGbps: l.available(), Paths: paths})
+	}
+	sort.Slice(topo.Nodes, func(i, j int) bool { return topo.Nodes[i].ID < topo.Nodes[j].ID })
+	sort.Slice(topo.Links, func(i, j int) bool { return topo.Links[i].ID < topo.Links[j].ID })
+	return topo
+}
+
+func (s *FabricManagerService) handleTopology(w http.ResponseWriter, r *http.Request) {
+	topo := s.GetTopology()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topo)
+}
+
+// nodeDist is a node and its tentative latency in the route search
+type nodeDist struct {
+	node string
+	dist uint64
+}
+
+// nodeQueue is a min-heap of nodes by latency
+type nodeQueue []nodeDist
+
+func (q nodeQueue) Len() int { return len(q) }
+func (q nodeQueue) Less(i, j int) bool {
+	if q[i].dist != q[j].dist {
+		return q[i].dist < q[j].dist
+	}
+	return q[i].node < q[j].node
+}
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(nodeDist)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
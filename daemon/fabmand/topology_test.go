@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWidestRoute(t *testing.T) {
+	s := NewFabricManagerService()
+	inv := testInventory()
+	for _, l := range inv.Links {
+		// sw-0 is fast and narrow, sw-1 slow and wide
+		if l.ID == "link-a0" || l.ID == "link-0b" {
+			l.CapacityGbps = 16
+		} else {
+			l.LatencyNs = 200
+		}
+	}
+	s.mutex.Lock()
+	s.applyInventoryLocked(inv, time.Now())
+	s.mutex.Unlock()
+
+	tests := []struct {
+		name       string
+		maxLatency uint64
+		want       string
+		wantGbps   uint64
+	}{
+		{"unbounded takes the widest route", 0, "sw-1", 64},
+		{"latency bound excludes the wide route", 300, "sw-0", 16},
+		{"no route within the bound", 100, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			route, ok := s.widestRouteLocked(&routeQuery{src: "dev-a", dst: "dev-b", minGbps: 8, maxLatency: tt.maxLatency})
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("found route %v, want none", route.Hops)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no route found")
+			}
+			if route.Hops[1] != tt.want || route.BottleneckGbps != tt.wantGbps {
+				t.Errorf("route %v with %d Gbps, want via %s with %d Gbps", route.Hops, route.BottleneckGbps, tt.want, tt.wantGbps)
+			}
+		})
+	}
+}
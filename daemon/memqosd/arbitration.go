@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// TierArbitration explains how one tier's deliverable bandwidth is divided
+// among the handles on it
+type TierArbitration struct {
+	Tier           string           `json:"tier"`
+	BudgetGBs      uint64           `json:"budget_GBs"`
+	DeliverableGBs float64          `json:"deliverable_GBs"` // the budget admission commits floors against
+	DemandGBs      uint64           `json:"demand_GBs"`      // sum of floors
+	Contended      bool             `json:"contended"`
+	FairShareGBs   float64          `json:"fair_share_GBs,omitempty"` // per unit of weight
+	Grants         []BandwidthGrant `json:"grants"`
+	ComputedAt     time.Time        `json:"computed_at"`
+}
+
+// BandwidthGrant is the bandwidth arbitration gave one handle
+type BandwidthGrant struct {
+	HandleID   string  `json:"handle_id"`
+	Priority   string  `json:"priority"`
+	Weight     float64 `json:"weight"`
+	FloorGBs   uint64  `json:"floor_GBs"`
+	GrantedGBs float64 `json:"granted_GBs"`
+	FloorMet   bool    `json:"floor_met"`
+	Reason     string  `json:"reason"`
+}
+
+// arbitrate divides a tier's bandwidth budget among handles by weighted
+// max-min fairness with floors as guarantees. Admission commits floors up to
+// the budget, so normally every floor is granted in full and the headroom
+// above the floors is shared out by weight: handles are levelled to the same
+// bandwidth per unit of weight, except those whose floor is already above
+// that level. Only if floors exceed the budget, e.g. after the tier shrank,
+// is the tier contended; then handles whose floor is below their weighted
+// fair share keep it and the rest split what is left by weight.
+func arbitrate(tier string, budget uint64, handles []*FFMHandle, now time.Time) *TierArbitration {
+	a := &TierArbitration{
+		Tier:           tier,
+		BudgetGBs:      budget,
+		DeliverableGBs: float64(budget),
+		Grants:         make([]BandwidthGrant, 0, len(handles)),
+		ComputedAt:     now,
+	}
+
+	// Order by floor per unit of weight; both passes below rely on it
+	sort.Slice(handles, func(i, j int) bool {
+		fi := float64(handles[i].BandwidthFloor) / handles[i].weight()
+		fj := float64(handles[j].BandwidthFloor) / handles[j].weight()
+		if fi != fj {
+			return fi < fj
+		}
+		return handles[i].ID < handles[j].ID
+	})
+	weight := 0.0
+	for _, h := range handles {
+		weight += h.weight()
+		a.DemandGBs += h.BandwidthFloor
+	}
+	a.Contended = a.DemandGBs > budget
+
+	var grants []float64
+	var level float64
+	if a.Contended {
+		grants, level = capAtFairShare(handles, float64(budget), weight)
+	} else {
+		grants, level = levelAboveFloors(handles, float64(budget))
+	}
+	a.FairShareGBs = round2(level)
+
+	for i, h := range handles {
+		g := BandwidthGrant{
+			HandleID:   h.ID,
+			Priority:   h.Priority,
+			Weight:     h.weight(),
+			FloorGBs:   h.BandwidthFloor,
+			GrantedGBs: grants[i],
+			FloorMet:   grants[i] >= float64(h.BandwidthFloor),
+		}
+		share := g.Weight * level
+		switch {
+		case !a.Contended && share > float64(h.BandwidthFloor):
+			g.Reason = fmt.Sprintf("floor guaranteed, headroom shared by weight: weight %g x %.2f GB/s", g.Weight, level)
+		case !a.Contended:
+			g.Reason = fmt.Sprintf("floor guaranteed, above its weighted share of %.2f GB/s", share)
+		case g.FloorMet:
+			g.Reason = fmt.Sprintf("floor within weighted fair share of %.2f GB/s", share)
+		default:
+			g.Reason = fmt.Sprintf("capped at weighted fair share: weight %g x %.2f GB/s", g.Weight, level)
+		}
+		g.GrantedGBs = round2(g.GrantedGBs)
+		a.Grants = append(a.Grants, g)
+	}
+	sort.Slice(a.Grants, func(i, j int) bool { return a.Grants[i].HandleID < a.Grants[j].HandleID })
+	return a
+}
+
+// levelAboveFloors grants each handle, sorted by floor per unit of weight,
+// the larger of its floor and weight x level, with level chosen so the
+// grants use the whole budget. The floors must fit the budget. It returns
+// the grants and the level.
+func levelAboveFloors(handles []*FFMHandle, budget float64) ([]float64, float64) {
+	grants := make([]float64, len(handles))
+	if len(handles) == 0 {
+		return grants, 0
+	}
+
+	// Try levelling all handles, then pin the one with the largest floor
+	// per unit of weight at its floor, and so on, until the level reaches
+	// every levelled handle's floor
+	pinned, weight := 0.0, 0.0
+	for _, h := range handles {
+		weight += h.weight()
+	}
+	k := len(handles)
+	level := budget / weight
+	for k > 1 {
+		h := handles[k-1]
+		if level*h.weight() >= float64(h.BandwidthFloor) {
+			break
+		}
+		k--
+		pinned += float64(h.BandwidthFloor)
+		weight -= h.weight()
+		level = (budget - pinned) / weight
+	}
+	for i, h := range handles {
+		grants[i] = float64(h.BandwidthFloor)
+		if i < k {
+			grants[i] = math.Max(grants[i], level*h.weight())
+		}
+	}
+	return grants, level
+}
+
+// capAtFairShare divides a budget that cannot cover every floor. Handles,
+// sorted by floor per unit of weight, whose floor is below their weighted
+// share of what remains keep it; once one handle is capped at its share, so
+// is every handle after it. It returns the grants and the fair share per
+// unit of weight of the capped handles.
+func capAtFairShare(handles []*FFMHandle, budget, weight float64) ([]float64, float64) {
+	grants := make([]float64, len(handles))
+	remaining, fairShare := budget, 0.0
+	for i, h := range handles {
+		w := h.weight()
+		if share := remaining * w / weight; float64(h.BandwidthFloor) <= share {
+			grants[i] = float64(h.BandwidthFloor)
+		} else {
+			fairShare = remaining / weight
+			grants[i] = share
+		}
+		remaining -= grants[i]
+		weight -= w
+	}
+	return grants, fairShare
+}
+
+// arbitrateLocked recomputes bandwidth arbitration for every tier and
+// updates the achieved bandwidth of each handle. It runs whenever floors,
+// tiers or the set of handles change. Callers must hold s.mutex for writing.
+func (s *FFMService) arbitrateLocked() {
+	now := time.Now()
+	byTier := make(map[string][]*FFMHandle, len(s.tiers))
+	for _, h := range s.allocations {
+		byTier[h.LatencyClass] = append(byTier[h.LatencyClass], h)
+	}
+
+	s.arbitration = make(map[string]*TierArbitration, len(s.tiers))
+	s.grants = make(map[string]float64, len(s.allocations))
+	for name, capacity := range s.tiers {
+		a := arbitrate(name, capacity.BandwidthGBs, byTier[name], now)
+		s.arbitration[name] = a
+		for _, g := range a.Grants {
+			s.grants[g.HandleID] = g.GrantedGBs
+			achieved := uint64(g.GrantedGBs + 0.5)
+			if h, ok := s.allocations[g.HandleID]; ok {
+				h.AchievedBandwidth = achieved
+			}
+			// Keep the latest reading consistent until the next sample
+			if sample, ok := s.telemetry[g.HandleID]; ok {
+				sample.AchievedGBs = achieved
+				s.telemetry[g.HandleID] = sample
+			}
+		}
+	}
+}
+
+// grantedBandwidth returns a handle's arbitrated bandwidth, or its floor if
+// it has not been arbitrated yet; callers must hold s.mutex
+func (s *FFMService) grantedBandwidth(handle *FFMHandle) float64 {
+	if g, ok := s.grants[handle.ID]; ok {
+		return g
+	}
+	return float64(handle.BandwidthFloor)
+}
+
+// Arbitration returns the latest arbitration of every tier, or of one tier
+func (s *FFMService) Arbitration(tier string) ([]TierArbitration, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if tier != "" {
+		a, ok := s.arbitration[tier]
+		if !ok {
+			return nil, notFound("tier %s not found", tier)
+		}
+		return []TierArbitration{*a}, nil
+	}
+	list := make([]TierArbitration, 0, len(s.arbitration))
+	for _, a := range s.arbitration {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tier < list[j].Tier })
+	return list, nil
+}
+
+func (s *FFMService) handleArbitration(w http.ResponseWriter, r *http.Request) {
+	list, err := s.Arbitration(r.URL.Query().Get("tier"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// attestDeadline bounds verifying one ticket, retries included
+	attestDeadline = 8 * time.Second
+	// attestTimeout bounds one request to attestd
+	attestTimeout = 2 * time.Second
+	// attestRetries is how many times a failed attestd request is retried
+	attestRetries = 2
+	// attestBackoff is the delay before the first retry; it doubles after
+	attestBackoff = 100 * time.Millisecond
+	// keyRefreshInterval limits how often an unknown key ID refetches keys
+	keyRefreshInterval = 30 * time.Second
+	// maxCachedTickets bounds the verified-ticket cache
+	maxCachedTickets = 4096
+)
+
+// ticketClaims is the signed payload of an attestd ticket
+type ticketClaims struct {
+	AttestationID string    `json:"attestation_id"`
+	Valid         bool      `json:"valid"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	KeyID         string    `json:"kid"`
+}
+
+// attestVerifier checks attestation tickets. Signed tickets are verified
+// locally against attestd's published keys; bare attestation IDs are looked
+// up online. Either way a verified ticket is cached until it expires.
+type attestVerifier struct {
+	baseURL string
+	client  *http.Client
+
+	mu            sync.Mutex
+	cache         map[string]time.Time // ticket -> expiry
+	keys          map[string]ed25519.PublicKey
+	keysFetchedAt time.Time
+}
+
+// attestdURL returns attestd's address from ATTESTD_URL
+func attestdURL() string {
+	if v := os.Getenv("ATTESTD_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:8084"
+}
+
+func newAttestVerifier(baseURL string) *attestVerifier {
+	return &attestVerifier{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: attestTimeout},
+		cache:   make(map[string]time.Time),
+		keys:    make(map[string]ed25519.PublicKey),
+	}
+}
+
+// Verify returns nil for a ticket that is valid and unexpired. Rejected
+// tickets wrap errForbidden; attestd failures wrap errUnavailable or
+// errUpstream.
+func (v *attestVerifier) Verify(ctx context.Context, ticket string) error {
+	now := time.Now()
+	v.mu.Lock()
+	expiresAt, cached := v.cache[ticket]
+	if cached && now.After(expiresAt) {
+		delete(v.cache, ticket)
+		cached = false
+	}
+	v.mu.Unlock()
+	if cached {
+		return nil
+	}
+
+	var err error
+	if strings.Contains(ticket, ".") {
+		expiresAt, err = v.verifySigned(ctx, ticket, now)
+	} else {
+		expiresAt, err = v.verifyOnline(ctx, ticket, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= maxCachedTickets {
+		for t, exp := range v.cache {
+			if now.After(exp) || len(v.cache) >= maxCachedTickets {
+				delete(v.cache, t)
+			}
+		}
+	}
+	v.cache[ticket] = expiresAt
+	return nil
+}
+
+// verifySigned checks a base64url(claims).base64url(signature) ticket
+func (v *attestVerifier) verifySigned(ctx context.Context, ticket string, now time.Time) (time.Time, error) {
+	payloadPart, sigPart, _ := strings.Cut(ticket, ".")
+	payload, err1 := base64.RawURLEncoding.DecodeString(payloadPart)
+	sig, err2 := base64.RawURLEncoding.DecodeString(sigPart)
+	var claims ticketClaims
+	if err1 != nil || err2 != nil || json.Unmarshal(payload, &claims) != nil {
+		return time.Time{}, fmt.Errorf("%w: malformed attestation ticket", errForbidden)
+	}
+
+	key, err := v.key(ctx, claims.KeyID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return time.Time{}, fmt.Errorf("%w: attestation ticket signature invalid", errForbidden)
+	}
+	if !claims.Valid || !now.Before(claims.ExpiresAt) {
+		return time.Time{}, fmt.Errorf("%w: attestation ticket invalid or expired", errForbidden)
+	}
+	return claims.ExpiresAt, nil
+}
+
+// key returns the public key with ID kid, refetching attestd's key set when
+// the ID is unknown, e.g. after attestd rotated its key
+func (v *attestVerifier) key(ctx context.Context, kid string) (ed25519.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.keysFetchedAt) >= keyRefreshInterval
+	v.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("%w: attestation ticket signed by unknown key %q", errForbidden, kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyID     string `json:"kid"`
+			Algorithm string `json:"alg"`
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}
+	found, err := v.get(ctx, "/v1/attest/keys", &set)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: attestd does not publish ticket keys", errUpstream)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if k.Algorithm != "ed25519" || err != nil || len(raw) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.KeyID] = ed25519.PublicKey(raw)
+	}
+	v.mu.Lock()
+	v.keys, v.keysFetchedAt = keys, time.Now()
+	v.mu.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: attestation ticket signed by unknown key %q", errForbidden, kid)
+	}
+	return key, nil
+}
+
+// verifyOnline looks an attestation ID up in attestd
+func (v *attestVerifier) verifyOnline(ctx context.Context, id string, now time.Time) (time.Time, error) {
+	var result struct {
+		Valid     bool      `json:"valid"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	found, err := v.get(ctx, "/v1/attest/"+url.PathEscape(id), &result)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found || !result.Valid || !now.Before(result.ExpiresAt) {
+		return time.Time{}, fmt.Errorf("%w: attestation ticket invalid or expired", errForbidden)
+	}
+	return result.ExpiresAt, nil
+}
+
+// get fetches path from attestd into out, retrying network errors and 5xx
+// responses with exponential backoff. It reports false for a 404.
+func (v *attestVerifier) get(ctx context.Context, path string, out interface{}) (bool, error) {
+	var lastErr error
+	backoff := attestBackoff
+	for attempt := 0; attempt <= attestRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return false, fmt.Errorf("%w: attestd: %v", errUnavailable, ctx.Err())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.baseURL+path, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := v.client.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("%w: attestd unreachable: %v", errUnavailable, err)
+			continue
+		}
+		var body bytes.Buffer
+		_, err = body.ReadFrom(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return false, nil
+		case resp.StatusCode >= 500:
+			lastErr = fmt.Errorf("%w: attestd returned HTTP %d", errUpstream, resp.StatusCode)
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				lastErr = fmt.Errorf("%w: attestd returned HTTP %d", errUnavailable, resp.StatusCode)
+			}
+			continue
+		case resp.StatusCode != http.StatusOK:
+			return false, fmt.Errorf("%w: attestd returned HTTP %d", errUpstream, resp.StatusCode)
+		case err != nil:
+			lastErr = fmt.Errorf("%w: read attestd response: %v", errUnavailable, err)
+			continue
+		}
+		if err := json.Unmarshal(body.Bytes(), out); err != nil {
+			return false, fmt.Errorf("%w: invalid attestd response: %v", errUpstream, err)
+		}
+		return true, nil
+	}
+	return false, lastErr
+}
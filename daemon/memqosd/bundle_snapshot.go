@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StateCloning marks a handle being filled from a snapshot; it becomes
+// active once the copy is verified
+const StateCloning = "cloning"
+
+// snapshotDirName holds bundle snapshots next to the allocation WAL. These
+// are copies of handle contents, unrelated to the WAL's own snapshot.
+const snapshotDirName = "snapshots"
+
+// BundleSnapshot is a durable copy of a handle's memory that new handles
+// can be cloned from
+type BundleSnapshot struct {
+	ID             string    `json:"id"`
+	Label          string    `json:"label,omitempty"`
+	SourceHandle   string    `json:"source_handle"`
+	Tier           string    `json:"tier"`
+	SecurityDomain string    `json:"security_domain"`
+	Bytes          uint64    `json:"bytes"`
+	Checksum       string    `json:"checksum"` // sha256:<hex> of the contents
+	CreatedAt      time.Time `json:"created_at"`
+
+	// Path is the contents file in the snapshot directory; it is derived
+	// from the ID rather than stored or served
+	Path string `json:"-"`
+}
+
+// SnapshotRequest is the body of POST /v1/ffm/{id}/snapshot
+type SnapshotRequest struct {
+	Label string `json:"label,omitempty"`
+}
+
+// loadSnapshots reads snapshot metadata from dir/snapshots and returns the
+// next free snapshot number
+func loadSnapshots(dir string) (map[string]*BundleSnapshot, int, error) {
+	snapshots := make(map[string]*BundleSnapshot)
+	next := 1
+	snapDir := filepath.Join(dir, snapshotDirName)
+	if err := os.MkdirAll(snapDir, 0o700); err != nil {
+		return nil, 0, err
+	}
+	metas, err := filepath.Glob(filepath.Join(snapDir, "snap-*.json"))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, path := range metas {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		var snap BundleSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, 0, fmt.Errorf("parse %s: %v", path, err)
+		}
+		snap.Path = filepath.Join(snapDir, snap.ID+".ffm")
+		if _, err := os.Stat(snap.Path); err != nil {
+			log.Printf("Skipping snapshot %s: %v", snap.ID, err)
+			continue
+		}
+		snapshots[snap.ID] = &snap
+		var n int
+		if _, err := fmt.Sscanf(snap.ID, "snap-%x", &n); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	// Drop copies interrupted by a crash
+	partial, _ := filepath.Glob(filepath.Join(snapDir, "*.tmp-*"))
+	for _, path := range partial {
+		os.Remove(path)
+	}
+	return snapshots, next, nil
+}
+
+// CreateSnapshot copies a handle's memory into a durable snapshot file. The
+// copy runs without the service mutex; writers should be quiesced for a
+// consistent image, as the copy is taken while the handle stays live.
+func (s *FFMService) CreateSnapshot(id string, req SnapshotRequest) (*BundleSnapshot, error) {
+	s.mutex.Lock()
+	handle, exists := s.allocations[id]
+	if !exists {
+		s.mutex.Unlock()
+		return nil, notFound("allocation %s not found", id)
+	}
+	if err := requireActive(handle); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	region, hasRegion := s.regions[id]
+	if !hasRegion || s.snapshotDir == "" {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("%w: allocation %s has no backing region to snapshot", errInvalidRequest, id)
+	}
+	snap := &BundleSnapshot{
+		Label:          req.Label,
+		SourceHandle:   id,
+		Tier:           handle.LatencyClass,
+		SecurityDomain: handle.SecurityDomain,
+		Bytes:          region.Size,
+		CreatedAt:      time.Now(),
+	}
+	dir := s.snapshotDir
+	s.mutex.Unlock()
+
+	tmp, err := os.CreateTemp(dir, "snap.ffm.tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("create snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	sum := sha256.New()
+	err = copySparse(tmp, region.file, int64(region.Size), sum)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write snapshot of %s: %v", id, err)
+	}
+	snap.Checksum = "sha256:" + hex.EncodeToString(sum.Sum(nil))
+
+	// Number the snapshot only once its contents are on disk, so failed
+	// copies leave no gaps
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snap.ID = fmt.Sprintf("snap-%04x", s.nextSnapshotID)
+	snap.Path = filepath.Join(dir, snap.ID+".ffm")
+	if err := os.Rename(tmp.Name(), snap.Path); err != nil {
+		return nil, fmt.Errorf("write snapshot of %s: %v", id, err)
+	}
+	meta, err := json.MarshalIndent(snap, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dir, snap.ID+".json"), meta)
+	}
+	if err != nil {
+		os.Remove(snap.Path)
+		return nil, fmt.Errorf("write snapshot metadata: %v", err)
+	}
+	s.nextSnapshotID++
+	s.snapshots[snap.ID] = snap
+	s.emitEvent(Event{
+		Type:           "snapshot_created",
+		HandleID:       id,
+		SecurityDomain: snap.SecurityDomain,
+		Detail:         fmt.Sprintf("%s, %d bytes, %s", snap.ID, snap.Bytes, snap.Checksum),
+	})
+	c := *snap
+	return &c, nil
+}
+
+// cloneSnapshot allocates a handle and fills it from a snapshot. Tier,
+// security domain and size default to the snapshot's. The handle is
+// cloning, and refuses changes, until the copy is verified.
+func (s *FFMService) cloneSnapshot(req AllocationRequest) (*FFMHandle, error) {
+	s.mutex.RLock()
+	snap, ok := s.snapshots[req.FromSnapshot]
+	hasBackend := s.backend != nil
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, invalidField("from_snapshot", "snapshot %s not found", req.FromSnapshot)
+	}
+	if !hasBackend {
+		return nil, fmt.Errorf("%w: cloning a snapshot needs a region backend", errInvalidRequest)
+	}
+	if req.Bytes == 0 {
+		req.Bytes = snap.Bytes
+	}
+	if req.Bytes < snap.Bytes {
+		return nil, invalidField("bytes", "%d bytes is smaller than the %d byte snapshot %s", req.Bytes, snap.Bytes, snap.ID)
+	}
+	if req.LatencyClass == "" {
+		req.LatencyClass = snap.Tier
+	}
+	if req.SecurityDomain == "" {
+		req.SecurityDomain = snap.SecurityDomain
+	}
+
+	handle, err := s.allocate(req, StateCloning)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.RLock()
+	region := s.regions[handle.ID]
+	s.mutex.RUnlock()
+	err = fillFromSnapshot(region, snap)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	h := s.allocations[handle.ID]
+	if err != nil {
+		if rerr := s.releaseLocked(h); rerr != nil {
+			log.Printf("Failed to release failed clone %s: %v", h.ID, rerr)
+		}
+		return nil, fmt.Errorf("clone %s into %s: %w", snap.ID, handle.ID, err)
+	}
+	h.State = StateActive
+	if err := s.persist(h); err != nil {
+		log.Printf("Failed to persist clone %s: %v", h.ID, err)
+	}
+	s.emitEvent(Event{
+		Type:           "cloned",
+		HandleID:       h.ID,
+		SecurityDomain: h.SecurityDomain,
+		Detail:         fmt.Sprintf("from %s (%s on %s)", snap.ID, snap.SourceHandle, snap.Tier),
+	})
+	c := *h
+	return withUpcomingTransitions(&c, time.Now()), nil
+}
+
+// fillFromSnapshot copies a snapshot into a fresh region, verifying its
+// checksum on the way
+func fillFromSnapshot(region *Region, snap *BundleSnapshot) error {
+	f, err := os.Open(snap.Path)
+	if err != nil {
+		return fmt.Errorf("open snapshot: %v", err)
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if err := copySparse(region.file, f, int64(snap.Bytes), sum); err != nil {
+		return fmt.Errorf("copy snapshot: %v", err)
+	}
+	// copySparse sizes the region to the snapshot; restore the full size
+	if err := region.file.Truncate(int64(region.Size)); err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(sum.Sum(nil)); got != snap.Checksum {
+		return fmt.Errorf("snapshot %s is corrupt: checksum %s, want %s", snap.ID, got, snap.Checksum)
+	}
+	return nil
+}
+
+// ListSnapshots returns snapshots ordered by ID, optionally limited to one
+// security domain
+func (s *FFMService) ListSnapshots(domain string) []BundleSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]BundleSnapshot, 0, len(s.snapshots))
+	for _, snap := range s.snapshots {
+		if domain == "" || snap.SecurityDomain == domain {
+			list = append(list, *snap)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// GetSnapshot returns one snapshot
+func (s *FFMService) GetSnapshot(id string) (*BundleSnapshot, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snap, ok := s.snapshots[id]
+	if !ok {
+		return nil, notFound("snapshot %s not found", id)
+	}
+	c := *snap
+	return &c, nil
+}
+
+// DeleteSnapshot removes a snapshot and its files. Handles already cloned
+// from it are unaffected.
+func (s *FFMService) DeleteSnapshot(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snap, ok := s.snapshots[id]
+	if !ok {
+		return notFound("snapshot %s not found", id)
+	}
+	// Metadata first, so a crash never leaves metadata without contents
+	if err := os.Remove(strings.TrimSuffix(snap.Path, ".ffm") + ".json"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete snapshot metadata: %v", err)
+	}
+	if err := os.Remove(snap.Path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to delete snapshot file %s: %v", snap.Path, err)
+	}
+	delete(s.snapshots, id)
+	s.emitEvent(Event{Type: "snapshot_deleted", HandleID: snap.SourceHandle, SecurityDomain: snap.SecurityDomain, Detail: id})
+	return nil
+}
+
+func (s *FFMService) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	snap, err := s.CreateSnapshot(mux.Vars(r)["id"], req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snap)
+}
+
+func (s *FFMService) handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots := s.ListSnapshots(r.URL.Query().Get("security_domain"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+func (s *FFMService) handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap, err := s.GetSnapshot(mux.Vars(r)["sid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+func (s *FFMService) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	if err := s.DeleteSnapshot(mux.Vars(r)["sid"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
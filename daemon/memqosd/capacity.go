@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// TierCapacity is the byte and bandwidth budget of one memory tier
+type TierCapacity struct {
+	Tier         string `json:"tier"`
+	Desc         string `json:"desc"`
+	Bytes        uint64 `json:"bytes"`
+	BandwidthGBs uint64 `json:"bandwidth_GBs"`
+}
+
+// TierUsage reports committed and free capacity of a tier
+type TierUsage struct {
+	TierCapacity
+	CommittedBytes        uint64 `json:"committed_bytes"`
+	FreeBytes             uint64 `json:"free_bytes"`
+	CommittedBandwidthGBs uint64 `json:"committed_bandwidth_GBs"`
+	FreeBandwidthGBs      uint64 `json:"free_bandwidth_GBs"`
+	Allocations           int    `json:"allocations"`
+}
+
+// CapacityError reports an allocation that would overcommit a tier
+type CapacityError struct {
+	Tier      string `json:"tier"`
+	Resource  string `json:"resource"` // bytes, bandwidth
+	Requested uint64 `json:"requested"`
+	Available uint64 `json:"available"`
+	Capacity  uint64 `json:"capacity"`
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("insufficient %s on tier %s: requested %d, available %d of %d",
+		e.Resource, e.Tier, e.Requested, e.Available, e.Capacity)
+}
+
+// defaultTiers returns the built-in inventory used when no policy is loaded
+func defaultTiers() map[string]*TierCapacity {
+	return map[string]*TierCapacity{
+		"T0": {Tier: "T0", Desc: "HBM", Bytes: 128 << 30, BandwidthGBs: 1000},
+		"T1": {Tier: "T1", Desc: "DDR5", Bytes: 1 << 40, BandwidthGBs: 400},
+		"T2": {Tier: "T2", Desc: "CXL_DRAM", Bytes: 2 << 40, BandwidthGBs: 400},
+		"T3": {Tier: "T3", Desc: "Persistent", Bytes: 8 << 40, BandwidthGBs: 40},
+	}
+}
+
+// SetTiers replaces the tier inventory
+func (s *FFMService) SetTiers(tiers map[string]*TierCapacity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tiers = tiers
+	s.arbitrateLocked()
+}
+
+// tierUsage sums what is committed on a tier, including reservations of
+// handles migrating onto it, skipping the handle excludeID; callers must
+// hold s.mutex
+func (s *FFMService) tierUsage(tier, excludeID string) (bytes, bandwidth uint64, count int) {
+	for id, h := range s.allocations {
+		if (h.LatencyClass != tier && h.MigratingTo != tier) || id == excludeID {
+			continue
+		}
+		bytes += h.Bytes
+		bandwidth += h.BandwidthFloor
+		count++
+	}
+	return bytes, bandwidth, count
+}
+
+// validateAllocationLocked rejects allocation requests that could never be
+// admitted: empty or unknown sizes, tiers and persistence levels, and
+// requests larger than a whole tier. Callers must hold s.mutex.
+func (s *FFMService) validateAllocationLocked(req AllocationRequest, floor uint64) error {
+	if req.Bytes == 0 {
+		return invalidField("bytes", "bytes must be greater than zero")
+	}
+	capacity, ok := s.tiers[req.LatencyClass]
+	if !ok {
+		tiers := make([]string, 0, len(s.tiers))
+		for name := range s.tiers {
+			tiers = append(tiers, name)
+		}
+		sort.Strings(tiers)
+		return invalidField("latency_class", "unknown latency class %q (want one of %s)", req.LatencyClass, strings.Join(tiers, ", "))
+	}
+	if req.Bytes > capacity.Bytes {
+		return invalidField("bytes", "%d bytes exceeds the %d byte capacity of tier %s", req.Bytes, capacity.Bytes, req.LatencyClass)
+	}
+	if floor > capacity.BandwidthGBs {
+		return invalidField("bandwidth_floor_GBs", "floor of %d GB/s exceeds the %d GB/s budget of tier %s", floor, capacity.BandwidthGBs, req.LatencyClass)
+	}
+	return validatePersistence(req.Persistence)
+}
+
+// admit checks that placing bytes and bandwidth on tier (in place of the
+// handle excludeID, if any) fits the tier's budget; callers must hold s.mutex
+func (s *FFMService) admit(tier string, bytes, bandwidth uint64, excludeID string) error {
+	capacity, ok := s.tiers[tier]
+	if !ok {
+		return invalidField("target", "unknown latency class %q", tier)
+	}
+	usedBytes, usedBandwidth, _ := s.tierUsage(tier, excludeID)
+
+	if freeBytes := sub(capacity.Bytes, usedBytes); bytes > freeBytes {
+		return &CapacityError{Tier: tier, Resource: "bytes", Requested: bytes, Available: freeBytes, Capacity: capacity.Bytes}
+	}
+	if freeBandwidth := sub(capacity.BandwidthGBs, usedBandwidth); bandwidth > freeBandwidth {
+		return &CapacityError{Tier: tier, Resource: "bandwidth", Requested: bandwidth, Available: freeBandwidth, Capacity: capacity.BandwidthGBs}
+	}
+	return nil
+}
+
+// Capacity reports free and committed capacity for every tier
+func (s *FFMService) Capacity() []TierUsage {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	usage := make([]TierUsage, 0, len(s.tiers))
+	for name, capacity := range s.tiers {
+		bytes, bandwidth, count := s.tierUsage(name, "")
+		usage = append(usage, TierUsage{
+			TierCapacity:          *capacity,
+			CommittedBytes:        bytes,
+			FreeBytes:             sub(capacity.Bytes, bytes),
+			CommittedBandwidthGBs: bandwidth,
+			FreeBandwidthGBs:      sub(capacity.BandwidthGBs, bandwidth),
+			Allocations:           count,
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tier < usage[j].Tier })
+	return usage
+}
+
+// sub returns a-b, clamped at zero
+func sub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+func (s *FFMService) handleCapacity(w http.ResponseWriter, r *http.Request) {
+	usage := s.Capacity()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+var (
+	// errHandleBusy is returned when a handle cannot change state right now
+	errHandleBusy = errors.New("handle busy")
+
+	// errInvalidRequest is returned for requests that can never succeed
+	errInvalidRequest = errors.New("invalid request")
+
+	// errForbidden is returned when a caller may not act on a handle
+	errForbidden = errors.New("forbidden")
+
+	// errNotFound is returned for unknown handles and other resources
+	errNotFound = errors.New("not found")
+
+	// errUpstream is returned when a service memqosd depends on answered
+	// with an error
+	errUpstream = errors.New("upstream error")
+
+	// errUnavailable is returned when a service memqosd depends on could
+	// not be reached, or memqosd itself is out of a resource
+	errUnavailable = errors.New("unavailable")
+)
+
+// RequestError is an error of a known class. Field names the request field
+// at fault for validation errors.
+type RequestError struct {
+	Kind    error
+	Field   string
+	Message string
+}
+
+func (e *RequestError) Error() string { return e.Message }
+
+func (e *RequestError) Unwrap() error { return e.Kind }
+
+// notFound reports a missing resource
+func notFound(format string, args ...interface{}) error {
+	return &RequestError{Kind: errNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+// invalidField reports a request field with an unacceptable value
+func invalidField(field, format string, args ...interface{}) error {
+	return &RequestError{Kind: errInvalidRequest, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// ErrorBody is the JSON envelope of every memqosd error response
+type ErrorBody struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Field     string      `json:"field,omitempty"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// errorClasses maps error sentinels to status, code and whether retrying
+// the same request can succeed
+var errorClasses = []struct {
+	kind      error
+	status    int
+	code      string
+	retryable bool
+}{
+	{errInvalidRequest, http.StatusBadRequest, "invalid_request", false},
+	{errNotFound, http.StatusNotFound, "not_found", false},
+	{errForbidden, http.StatusForbidden, "forbidden", false},
+	{errHandleBusy, http.StatusConflict, "handle_busy", true},
+	{errUpstream, http.StatusBadGateway, "upstream_error", true},
+	{errUnavailable, http.StatusServiceUnavailable, "unavailable", true},
+}
+
+// writeError writes err as an error envelope, choosing the status from its
+// class; unclassified errors are internal errors
+func writeError(w http.ResponseWriter, err error) {
+	var capErr *CapacityError
+	var quotaErr *QuotaError
+	switch {
+	case errors.As(err, &capErr):
+		// Capacity frees up as other handles are released
+		writeErrorBody(w, http.StatusConflict, ErrorBody{
+			Code: "insufficient_capacity", Message: err.Error(), Retryable: true, Details: capErr,
+		})
+		return
+	case errors.As(err, &quotaErr):
+		writeErrorBody(w, http.StatusForbidden, ErrorBody{
+			Code: "quota_exceeded", Message: err.Error(), Details: quotaErr,
+		})
+		return
+	}
+
+	body := ErrorBody{Code: "internal", Message: err.Error()}
+	status := http.StatusInternalServerError
+	for _, c := range errorClasses {
+		if errors.Is(err, c.kind) {
+			status, body.Code, body.Retryable = c.status, c.code, c.retryable
+			break
+		}
+	}
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		body.Field = reqErr.Field
+	}
+	writeErrorBody(w, status, body)
+}
+
+// writeErrorBody writes an error envelope with an explicit status
+func writeErrorBody(w http.ResponseWriter, status int, body ErrorBody) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// decodeBody decodes a JSON request body into v, naming the offending
+// field when a value has the wrong type, such as a negative floor
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, io.EOF):
+		return &RequestError{Kind: errInvalidRequest, Message: "request body is empty"}
+	case errors.As(err, &typeErr):
+		want := typeErr.Type.String()
+		switch typeErr.Type.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			want = "non-negative integer"
+		}
+		return invalidField(typeErr.Field, "%s must be a %s, got %s", typeErr.Field, want, typeErr.Value)
+	default:
+		return &RequestError{Kind: errInvalidRequest, Message: "invalid request body: " + err.Error()}
+	}
+}
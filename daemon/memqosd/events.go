@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxEvents bounds the in-memory event history; older events are read
+	// back from the journal
+	maxEvents = 1024
+	// eventJournalFile is the append-only event journal in the state dir
+	eventJournalFile = "events.jsonl"
+	// maxJournalEvents bounds the journal; the oldest events are dropped
+	// when it is reopened
+	maxJournalEvents = 100000
+	// defaultEventLimit and maxEventLimit bound one page of events
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+// Event records a notable state change of an FFM allocation. Before and
+// After hold the fields the change touched.
+type Event struct {
+	Seq            uint64                 `json:"seq"`
+	Type           string                 `json:"type"`
+	HandleID       string                 `json:"handle_id"`
+	SecurityDomain string                 `json:"security_domain,omitempty"`
+	Detail         string                 `json:"detail,omitempty"`
+	Before         map[string]interface{} `json:"before,omitempty"`
+	After          map[string]interface{} `json:"after,omitempty"`
+	At             time.Time              `json:"at"`
+}
+
+// EventQuery selects a page of events after a cursor
+type EventQuery struct {
+	Since          uint64
+	Limit          int
+	HandleID       string
+	SecurityDomain string
+	Type           string
+}
+
+// matches reports whether ev passes the query's filters
+func (q EventQuery) matches(ev Event) bool {
+	return (q.HandleID == "" || ev.HandleID == q.HandleID) &&
+		(q.SecurityDomain == "" || ev.SecurityDomain == q.SecurityDomain) &&
+		(q.Type == "" || ev.Type == q.Type)
+}
+
+// EventPage is one page of events. Pass NextCursor as since to continue;
+// Truncated is set when events after since were already dropped.
+type EventPage struct {
+	Events     []Event `json:"events"`
+	NextCursor uint64  `json:"next_cursor"`
+	Truncated  bool    `json:"truncated,omitempty"`
+}
+
+// eventJournal appends events to a JSON-lines file. Appends are not synced:
+// the journal is a record for consumers, not a source of state, so a crash
+// may lose the last few events.
+type eventJournal struct {
+	path string
+	f    *os.File
+}
+
+// openEventJournal opens the journal in dir for appending and returns the
+// most recent events. A journal beyond maxJournalEvents, or one ending in a
+// torn write, is rewritten first.
+func openEventJournal(dir string) (*eventJournal, []Event, error) {
+	path := filepath.Join(dir, eventJournalFile)
+	var lines [][]byte
+	rewrite := false
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			if !json.Valid(scanner.Bytes()) {
+				rewrite = true
+				continue
+			}
+			lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read event journal: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if len(lines) > maxJournalEvents {
+		lines = lines[len(lines)-maxJournalEvents:]
+		rewrite = true
+	}
+	if rewrite {
+		var buf bytes.Buffer
+		for _, line := range lines {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+			return nil, nil, fmt.Errorf("compact event journal: %v", err)
+		}
+	}
+
+	tail := lines
+	if len(tail) > maxEvents {
+		tail = tail[len(tail)-maxEvents:]
+	}
+	events := make([]Event, 0, len(tail))
+	for _, line := range tail {
+		var ev Event
+		if err := json.Unmarshal(line, &ev); err == nil {
+			events = append(events, ev)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &eventJournal{path: path, f: f}, events, nil
+}
+
+// append writes one event as a single line
+func (j *eventJournal) append(ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = j.f.Write(append(data, '\n'))
+	return err
+}
+
+func (j *eventJournal) Close() error {
+	return j.f.Close()
+}
+
+// readEventJournal returns the page of journal events after q.Since. It
+// reads the file without the service mutex; a line still being appended is
+// skipped.
+func readEventJournal(path string, q EventQuery) (EventPage, error) {
+	page := EventPage{Events: []Event{}, NextCursor: q.Since}
+	f, err := os.Open(path)
+	if err != nil {
+		return page, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	first := true
+	for scanner.Scan() && len(page.Events) < q.Limit {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		if first {
+			page.Truncated = ev.Seq > q.Since+1
+			first = false
+		}
+		if ev.Seq <= q.Since {
+			continue
+		}
+		page.NextCursor = ev.Seq
+		if q.matches(ev) {
+			page.Events = append(page.Events, ev)
+		}
+	}
+	return page, scanner.Err()
+}
+
+// handleValues returns the fields of a handle events report on creation
+func handleValues(h *FFMHandle) map[string]interface{} {
+	return map[string]interface{}{
+		"bytes":               h.Bytes,
+		"latency_class":       h.LatencyClass,
+		"bandwidth_floor_GBs": h.BandwidthFloor,
+		"persistence":         h.Persistence,
+		"priority":            h.Priority,
+		"state":               h.State,
+	}
+}
+
+// emitEvent appends an event to the history and journal and hands it to
+// webhooks; callers must hold s.mutex
+func (s *FFMService) emitEvent(ev Event) {
+	s.eventSeq++
+	ev.Seq = s.eventSeq
+	ev.At = time.Now()
+	s.events = append(s.events, ev)
+	if len(s.events) > maxEvents {
+		s.events = s.events[len(s.events)-maxEvents:]
+	}
+	if s.journal != nil {
+		if err := s.journal.append(ev); err != nil {
+			log.Printf("Failed to journal event %d: %v", ev.Seq, err)
+		}
+	}
+	s.webhooks.publish(ev)
+	log.Printf("event %d: %s %s %s", ev.Seq, ev.Type, ev.HandleID, ev.Detail)
+}
+
+// ListEvents returns the events after q.Since, oldest first. Recent events
+// are served from memory, older ones from the journal.
+func (s *FFMService) ListEvents(q EventQuery) (EventPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultEventLimit
+	}
+	if q.Limit > maxEventLimit {
+		q.Limit = maxEventLimit
+	}
+
+	s.mutex.RLock()
+	inMemory := len(s.events) == 0 || q.Since+1 >= s.events[0].Seq
+	if inMemory || s.journal == nil {
+		defer s.mutex.RUnlock()
+		page := EventPage{Events: []Event{}, NextCursor: q.Since}
+		page.Truncated = len(s.events) > 0 && q.Since+1 < s.events[0].Seq
+		for _, ev := range s.events {
+			if len(page.Events) >= q.Limit {
+				break
+			}
+			if ev.Seq <= q.Since {
+				continue
+			}
+			page.NextCursor = ev.Seq
+			if q.matches(ev) {
+				page.Events = append(page.Events, ev)
+			}
+		}
+		return page, nil
+	}
+	path := s.journal.path
+	s.mutex.RUnlock()
+
+	page, err := readEventJournal(path, q)
+	if err != nil {
+		return page, fmt.Errorf("read event journal: %v", err)
+	}
+	return page, nil
+}
+
+func (s *FFMService) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := EventQuery{
+		HandleID:       query.Get("handle_id"),
+		SecurityDomain: query.Get("security_domain"),
+		Type:           query.Get("type"),
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, invalidField("since", "since must be an event sequence number, got %q", v))
+			return
+		}
+		q.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeError(w, invalidField("limit", "limit must be a positive integer, got %q", v))
+			return
+		}
+		q.Limit = limit
+	}
+
+	page, err := s.ListEvents(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
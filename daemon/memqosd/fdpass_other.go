@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// ServeFDs is unavailable without Unix domain sockets
+func (s *FFMService) ServeFDs(path string, stop <-chan struct{}) error {
+	return errors.New("fd passing requires Unix domain sockets")
+}
@@ -0,0 +1,167 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fdConnTimeout bounds a whole request/response exchange on the fd socket
+const fdConnTimeout = 10 * time.Second
+
+// FDRequest asks the fd socket for a duplicate of a handle's region fd.
+// The owner presents the descriptor issued on allocation; consumers of
+// shared handles present the one issued on attach.
+type FDRequest struct {
+	HandleID   string `json:"handle_id"`
+	Descriptor string `json:"descriptor,omitempty"`
+}
+
+// FDResponse accompanies the fd, passed as SCM_RIGHTS ancillary data
+type FDResponse struct {
+	HandleID    string      `json:"handle_id"`
+	Bytes       uint64      `json:"bytes,omitempty"`
+	Persistence string      `json:"persistence,omitempty"`
+	Region      *RegionInfo `json:"region,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// ServeFDs listens on a Unix socket and hands region fds to local clients
+// until stop is closed. The socket's file mode limits who may connect; each
+// request must also carry the owner's or an attached consumer's descriptor,
+// so a client cannot reach handles of another security domain.
+func (s *FFMService) ServeFDs(path string, stop <-chan struct{}) error {
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		<-stop
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("fd socket accept failed: %v", err)
+				}
+				return
+			}
+			go s.serveFDConn(conn)
+		}
+	}()
+	return nil
+}
+
+// serveFDConn answers one FDRequest per line until the client hangs up
+func (s *FFMService) serveFDConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(fdConnTimeout))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req FDRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			writeFDResponse(conn, FDResponse{Error: "invalid request"}, -1)
+			return
+		}
+
+		resp, fd, err := s.dupRegion(req)
+		if err != nil {
+			resp = FDResponse{HandleID: req.HandleID, Error: err.Error()}
+		}
+		err = writeFDResponse(conn, resp, fd)
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeFDResponse sends a response line, with fd attached when it is valid
+func writeFDResponse(conn *net.UnixConn, resp FDResponse, fd int) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if fd >= 0 {
+		oob = syscall.UnixRights(fd)
+	}
+	_, _, err = conn.WriteMsgUnix(append(data, '\n'), oob, nil)
+	return err
+}
+
+// descriptorAllowed reports whether descriptor is the handle owner's or an
+// attached consumer's. An empty descriptor never is.
+func descriptorAllowed(handle *FFMHandle, descriptor string) bool {
+	if descriptor == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(descriptor), []byte(handle.OwnerDescriptor)) == 1 {
+		return true
+	}
+	for _, c := range handle.Consumers {
+		if subtle.ConstantTimeCompare([]byte(descriptor), []byte(c.Descriptor)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// dupRegion duplicates the region fd of an active handle so it can be sent
+// after s.mutex is released
+func (s *FFMService) dupRegion(req FDRequest) (FDResponse, int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	handle, exists := s.allocations[req.HandleID]
+	if !exists {
+		return FDResponse{}, -1, notFound("allocation %s not found", req.HandleID)
+	}
+	if err := requireActive(handle); err != nil {
+		return FDResponse{}, -1, err
+	}
+	if !descriptorAllowed(handle, req.Descriptor) {
+		return FDResponse{}, -1, fmt.Errorf("%w: descriptor does not grant access to allocation %s", errForbidden, req.HandleID)
+	}
+	region, ok := s.regions[req.HandleID]
+	if !ok {
+		return FDResponse{}, -1, fmt.Errorf("allocation %s has no backing region", req.HandleID)
+	}
+
+	fd, err := syscall.Dup(int(region.file.Fd()))
+	if err != nil {
+		return FDResponse{}, -1, err
+	}
+	syscall.CloseOnExec(fd)
+	info := region.RegionInfo
+	return FDResponse{
+		HandleID:    handle.ID,
+		Bytes:       handle.Bytes,
+		Persistence: handle.Persistence,
+		Region:      &info,
+	}, fd, nil
+}
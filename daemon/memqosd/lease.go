@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultLeaseTTL = 3600  // seconds
+	maxLeaseTTL     = 86400 // seconds
+)
+
+// RenewRequest represents a lease renewal request
+type RenewRequest struct {
+	TTLSeconds int `json:"ttl_s,omitempty"`
+}
+
+// RenewLease extends an allocation's lease by its TTL (or a new TTL)
+func (s *FFMService) RenewLease(id string, req RenewRequest) (*FFMHandle, error) {
+	if req.TTLSeconds < 0 || req.TTLSeconds > maxLeaseTTL {
+		return nil, invalidField("ttl_s", "ttl_s must be between 1 and %d, or 0 to keep the current TTL", maxLeaseTTL)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return nil, notFound("allocation %s not found", id)
+	}
+	if err := requireActive(handle); err != nil {
+		return nil, err
+	}
+
+	oldTTL, oldExpiry := handle.PolicyLeaseTTL, handle.LeaseExpiresAt
+	if req.TTLSeconds > 0 {
+		handle.PolicyLeaseTTL = req.TTLSeconds
+	}
+	handle.LeaseExpiresAt = time.Now().Add(time.Duration(handle.PolicyLeaseTTL) * time.Second)
+	if err := s.persist(handle); err != nil {
+		handle.PolicyLeaseTTL, handle.LeaseExpiresAt = oldTTL, oldExpiry
+		return nil, fmt.Errorf("persist lease renewal: %v", err)
+	}
+
+	c := *handle
+	return redactDescriptors(&c), nil
+}
+
+// reapExpiredLeases releases every allocation whose lease lapsed more than
+// grace ago and returns the IDs that were reaped. Like Release, it leaves
+// shared handles alone while consumers are attached; they are reaped once
+// the last consumer detaches.
+func (s *FFMService) reapExpiredLeases(now time.Time, grace time.Duration) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var reaped []string
+	for id, handle := range s.allocations {
+		if handle.State != StateActive || !now.After(handle.LeaseExpiresAt.Add(grace)) {
+			continue
+		}
+		// Policy-managed bundles live as long as the policy declares them
+		if handle.Bundle != "" {
+			continue
+		}
+		if handle.RefCount > 0 {
+			continue
+		}
+		if err := s.releaseLocked(handle); err != nil {
+			log.Printf("Failed to release expired allocation %s: %v", id, err)
+			continue
+		}
+		s.metrics.LeaseExpirations.Inc()
+		s.emitEvent(Event{
+			Type:           "lease_expired",
+			HandleID:       id,
+			SecurityDomain: handle.SecurityDomain,
+			Detail:         fmt.Sprintf("lease expired at %s", handle.LeaseExpiresAt.Format(time.RFC3339)),
+			Before:         map[string]interface{}{"state": StateActive},
+			After:          map[string]interface{}{"state": StateReleased},
+		})
+		reaped = append(reaped, id)
+	}
+	return reaped
+}
+
+// runLeaseReaper periodically expires allocations whose lease has lapsed
+func (s *FFMService) runLeaseReaper(interval, grace time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, id := range s.reapExpiredLeases(now, grace) {
+				log.Printf("Lease expired for %s, allocation released", id)
+			}
+		}
+	}
+}
+
+func (s *FFMService) handleRenewLease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req RenewRequest
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	handle, err := s.RenewLease(id, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handle)
+}
@@ -8,7 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -29,11 +29,29 @@ type FFMHandle struct {
     SecurityDomain   string    `json:"security_domain"`
     CreatedAt        time.Time `json:"created_at"`
     PolicyLeaseTTL   int       `json:"policy_lease_ttl_s"`
+    LeaseExpiresAt   time.Time `json:"lease_expires_at"`
     FileDescriptors  []string  `json:"fds"`
     AchievedBandwidth uint64   `json:"achieved_GBs"`
     MovedPages       uint64    `json:"moved_pages"`
     TailP99Ms        float64   `json:"tail_p99_ms"`
     AttestationTicket string   `json:"attestation_ticket,omitempty"`
+    State            string    `json:"state"`
+    RefCount         int       `json:"refcount"`
+    Consumers        []Consumer `json:"consumers,omitempty"`
+    OwnerDescriptor  string    `json:"owner_descriptor,omitempty"` // presented by the owner on the fd socket; only in the alloc response
+    MigrationID      string    `json:"migration_id,omitempty"`
+    MigratingTo      string    `json:"migrating_to,omitempty"`
+    Schedule         []ScheduleWindow     `json:"schedule,omitempty"`
+    ActiveWindow     string               `json:"active_window,omitempty"`
+    UpcomingTransitions []ScheduleTransition `json:"upcoming_transitions,omitempty"`
+    Bundle           string    `json:"bundle,omitempty"`
+    Priority         string    `json:"priority,omitempty"`
+    Region           *RegionInfo `json:"region,omitempty"`
+    Placement        *Placement  `json:"placement,omitempty"`
+    LastSyncedAt     *time.Time  `json:"last_synced_at,omitempty"`
+    ClonedFrom       string      `json:"cloned_from,omitempty"`
+
+    failedWindow     string // schedule window whose floor last failed to apply
 }
 
 // AllocationRequest represents a memory allocation request
@@ -46,6 +64,10 @@ type AllocationRequest struct {
     SecurityDomain   string `json:"security_domain"`
     AttestationRequired bool   `json:"attestation_required,omitempty"`
     AttestationTicket   string `json:"attestation_ticket,omitempty"`
+    Schedule         []ScheduleWindow `json:"schedule,omitempty"`
+    Bundle           string `json:"-"` // set by policy reconciliation only
+    Priority         string `json:"priority,omitempty"` // gold, silver (default) or bronze
+    FromSnapshot     string `json:"from_snapshot,omitempty"` // clone contents from this snapshot
 }
 
 // BandwidthAdjustRequest represents a bandwidth adjustment request
@@ -74,6 +96,33 @@ type FFMService struct {
     mutex       sync.RWMutex
     nextID      int
     metrics     *FFMMetrics
+    store       *allocationStore
+    events      []Event
+    eventSeq    uint64
+    tiers       map[string]*TierCapacity
+    migrations  map[string]*Migration
+    nextMigrationID int
+    policy      *FFMPolicy
+    bundles     map[string]AllocationRequest
+    policyPath  string
+    quotas      map[string]*Quota
+    telemetrySource TelemetrySource
+    telemetry   map[string]TelemetryResponse // latest sample per handle
+    streams     *streamHub
+    slo         map[string]*sloTracker
+    sloWindow   time.Duration
+    sloRemediate bool
+    backend     RegionBackend
+    regions     map[string]*Region
+    topology    *Topology
+    attest      *attestVerifier
+    snapshots   map[string]*BundleSnapshot
+    nextSnapshotID int
+    snapshotDir string
+    arbitration map[string]*TierArbitration
+    grants      map[string]float64 // arbitrated bandwidth per handle
+    journal     *eventJournal
+    webhooks    *webhookHub
 }
 
 // FFMMetrics holds Prometheus metrics
@@ -83,6 +132,9 @@ type FFMMetrics struct {
 	LatencyP99          prometheus.Histogram
 	MigrationCount      prometheus.Counter
 	AllocationDuration  prometheus.Histogram
+	LeaseExpirations    prometheus.Counter
+	SLOViolations       *prometheus.CounterVec
+	SLORemediations     *prometheus.CounterVec
 }
 
 // NewFFMService creates a new FFM service
@@ -110,6 +162,18 @@ func NewFFMService() *FFMService {
 			Help:    "Time taken to allocate FFM",
 			Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
 		}),
+		LeaseExpirations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ffm_lease_expirations_total",
+			Help: "Total number of allocations released by lease expiry",
+		}),
+		SLOViolations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ffm_slo_violations_total",
+			Help: "Total number of FFM SLO violations",
+		}, []string{"tier", "security_domain", "kind"}),
+		SLORemediations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ffm_slo_remediations_total",
+			Help: "Total number of automatic FFM SLO remediations",
+		}, []string{"tier", "security_domain", "kind"}),
 	}
 
 	prometheus.MustRegister(metrics.AllocationsTotal)
@@ -117,67 +181,163 @@ func NewFFMService() *FFMService {
 	prometheus.MustRegister(metrics.LatencyP99)
 	prometheus.MustRegister(metrics.MigrationCount)
 	prometheus.MustRegister(metrics.AllocationDuration)
+	prometheus.MustRegister(metrics.LeaseExpirations)
+	prometheus.MustRegister(metrics.SLOViolations)
+	prometheus.MustRegister(metrics.SLORemediations)
 
-	return &FFMService{
+	s := &FFMService{
 		allocations: make(map[string]*FFMHandle),
 		metrics:     metrics,
 		nextID:      1,
+		tiers:       defaultTiers(),
+		migrations:  make(map[string]*Migration),
+		nextMigrationID: 1,
+		quotas:      make(map[string]*Quota),
+		telemetrySource: NewSimulatedSource(),
+		telemetry:   make(map[string]TelemetryResponse),
+		streams:     newStreamHub(),
+		slo:         make(map[string]*sloTracker),
+		sloWindow:   defaultSLOWindow,
+		regions:     make(map[string]*Region),
+		attest:      newAttestVerifier(attestdURL()),
+		snapshots:   make(map[string]*BundleSnapshot),
+		nextSnapshotID: 1,
+		webhooks:    newWebhookHub(),
 	}
+	s.arbitrateLocked()
+	return s
 }
 
-// Allocate creates a new FFM allocation
+// Allocate creates a new FFM allocation, cloned from a snapshot when
+// req.FromSnapshot is set
 func (s *FFMService) Allocate(req AllocationRequest) (*FFMHandle, error) {
+	if req.FromSnapshot != "" {
+		return s.cloneSnapshot(req)
+	}
+	return s.allocate(req, StateActive)
+}
+
+// allocate creates a handle in the given initial state
+func (s *FFMService) allocate(req AllocationRequest, state string) (*FFMHandle, error) {
 	start := time.Now()
 	defer func() {
 		s.metrics.AllocationDuration.Observe(time.Since(start).Seconds())
 	}()
 
+	schedule, err := normalizeSchedule(req.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := normalizePriority(req.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	// A scheduled allocation starts on the floor of its active window
+	floor, window := req.BandwidthFloor, ""
+	if w, ok := activeWindow(schedule, start); ok {
+		floor, window = w.FloorGBs, w.Name
+	}
+
+	// Enforce attestation when requested, before taking the lock so a slow
+	// attestd cannot stall other requests
+	if req.AttestationRequired {
+		if req.AttestationTicket == "" {
+			return nil, invalidField("attestation_ticket", "attestation required but no ticket provided")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), attestDeadline)
+		err := s.attest.Verify(ctx, req.AttestationTicket)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("attestation verification failed: %w", err)
+		}
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-    // Enforce attestation when requested
-    if req.AttestationRequired {
-        if req.AttestationTicket == "" {
-            return nil, fmt.Errorf("attestation required but no ticket provided")
-        }
-        ok, err := verifyAttestation(req.AttestationTicket)
-        if err != nil {
-            return nil, fmt.Errorf("attestation verification failed: %v", err)
-        }
-        if !ok {
-            return nil, fmt.Errorf("attestation ticket invalid or expired")
-        }
+	if err := s.validateAllocationLocked(req, floor); err != nil {
+		return nil, err
+	}
+	if err := s.validateScheduleLocked(schedule, req.LatencyClass, req.SecurityDomain); err != nil {
+		return nil, err
+	}
+
+    // Admission control against the tier inventory
+    if err := s.admit(req.LatencyClass, req.Bytes, floor, ""); err != nil {
+        return nil, err
+    }
+    if err := s.admitQuota(req.SecurityDomain, req.LatencyClass, req.Bytes, floor, ""); err != nil {
+        return nil, err
     }
 
     // Generate unique ID
     id := fmt.Sprintf("ffm-%04x", s.nextID)
+    owner, err := newDescriptor(id)
+    if err != nil {
+        return nil, err
+    }
     s.nextID++
 
 	// Create allocation
+	now := time.Now()
 	handle := &FFMHandle{
 		ID:               id,
 		Bytes:            req.Bytes,
 		LatencyClass:     req.LatencyClass,
-		BandwidthFloor:   req.BandwidthFloor,
+		BandwidthFloor:   floor,
 		Persistence:      req.Persistence,
 		Shareable:        req.Shareable,
 		SecurityDomain:   req.SecurityDomain,
-		CreatedAt:        time.Now(),
-		PolicyLeaseTTL:   3600, // 1 hour default
-		FileDescriptors:  []string{fmt.Sprintf("/proc/12345/fd/%d", s.nextID)},
-		AchievedBandwidth: uint64(float64(req.BandwidthFloor) * 0.9), // Simulate 90% achievement
+		CreatedAt:        now,
+		PolicyLeaseTTL:   defaultLeaseTTL,
+		LeaseExpiresAt:   now.Add(defaultLeaseTTL * time.Second),
+		FileDescriptors:  []string{},
 		MovedPages:       0,
-        TailP99Ms:        2.1,
         AttestationTicket: req.AttestationTicket,
+        State:            state,
+        Schedule:         schedule,
+        ActiveWindow:     window,
+        Bundle:           req.Bundle,
+        Priority:         priority,
+        ClonedFrom:       req.FromSnapshot,
+        OwnerDescriptor:  owner,
     }
 
+	// Back the handle with real memory
+	if s.backend != nil {
+		region, err := s.backend.Create(handle)
+		if err != nil {
+			return nil, fmt.Errorf("create backing region: %v", err)
+		}
+		s.attachRegionLocked(handle, region)
+		s.placeRegionLocked(handle, false)
+	}
+
+	if err := s.persist(handle); err != nil {
+		s.releaseRegionLocked(handle)
+		return nil, fmt.Errorf("persist allocation: %v", err)
+	}
 	s.allocations[id] = handle
+	s.arbitrateLocked()
+	if _, err := s.sampleLocked(handle, now); err != nil {
+		log.Printf("Telemetry sample of %s failed: %v", id, err)
+	}
 
 	// Update metrics
 	s.metrics.AllocationsTotal.Set(float64(len(s.allocations)))
-	s.metrics.BandwidthTotal.Add(float64(req.BandwidthFloor))
-
-	return handle, nil
+	s.metrics.BandwidthTotal.Add(float64(floor))
+
+	s.emitEvent(Event{
+		Type:           "allocated",
+		HandleID:       id,
+		SecurityDomain: handle.SecurityDomain,
+		Detail:         fmt.Sprintf("%d bytes on %s, floor %d GB/s", handle.Bytes, handle.LatencyClass, floor),
+		After:          handleValues(handle),
+	})
+
+	c := *handle
+	return withUpcomingTransitions(&c, start), nil
 }
 
 // GetTelemetry returns telemetry for an allocation
@@ -187,17 +347,20 @@ func (s *FFMService) GetTelemetry(id string) (*TelemetryResponse, error) {
 
 	handle, exists := s.allocations[id]
 	if !exists {
-		return nil, fmt.Errorf("allocation %s not found", id)
+		return nil, notFound("allocation %s not found", id)
 	}
 
-	return &TelemetryResponse{
-		AchievedGBs:  handle.AchievedBandwidth,
-		MovedPages:   handle.MovedPages,
-		TailP99Ms:    handle.TailP99Ms,
-		Temperature:  45.2,
-		PowerW:       12.5,
-		Utilization:  85.3,
-	}, nil
+	// Serve the latest periodic sample; handles not sampled yet are sampled
+	// on demand without recording the reading
+	if sample, ok := s.telemetry[id]; ok {
+		sample.MovedPages = handle.MovedPages
+		return &sample, nil
+	}
+	sample, err := s.telemetrySource.Sample(handle, s.tierLoad(handle), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: telemetry for allocation %s: %v", errUnavailable, id, err)
+	}
+	return &sample, nil
 }
 
 // AdjustBandwidth modifies bandwidth floor for an allocation
@@ -207,35 +370,81 @@ func (s *FFMService) AdjustBandwidth(id string, req BandwidthAdjustRequest) erro
 
 	handle, exists := s.allocations[id]
 	if !exists {
-		return fmt.Errorf("allocation %s not found", id)
+		return notFound("allocation %s not found", id)
+	}
+	if err := requireActive(handle); err != nil {
+		return err
 	}
 
 	oldFloor := handle.BandwidthFloor
-	handle.BandwidthFloor = req.FloorGBs
-	handle.AchievedBandwidth = uint64(float64(req.FloorGBs) * 0.9)
+	if err := s.setBandwidthFloor(handle, req.FloorGBs); err != nil {
+		return err
+	}
+	s.emitEvent(Event{
+		Type:           "bandwidth_changed",
+		HandleID:       id,
+		SecurityDomain: handle.SecurityDomain,
+		Detail:         fmt.Sprintf("floor %d -> %d GB/s", oldFloor, handle.BandwidthFloor),
+		Before:         map[string]interface{}{"bandwidth_floor_GBs": oldFloor},
+		After:          map[string]interface{}{"bandwidth_floor_GBs": handle.BandwidthFloor},
+	})
+	return nil
+}
+
+// setBandwidthFloor admits and applies a new floor; callers must hold s.mutex
+func (s *FFMService) setBandwidthFloor(handle *FFMHandle, floor uint64) error {
+	oldFloor := handle.BandwidthFloor
+	if floor > oldFloor {
+		if err := s.admit(handle.LatencyClass, 0, floor, handle.ID); err != nil {
+			return err
+		}
+		if handle.MigratingTo != "" {
+			if err := s.admit(handle.MigratingTo, 0, floor, handle.ID); err != nil {
+				return err
+			}
+		}
+		if err := s.admitQuota(handle.SecurityDomain, handle.LatencyClass, handle.Bytes, floor, handle.ID); err != nil {
+			return err
+		}
+	}
+	handle.BandwidthFloor = floor
+	if err := s.persist(handle); err != nil {
+		handle.BandwidthFloor = oldFloor
+		return fmt.Errorf("persist bandwidth change: %v", err)
+	}
+	s.arbitrateLocked()
+	if _, err := s.sampleLocked(handle, time.Now()); err != nil {
+		log.Printf("Telemetry sample of %s failed: %v", handle.ID, err)
+	}
 
 	// Update metrics
-	s.metrics.BandwidthTotal.Add(float64(req.FloorGBs - oldFloor))
+	s.metrics.BandwidthTotal.Add(float64(floor) - float64(oldFloor))
 
 	return nil
 }
 
-// AdjustLatencyClass migrates allocation to different tier
-func (s *FFMService) AdjustLatencyClass(id string, req LatencyClassAdjustRequest) error {
+// AdjustLatencyClass starts migrating an allocation to a different tier
+func (s *FFMService) AdjustLatencyClass(id string, req LatencyClassAdjustRequest) (*Migration, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	handle, exists := s.allocations[id]
 	if !exists {
-		return fmt.Errorf("allocation %s not found", id)
+		return nil, notFound("allocation %s not found", id)
+	}
+	if err := requireActive(handle); err != nil {
+		return nil, err
+	}
+	if req.Target == handle.LatencyClass {
+		return nil, invalidField("target", "allocation %s is already on tier %s", id, req.Target)
 	}
 
-	// Simulate migration
-	handle.LatencyClass = req.Target
-	handle.MovedPages += 1000000 // Simulate page migration
-	s.metrics.MigrationCount.Add(1000000)
-
-	return nil
+	m, err := s.startMigration(handle, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	c := *m
+	return &c, nil
 }
 
 // ListAllocations returns all active allocations
@@ -243,9 +452,11 @@ func (s *FFMService) ListAllocations() []*FFMHandle {
     s.mutex.RLock()
     defer s.mutex.RUnlock()
 
+    now := time.Now()
     allocations := make([]*FFMHandle, 0, len(s.allocations))
     for _, handle := range s.allocations {
-        allocations = append(allocations, handle)
+        c := *handle
+        allocations = append(allocations, withUpcomingTransitions(redactDescriptors(&c), now))
     }
 
     return allocations
@@ -258,43 +469,23 @@ func (s *FFMService) GetAllocation(id string) (*FFMHandle, error) {
 
     handle, exists := s.allocations[id]
     if !exists {
-        return nil, fmt.Errorf("allocation %s not found", id)
-    }
-    return handle, nil
-}
-
-// verifyAttestation checks attestation with attestd
-func verifyAttestation(ticket string) (bool, error) {
-    url := os.Getenv("ATTESTD_URL")
-    if url == "" {
-        url = "http://localhost:8084"
+        return nil, notFound("allocation %s not found", id)
     }
-    resp, err := http.Get(fmt.Sprintf("%s/v1/attest/%s", strings.TrimRight(url, "/"), ticket))
-    if err != nil {
-        return false, err
-    }
-    defer resp.Body.Close()
-    if resp.StatusCode != http.StatusOK {
-        return false, fmt.Errorf("HTTP %d", resp.StatusCode)
-    }
-    var result struct { Valid bool `json:"valid"` }
-    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-        return false, err
-    }
-    return result.Valid, nil
+    c := *handle
+    return withUpcomingTransitions(redactDescriptors(&c), time.Now()), nil
 }
 
 // HTTP handlers
 func (s *FFMService) handleAllocate(w http.ResponseWriter, r *http.Request) {
 	var req AllocationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
 		return
 	}
 
     handle, err := s.Allocate(req)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        writeError(w, err)
         return
     }
 
@@ -309,7 +500,7 @@ func (s *FFMService) handleGetTelemetry(w http.ResponseWriter, r *http.Request)
 
 	telemetry, err := s.GetTelemetry(id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 
@@ -322,13 +513,13 @@ func (s *FFMService) handleAdjustBandwidth(w http.ResponseWriter, r *http.Reques
 	id := vars["id"]
 
 	var req BandwidthAdjustRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
 		return
 	}
 
 	if err := s.AdjustBandwidth(id, req); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 
@@ -340,17 +531,20 @@ func (s *FFMService) handleAdjustLatencyClass(w http.ResponseWriter, r *http.Req
 	id := vars["id"]
 
 	var req LatencyClassAdjustRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	if err := s.AdjustLatencyClass(id, req); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	migration, err := s.AdjustLatencyClass(id, req)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(migration)
 }
 
 func (s *FFMService) handleListAllocations(w http.ResponseWriter, r *http.Request) {
@@ -366,7 +560,7 @@ func (s *FFMService) handleGetAllocation(w http.ResponseWriter, r *http.Request)
 
     handle, err := s.GetAllocation(id)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
+        writeError(w, err)
         return
     }
 
@@ -378,6 +572,145 @@ func main() {
 	// Create FFM service
 	service := NewFFMService()
 
+	// Load tier inventory and declared bundles from ffm_policy.yaml when
+	// configured; bundles are reconciled once allocation state is recovered
+	policyPath := os.Getenv("MEMQOSD_POLICY")
+	if policyPath != "" {
+		policy, err := loadPolicy(policyPath)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		if err := service.ApplyPolicy(policy); err != nil {
+			log.Fatalf("Invalid policy %s: %v", policyPath, err)
+		}
+		service.policyPath = policyPath
+		log.Printf("Loaded tier inventory from %s", policyPath)
+	}
+
+	// Recover durable allocation state
+	stateDir := os.Getenv("MEMQOSD_STATE_DIR")
+	if stateDir == "" {
+		stateDir = "/var/lib/memqosd"
+	}
+	// Back handles with memfds or files placed by persistence, unless
+	// MEMQOSD_BACKING=none keeps them purely accounted
+	if os.Getenv("MEMQOSD_BACKING") != "none" {
+		config := defaultRegionConfig(stateDir)
+		if v := os.Getenv("MEMQOSD_TMPFS_DIR"); v != "" {
+			config.TmpfsDir = v
+		}
+		if v := os.Getenv("MEMQOSD_DAX_DIR"); v != "" {
+			config.DAXDir = v
+		}
+		backend, err := NewMemoryBackend(config)
+		if err != nil {
+			log.Fatalf("Failed to set up region backend: %v", err)
+		}
+		service.SetRegionBackend(backend)
+		log.Printf("Region backend: %s", backend.Name())
+
+		// Bind regions to the NUMA nodes of their tier. MEMQOSD_SYSFS_ROOT
+		// points discovery at a fake sysfs tree; MEMQOSD_NUMA_TIERS pins
+		// nodes to tiers, e.g. "2=T0,3=T3"
+		sysfsRoot := os.Getenv("MEMQOSD_SYSFS_ROOT")
+		if sysfsRoot == "" {
+			sysfsRoot = "/sys"
+		}
+		overrides, err := parseNUMAOverrides(os.Getenv("MEMQOSD_NUMA_TIERS"))
+		if err != nil {
+			log.Fatalf("Invalid MEMQOSD_NUMA_TIERS: %v", err)
+		}
+		if topo, err := DiscoverTopology(sysfsRoot, overrides); err != nil {
+			log.Printf("NUMA placement disabled: %v", err)
+		} else {
+			service.SetTopology(topo)
+			log.Printf("NUMA topology: %d nodes, tiers %v", len(topo.Nodes), topo.Tiers)
+		}
+	}
+
+	if err := service.OpenStore(stateDir); err != nil {
+		log.Fatalf("Failed to open allocation store in %s: %v", stateDir, err)
+	}
+	stopCheckpoints := make(chan struct{})
+	go service.runCheckpoints(5*time.Minute, stopCheckpoints)
+
+	// Checkpoint write-back handles in the background
+	flushInterval := defaultFlushInterval
+	if v := os.Getenv("MEMQOSD_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid MEMQOSD_FLUSH_INTERVAL %q", v)
+		}
+		flushInterval = d
+	}
+	stopFlusher := make(chan struct{})
+	flusherDone := make(chan struct{})
+	go service.runFlusher(flushInterval, stopFlusher, flusherDone)
+
+	// Hand region fds to local clients over SCM_RIGHTS
+	stopFDs := make(chan struct{})
+	if service.backend != nil {
+		fdSocket := os.Getenv("MEMQOSD_FD_SOCKET")
+		if fdSocket == "" {
+			fdSocket = filepath.Join(stateDir, "ffm.sock")
+		}
+		if err := service.ServeFDs(fdSocket, stopFDs); err != nil {
+			log.Printf("fd socket disabled: %v", err)
+		} else {
+			log.Printf("Serving region fds on %s", fdSocket)
+		}
+	}
+
+	// Reconcile declared bundles now and whenever SIGHUP asks for a reload
+	if policyPath != "" {
+		service.Reconcile()
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := service.ReloadPolicy(); err != nil {
+					log.Printf("Policy reload failed, keeping previous policy: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Expire allocations whose lease lapsed beyond the grace period
+	leaseGrace := 30 * time.Second
+	if v := os.Getenv("MEMQOSD_LEASE_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid MEMQOSD_LEASE_GRACE %q: %v", v, err)
+		}
+		leaseGrace = d
+	}
+	stopReaper := make(chan struct{})
+	go service.runLeaseReaper(10*time.Second, leaseGrace, stopReaper)
+
+	// Sample telemetry from the simulator or a recorded trace
+	source, err := telemetrySourceFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up telemetry: %v", err)
+	}
+	service.SetTelemetrySource(source)
+	log.Printf("Telemetry source: %s", source.Name())
+	// Evaluate bandwidth and tail latency SLOs on every telemetry sample
+	sloWindow := defaultSLOWindow
+	if v := os.Getenv("MEMQOSD_SLO_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid MEMQOSD_SLO_WINDOW %q: %v", v, err)
+		}
+		sloWindow = d
+	}
+	service.ConfigureSLO(sloWindow, os.Getenv("MEMQOSD_SLO_REMEDIATE") == "true")
+	stopTelemetry := make(chan struct{})
+	go service.runTelemetry(5*time.Second, stopTelemetry)
+
+	// Apply time-of-day bandwidth schedules at window boundaries
+	stopScheduler := make(chan struct{})
+	go service.runScheduler(30*time.Second, stopScheduler)
+
 	// Set up HTTP router
 	router := mux.NewRouter()
 	api := router.PathPrefix("/v1/ffm").Subrouter()
@@ -385,9 +718,38 @@ func main() {
 	// API endpoints
     api.HandleFunc("/alloc", service.handleAllocate).Methods("POST")
     api.HandleFunc("/{id}/telemetry", service.handleGetTelemetry).Methods("GET")
+    api.HandleFunc("/{id}/telemetry/stream", service.handleTelemetryStream).Methods("GET")
+    api.HandleFunc("/{id}/slo", service.handleGetSLO).Methods("GET")
+    api.HandleFunc("/telemetry/stream", service.handleDomainTelemetryStream).Methods("GET")
     api.HandleFunc("/{id}/bandwidth", service.handleAdjustBandwidth).Methods("PATCH")
     api.HandleFunc("/{id}/latency_class", service.handleAdjustLatencyClass).Methods("PATCH")
+    api.HandleFunc("/{id}/renew", service.handleRenewLease).Methods("POST")
+    api.HandleFunc("/{id}/sync", service.handleSync).Methods("POST")
+    api.HandleFunc("/{id}/snapshot", service.handleCreateSnapshot).Methods("POST")
+    api.HandleFunc("/{id}/attach", service.handleAttach).Methods("POST")
+    api.HandleFunc("/{id}/detach", service.handleDetach).Methods("POST")
+    api.HandleFunc("/{id}/migrations/{mid}", service.handleGetMigration).Methods("GET")
+    api.HandleFunc("/{id}/migrations/{mid}/cancel", service.handleCancelMigration).Methods("POST")
+    api.HandleFunc("/events", service.handleListEvents).Methods("GET")
+    api.HandleFunc("/webhooks", service.handleListWebhooks).Methods("GET")
+    api.HandleFunc("/webhooks", service.handleCreateWebhook).Methods("POST")
+    api.HandleFunc("/webhooks/{wid}", service.handleGetWebhook).Methods("GET")
+    api.HandleFunc("/webhooks/{wid}", service.handleDeleteWebhook).Methods("DELETE")
+    api.HandleFunc("/webhooks/{wid}/deadletters", service.handleListDeadLetters).Methods("GET")
+    api.HandleFunc("/webhooks/{wid}/deadletters/redeliver", service.handleRedeliver).Methods("POST")
+    api.HandleFunc("/capacity", service.handleCapacity).Methods("GET")
+    api.HandleFunc("/arbitration", service.handleArbitration).Methods("GET")
+    api.HandleFunc("/plan", service.handlePlan).Methods("GET")
+    api.HandleFunc("/topology", service.handleTopology).Methods("GET")
+    api.HandleFunc("/snapshots", service.handleListSnapshots).Methods("GET")
+    api.HandleFunc("/snapshots/{sid}", service.handleGetSnapshot).Methods("GET")
+    api.HandleFunc("/snapshots/{sid}", service.handleDeleteSnapshot).Methods("DELETE")
+    api.HandleFunc("/quotas", service.handleListQuotas).Methods("GET")
+    api.HandleFunc("/quotas/{domain}", service.handleGetQuota).Methods("GET")
+    api.HandleFunc("/quotas/{domain}", service.handleSetQuota).Methods("PUT")
+    api.HandleFunc("/quotas/{domain}", service.handleDeleteQuota).Methods("DELETE")
     api.HandleFunc("/{id}", service.handleGetAllocation).Methods("GET")
+    api.HandleFunc("/{id}", service.handleRelease).Methods("DELETE")
     api.HandleFunc("/", service.handleListAllocations).Methods("GET")
 
 	// Metrics endpoint
@@ -404,19 +766,40 @@ func main() {
 		Addr:    ":8081",
 		Handler: router,
 	}
+	// Streams never go idle on their own; end them so Shutdown can finish
+	server.RegisterOnShutdown(service.CloseStreams)
 
 	// Graceful shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		<-c
 		log.Println("Shutting down FFM service...")
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		server.Shutdown(ctx)
+		close(stopScheduler)
+		close(stopTelemetry)
+		close(stopFDs)
+		close(stopReaper)
+		close(stopCheckpoints)
+		// Final write-back flush before the store closes
+		close(stopFlusher)
+		<-flusherDone
+		if err := service.checkpoint(); err != nil {
+			log.Printf("Final snapshot failed: %v", err)
+		}
+		service.webhooks.Close()
+		service.store.Close()
+		service.journal.Close()
 	}()
 
 	log.Println("Starting FFM service on :8081")
-	log.Fatal(server.ListenAndServe())
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	pageSize = 4096
+
+	// migrationTick is how often a migration worker advances
+	migrationTick = 100 * time.Millisecond
+
+	// minMigrationGBs keeps migrations moving on a fully committed tier
+	minMigrationGBs = 1
+
+	// maxFinishedMigrations bounds the finished migrations kept per handle
+	maxFinishedMigrations = 8
+)
+
+// Migration states
+const (
+	MigrationRunning   = "running"
+	MigrationCompleted = "completed"
+	MigrationCancelled = "cancelled"
+	MigrationFailed    = "failed"
+)
+
+// Migration tracks moving an allocation between tiers
+type Migration struct {
+	ID         string     `json:"id"`
+	HandleID   string     `json:"handle_id"`
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	TotalPages uint64     `json:"total_pages"`
+	MovedPages uint64     `json:"moved_pages"`
+	RateGBs    uint64     `json:"rate_GBs"`
+	State      string     `json:"state"`
+	ETASeconds float64    `json:"eta_s"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	cancel chan struct{}
+}
+
+// startMigration reserves the target tier and launches a worker that moves
+// the handle's pages; callers must hold s.mutex
+func (s *FFMService) startMigration(handle *FFMHandle, target string) (*Migration, error) {
+	if handle.MigrationID != "" {
+		return nil, fmt.Errorf("%w: allocation %s is already migrating (%s)", errHandleBusy, handle.ID, handle.MigrationID)
+	}
+	if err := s.admit(target, handle.Bytes, handle.BandwidthFloor, handle.ID); err != nil {
+		return nil, err
+	}
+	if err := s.admitQuota(handle.SecurityDomain, target, handle.Bytes, handle.BandwidthFloor, handle.ID); err != nil {
+		return nil, err
+	}
+
+	// Copy bandwidth left over after guaranteed floors on both tiers
+	_, srcUsed, _ := s.tierUsage(handle.LatencyClass, "")
+	_, dstUsed, _ := s.tierUsage(target, "")
+	rate := sub(s.tiers[handle.LatencyClass].BandwidthGBs, srcUsed)
+	if free := sub(s.tiers[target].BandwidthGBs, dstUsed); free < rate {
+		rate = free
+	}
+	if rate < minMigrationGBs {
+		rate = minMigrationGBs
+	}
+
+	m := &Migration{
+		ID:         fmt.Sprintf("mig-%04x", s.nextMigrationID),
+		HandleID:   handle.ID,
+		From:       handle.LatencyClass,
+		To:         target,
+		TotalPages: (handle.Bytes + pageSize - 1) / pageSize,
+		RateGBs:    rate,
+		State:      MigrationRunning,
+		StartedAt:  time.Now(),
+		cancel:     make(chan struct{}),
+	}
+	m.ETASeconds = m.eta()
+	s.nextMigrationID++
+
+	handle.MigrationID = m.ID
+	handle.MigratingTo = target
+	s.migrations[m.ID] = m
+
+	s.emitEvent(Event{
+		Type:           "migration_started",
+		HandleID:       handle.ID,
+		SecurityDomain: handle.SecurityDomain,
+		Detail:         fmt.Sprintf("%s %s->%s at %d GB/s", m.ID, m.From, m.To, m.RateGBs),
+	})
+	go s.runMigration(m)
+	return m, nil
+}
+
+// eta estimates the seconds left at the current rate
+func (m *Migration) eta() float64 {
+	remaining := float64(m.TotalPages-m.MovedPages) * pageSize
+	return remaining / (float64(m.RateGBs) * 1e9)
+}
+
+// runMigration advances a migration until it completes or is cancelled
+func (s *FFMService) runMigration(m *Migration) {
+	ticker := time.NewTicker(migrationTick)
+	defer ticker.Stop()
+
+	pagesPerTick := uint64(float64(m.RateGBs) * 1e9 * migrationTick.Seconds() / pageSize)
+	if pagesPerTick == 0 {
+		pagesPerTick = 1
+	}
+
+	for {
+		select {
+		case <-m.cancel:
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		if m.State != MigrationRunning {
+			s.mutex.Unlock()
+			return
+		}
+		handle, exists := s.allocations[m.HandleID]
+		if !exists {
+			s.finishMigration(m, nil, MigrationFailed, "allocation released")
+			s.mutex.Unlock()
+			return
+		}
+
+		step := pagesPerTick
+		if left := m.TotalPages - m.MovedPages; step > left {
+			step = left
+		}
+		m.MovedPages += step
+		m.ETASeconds = m.eta()
+		handle.MovedPages += step
+		s.metrics.MigrationCount.Add(float64(step))
+
+		if m.MovedPages >= m.TotalPages {
+			oldClass := handle.LatencyClass
+			handle.LatencyClass = m.To
+			if err := s.persist(handle); err != nil {
+				handle.LatencyClass = oldClass
+				s.finishMigration(m, handle, MigrationFailed, err.Error())
+			} else {
+				s.placeRegionLocked(handle, true)
+				s.arbitrateLocked()
+				s.finishMigration(m, handle, MigrationCompleted, "")
+			}
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// finishMigration records a terminal state and clears the handle's
+// reservation; callers must hold s.mutex
+func (s *FFMService) finishMigration(m *Migration, handle *FFMHandle, state, reason string) {
+	now := time.Now()
+	m.State = state
+	m.Error = reason
+	m.FinishedAt = &now
+	m.ETASeconds = 0
+	if handle != nil {
+		handle.MigrationID = ""
+		handle.MigratingTo = ""
+	}
+	if state != MigrationCompleted {
+		log.Printf("Migration %s of %s %s: %s", m.ID, m.HandleID, state, reason)
+	}
+	ev := Event{
+		Type:     "migration_" + state,
+		HandleID: m.HandleID,
+		Detail:   fmt.Sprintf("%s %s->%s, %d/%d pages", m.ID, m.From, m.To, m.MovedPages, m.TotalPages),
+	}
+	if handle != nil {
+		ev.SecurityDomain = handle.SecurityDomain
+	}
+	if state == MigrationCompleted {
+		ev.Before = map[string]interface{}{"latency_class": m.From}
+		ev.After = map[string]interface{}{"latency_class": m.To}
+	}
+	s.emitEvent(ev)
+	s.pruneMigrationsLocked(m.HandleID)
+}
+
+// pruneMigrationsLocked forgets all but the most recent finished migrations
+// of a handle, so one that migrates repeatedly does not grow s.migrations
+// without bound; callers must hold s.mutex
+func (s *FFMService) pruneMigrationsLocked(handleID string) {
+	var finished []*Migration
+	for _, m := range s.migrations {
+		if m.HandleID == handleID && m.State != MigrationRunning {
+			finished = append(finished, m)
+		}
+	}
+	if len(finished) <= maxFinishedMigrations {
+		return
+	}
+	// A handle migrates one at a time, so start order is finish order
+	sort.Slice(finished, func(i, j int) bool { return finished[i].StartedAt.Before(finished[j].StartedAt) })
+	for _, m := range finished[:len(finished)-maxFinishedMigrations] {
+		delete(s.migrations, m.ID)
+	}
+}
+
+// GetMigration returns a migration of an allocation
+func (s *FFMService) GetMigration(handleID, migrationID string) (*Migration, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	m, exists := s.migrations[migrationID]
+	if !exists || m.HandleID != handleID {
+		return nil, notFound("migration %s not found for allocation %s", migrationID, handleID)
+	}
+	c := *m
+	return &c, nil
+}
+
+// CancelMigration stops a running migration, leaving the handle on its
+// source tier
+func (s *FFMService) CancelMigration(handleID, migrationID string) (*Migration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, exists := s.migrations[migrationID]
+	if !exists || m.HandleID != handleID {
+		return nil, notFound("migration %s not found for allocation %s", migrationID, handleID)
+	}
+	if m.State != MigrationRunning {
+		return nil, fmt.Errorf("%w: migration %s is %s", errHandleBusy, migrationID, m.State)
+	}
+	s.cancelMigrationLocked(m, "cancelled by request")
+	c := *m
+	return &c, nil
+}
+
+// cancelMigrationLocked stops a running migration; callers must hold s.mutex
+func (s *FFMService) cancelMigrationLocked(m *Migration, reason string) {
+	close(m.cancel)
+	s.finishMigration(m, s.allocations[m.HandleID], MigrationCancelled, reason)
+}
+
+func (s *FFMService) handleGetMigration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	m, err := s.GetMigration(vars["id"], vars["mid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func (s *FFMService) handleCancelMigration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	m, err := s.CancelMigration(vars["id"], vars["mid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
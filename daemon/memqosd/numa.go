@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hbmDistance is the largest SLIT distance from a CPU node at which a
+// CPU-less node is treated as on-package HBM rather than CXL memory
+const hbmDistance = 19
+
+// Memory policy modes, as in set_mempolicy(2)
+const (
+	PolicyPreferred  = "preferred"
+	PolicyBind       = "bind"
+	PolicyInterleave = "interleave"
+)
+
+// tierFallback is where a handle is placed when its tier has no nodes
+var tierFallback = map[string]string{
+	"T0": "T1",
+	"T2": "T1",
+	"T3": "T2",
+}
+
+// NUMANode is one node found under /sys/devices/system/node
+type NUMANode struct {
+	ID       int    `json:"id"`
+	CPUs     string `json:"cpus,omitempty"` // cpulist, empty for memory-only nodes
+	MemBytes uint64 `json:"mem_bytes"`
+	Distance []int  `json:"distance"`
+	Tier     string `json:"tier"`
+}
+
+// Topology maps the host's NUMA nodes onto memory tiers
+type Topology struct {
+	SysfsRoot string            `json:"sysfs_root"`
+	Nodes     []NUMANode        `json:"nodes"`
+	Tiers     map[string][]int  `json:"tiers"` // node IDs per tier
+	Overrides map[string]string `json:"overrides,omitempty"`
+	Bytes     map[string]uint64 `json:"bytes"` // memory per tier
+}
+
+// Placement records where a handle's memory is bound
+type Placement struct {
+	Tier     string `json:"tier"` // tier whose nodes were used
+	Nodes    []int  `json:"nodes"`
+	Policy   string `json:"policy"`
+	Fallback bool   `json:"fallback,omitempty"` // tier had no nodes
+	Applied  bool   `json:"applied"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DiscoverTopology reads NUMA nodes from sysfsRoot (normally /sys) and maps
+// them to tiers: nodes with CPUs are DDR (T1), memory-only nodes close to a
+// CPU are HBM (T0) and farther memory-only nodes are CXL (T2). overrides
+// pins node IDs to tiers, e.g. {"3": "T3"} for a persistent-memory node.
+func DiscoverTopology(sysfsRoot string, overrides map[string]string) (*Topology, error) {
+	dir := filepath.Join(sysfsRoot, "devices", "system", "node")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read NUMA nodes: %v", err)
+	}
+
+	topo := &Topology{
+		SysfsRoot: sysfsRoot,
+		Tiers:     make(map[string][]int),
+		Overrides: overrides,
+		Bytes:     make(map[string]uint64),
+	}
+	for _, e := range entries {
+		id, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "node"))
+		if err != nil || !strings.HasPrefix(e.Name(), "node") {
+			continue
+		}
+		node, err := readNUMANode(filepath.Join(dir, e.Name()), id)
+		if err != nil {
+			return nil, fmt.Errorf("node%d: %v", id, err)
+		}
+		topo.Nodes = append(topo.Nodes, node)
+	}
+	if len(topo.Nodes) == 0 {
+		return nil, fmt.Errorf("no NUMA nodes under %s", dir)
+	}
+	sort.Slice(topo.Nodes, func(i, j int) bool { return topo.Nodes[i].ID < topo.Nodes[j].ID })
+
+	// Index SLIT columns by node ID; sysfs lists distances in node order
+	column := make(map[int]int, len(topo.Nodes))
+	for i, n := range topo.Nodes {
+		column[n.ID] = i
+	}
+	for i := range topo.Nodes {
+		n := &topo.Nodes[i]
+		if tier, ok := overrides[strconv.Itoa(n.ID)]; ok {
+			n.Tier = tier
+		} else if n.CPUs != "" {
+			n.Tier = "T1"
+		} else if nearest := nearestCPUDistance(n, topo.Nodes, column); nearest > 0 && nearest <= hbmDistance {
+			n.Tier = "T0"
+		} else {
+			n.Tier = "T2"
+		}
+		topo.Tiers[n.Tier] = append(topo.Tiers[n.Tier], n.ID)
+		topo.Bytes[n.Tier] += n.MemBytes
+	}
+	return topo, nil
+}
+
+// readNUMANode reads cpulist, meminfo and distance of one node directory
+func readNUMANode(dir string, id int) (NUMANode, error) {
+	node := NUMANode{ID: id}
+
+	cpus, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+	if err != nil && !os.IsNotExist(err) {
+		return node, err
+	}
+	node.CPUs = strings.TrimSpace(string(cpus))
+
+	if f, err := os.Open(filepath.Join(dir, "meminfo")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// "Node 0 MemTotal:       16384 kB"
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 4 && fields[2] == "MemTotal:" {
+				kb, err := strconv.ParseUint(fields[3], 10, 64)
+				if err == nil {
+					node.MemBytes = kb << 10
+				}
+				break
+			}
+		}
+		f.Close()
+	}
+
+	distance, err := os.ReadFile(filepath.Join(dir, "distance"))
+	if err != nil && !os.IsNotExist(err) {
+		return node, err
+	}
+	for _, field := range strings.Fields(string(distance)) {
+		d, err := strconv.Atoi(field)
+		if err != nil {
+			return node, fmt.Errorf("invalid distance %q", field)
+		}
+		node.Distance = append(node.Distance, d)
+	}
+	return node, nil
+}
+
+// nearestCPUDistance returns the SLIT distance from n to the closest node
+// with CPUs, or 0 if unknown
+func nearestCPUDistance(n *NUMANode, nodes []NUMANode, column map[int]int) int {
+	nearest := 0
+	for _, other := range nodes {
+		if other.CPUs == "" {
+			continue
+		}
+		c := column[other.ID]
+		if c >= len(n.Distance) {
+			continue
+		}
+		if d := n.Distance[c]; nearest == 0 || d < nearest {
+			nearest = d
+		}
+	}
+	return nearest
+}
+
+// parseNUMAOverrides parses "node=tier" pairs such as "2=T0,3=T3"
+func parseNUMAOverrides(s string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		node, tier, ok := strings.Cut(pair, "=")
+		if _, err := strconv.Atoi(node); !ok || err != nil {
+			return nil, fmt.Errorf("invalid NUMA override %q (want node=tier)", pair)
+		}
+		if _, known := defaultTiers()[tier]; !known {
+			return nil, fmt.Errorf("invalid NUMA override %q: unknown tier %q", pair, tier)
+		}
+		overrides[node] = tier
+	}
+	return overrides, nil
+}
+
+// place chooses nodes and a memory policy for tier. A tier with several
+// nodes is interleaved across them for bandwidth; a single node is bound.
+// Tiers without nodes fall back to the nearest populated tier with a
+// preferred policy so the kernel may still spill elsewhere.
+func (t *Topology) place(tier string) (Placement, bool) {
+	for target, fallback := tier, false; target != ""; target, fallback = tierFallback[target], true {
+		nodes := t.Tiers[target]
+		if len(nodes) == 0 {
+			continue
+		}
+		p := Placement{Tier: target, Nodes: append([]int(nil), nodes...), Fallback: fallback}
+		switch {
+		case fallback:
+			p.Policy = PolicyPreferred
+			p.Nodes = p.Nodes[:1]
+		case len(nodes) > 1:
+			p.Policy = PolicyInterleave
+		default:
+			p.Policy = PolicyBind
+		}
+		return p, true
+	}
+	return Placement{}, false
+}
+
+// SetTopology installs the discovered NUMA topology used for placement
+func (s *FFMService) SetTopology(topo *Topology) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.topology = topo
+}
+
+// placeRegionLocked binds a handle's region to the nodes of its tier and
+// records the result on the handle. move migrates pages already faulted in,
+// as after a tier change. Callers must hold s.mutex.
+func (s *FFMService) placeRegionLocked(handle *FFMHandle, move bool) {
+	region, ok := s.regions[handle.ID]
+	if s.topology == nil || !ok {
+		return
+	}
+	p, ok := s.topology.place(handle.LatencyClass)
+	if !ok {
+		handle.Placement = nil
+		return
+	}
+	if err := bindRegion(region, p, move); err != nil {
+		p.Error = err.Error()
+		log.Printf("Placement of %s on nodes %v failed: %v", handle.ID, p.Nodes, err)
+	} else {
+		p.Applied = true
+	}
+	handle.Placement = &p
+}
+
+func (s *FFMService) handleTopology(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	topo := s.topology
+	s.mutex.RUnlock()
+	if topo == nil {
+		writeError(w, notFound("NUMA topology not discovered"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topo)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Memory policy modes and mbind flags from <linux/mempolicy.h>
+const (
+	mpolPreferred  = 1
+	mpolBind       = 2
+	mpolInterleave = 3
+
+	mpolMFMove = 1 << 1
+)
+
+var mempolicyModes = map[string]uintptr{
+	PolicyPreferred:  mpolPreferred,
+	PolicyBind:       mpolBind,
+	PolicyInterleave: mpolInterleave,
+}
+
+// bindRegion sets the NUMA policy of a region's pages. The region is mapped
+// shared so the policy attaches to the shared memory object itself and applies
+// to every process that maps the fd; move migrates pages already resident.
+func bindRegion(region *Region, p Placement, move bool) error {
+	mode, ok := mempolicyModes[p.Policy]
+	if !ok {
+		return fmt.Errorf("unknown memory policy %q", p.Policy)
+	}
+	if region.Size == 0 {
+		return nil
+	}
+	if region.mapping == nil {
+		mapping, err := unix.Mmap(int(region.file.Fd()), 0, int(region.Size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("map region: %v", err)
+		}
+		region.mapping = mapping
+	}
+
+	maxNode := 0
+	for _, n := range p.Nodes {
+		if n > maxNode {
+			maxNode = n
+		}
+	}
+	mask := make([]uint64, maxNode/64+1)
+	for _, n := range p.Nodes {
+		mask[n/64] |= 1 << (n % 64)
+	}
+	flags := uintptr(0)
+	if move {
+		flags = mpolMFMove
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_MBIND,
+		uintptr(unsafe.Pointer(&region.mapping[0])), uintptr(len(region.mapping)),
+		mode, uintptr(unsafe.Pointer(&mask[0])), uintptr(len(mask)*64+1), flags)
+	if errno != 0 {
+		return fmt.Errorf("mbind: %v", errno)
+	}
+	return nil
+}
+
+// unbindRegion drops the mapping used to hold a region's policy
+func unbindRegion(region *Region) error {
+	if region.mapping == nil {
+		return nil
+	}
+	err := unix.Munmap(region.mapping)
+	region.mapping = nil
+	return err
+}
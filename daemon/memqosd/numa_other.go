@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// bindRegion is unsupported without Linux memory policies
+func bindRegion(region *Region, p Placement, move bool) error {
+	return errors.New("NUMA placement requires Linux")
+}
+
+func unbindRegion(region *Region) error {
+	return nil
+}
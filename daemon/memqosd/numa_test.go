@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const gib = 1 << 30
+
+func TestDiscoverTopology(t *testing.T) {
+	tests := []struct {
+		name      string
+		root      string
+		overrides map[string]string
+		tiers     map[string][]int
+		bytes     map[string]uint64
+		placement map[string]Placement
+	}{
+		{
+			name: "two sockets with HBM and CXL",
+			root: "two-socket-cxl",
+			tiers: map[string][]int{
+				"T0": {2},
+				"T1": {0, 1},
+				"T2": {3, 4},
+			},
+			bytes: map[string]uint64{"T0": 16 * gib, "T1": 64 * gib, "T2": 128 * gib},
+			placement: map[string]Placement{
+				"T0": {Tier: "T0", Nodes: []int{2}, Policy: PolicyBind},
+				"T1": {Tier: "T1", Nodes: []int{0, 1}, Policy: PolicyInterleave},
+				"T2": {Tier: "T2", Nodes: []int{3, 4}, Policy: PolicyInterleave},
+				"T3": {Tier: "T2", Nodes: []int{3}, Policy: PolicyPreferred, Fallback: true},
+			},
+		},
+		{
+			name: "one socket with a CXL expander",
+			root: "one-socket-cxl",
+			tiers: map[string][]int{
+				"T1": {0},
+				"T2": {1},
+			},
+			bytes: map[string]uint64{"T1": 16 * gib, "T2": 32 * gib},
+			placement: map[string]Placement{
+				"T0": {Tier: "T1", Nodes: []int{0}, Policy: PolicyPreferred, Fallback: true},
+				"T1": {Tier: "T1", Nodes: []int{0}, Policy: PolicyBind},
+				"T2": {Tier: "T2", Nodes: []int{1}, Policy: PolicyBind},
+				"T3": {Tier: "T2", Nodes: []int{1}, Policy: PolicyPreferred, Fallback: true},
+			},
+		},
+		{
+			name:      "CXL expander overridden to persistent memory",
+			root:      "one-socket-cxl",
+			overrides: map[string]string{"1": "T3"},
+			tiers: map[string][]int{
+				"T1": {0},
+				"T3": {1},
+			},
+			bytes: map[string]uint64{"T1": 16 * gib, "T3": 32 * gib},
+			placement: map[string]Placement{
+				"T0": {Tier: "T1", Nodes: []int{0}, Policy: PolicyPreferred, Fallback: true},
+				"T1": {Tier: "T1", Nodes: []int{0}, Policy: PolicyBind},
+				"T2": {Tier: "T1", Nodes: []int{0}, Policy: PolicyPreferred, Fallback: true},
+				"T3": {Tier: "T3", Nodes: []int{1}, Policy: PolicyBind},
+			},
+		},
+		{
+			name:  "no CXL memory",
+			root:  "cpu-only",
+			tiers: map[string][]int{"T1": {0}},
+			bytes: map[string]uint64{"T1": 8 * gib},
+			placement: map[string]Placement{
+				"T0": {Tier: "T1", Nodes: []int{0}, Policy: PolicyPreferred, Fallback: true},
+				"T1": {Tier: "T1", Nodes: []int{0}, Policy: PolicyBind},
+				"T2": {Tier: "T1", Nodes: []int{0}, Policy: PolicyPreferred, Fallback: true},
+				"T3": {Tier: "T1", Nodes: []int{0}, Policy: PolicyPreferred, Fallback: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topo, err := DiscoverTopology(filepath.Join("testdata", "sysfs", tt.root), tt.overrides)
+			if err != nil {
+				t.Fatalf("DiscoverTopology: %v", err)
+			}
+			if !reflect.DeepEqual(topo.Tiers, tt.tiers) {
+				t.Errorf("tiers = %v, want %v", topo.Tiers, tt.tiers)
+			}
+			if !reflect.DeepEqual(topo.Bytes, tt.bytes) {
+				t.Errorf("bytes = %v, want %v", topo.Bytes, tt.bytes)
+			}
+			for _, n := range topo.Nodes {
+				if n.CPUs == "" && n.Tier == "T1" {
+					t.Errorf("memory-only node%d mapped to DDR", n.ID)
+				}
+			}
+			for tier, want := range tt.placement {
+				got, ok := topo.place(tier)
+				if !ok {
+					t.Errorf("place(%s): no nodes", tier)
+					continue
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("place(%s) = %+v, want %+v", tier, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoverTopologyMissingRoot(t *testing.T) {
+	if _, err := DiscoverTopology(filepath.Join("testdata", "sysfs", "missing"), nil); err == nil {
+		t.Fatal("DiscoverTopology of a missing tree succeeded")
+	}
+}
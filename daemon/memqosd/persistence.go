@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Persistence levels
+const (
+	// PersistenceNone handles are anonymous memory, empty after a restart
+	PersistenceNone = "none"
+	// PersistenceWriteBack handles work on tmpfs and are checkpointed in the
+	// background and on sync
+	PersistenceWriteBack = "write-back"
+	// PersistenceWriteThrough handles live on persistent storage and are
+	// flushed on sync
+	PersistenceWriteThrough = "write-through"
+	// PersistenceDurable handles live on persistent storage, normally a DAX
+	// mount, and are flushed on sync
+	PersistenceDurable = "durable"
+)
+
+// defaultFlushInterval is how often write-back handles are checkpointed
+const defaultFlushInterval = 30 * time.Second
+
+// validatePersistence rejects unknown persistence levels; empty means none
+func validatePersistence(p string) error {
+	switch p {
+	case "", PersistenceNone, PersistenceWriteBack, PersistenceWriteThrough, PersistenceDurable:
+		return nil
+	}
+	return invalidField("persistence", "unknown persistence %q (want none, write-back, write-through or durable)", p)
+}
+
+// SyncResult reports a completed sync of a handle
+type SyncResult struct {
+	HandleID    string    `json:"handle_id"`
+	Persistence string    `json:"persistence"`
+	Method      string    `json:"method"` // checkpoint or fsync
+	SyncedAt    time.Time `json:"synced_at"`
+	DurationMs  float64   `json:"duration_ms"`
+}
+
+// Sync makes a handle's contents durable. The copy or fsync runs without
+// the service mutex so a large checkpoint does not stall other requests.
+func (s *FFMService) Sync(id string) (*SyncResult, error) {
+	s.mutex.RLock()
+	handle, exists := s.allocations[id]
+	if !exists {
+		s.mutex.RUnlock()
+		return nil, notFound("allocation %s not found", id)
+	}
+	h := *handle
+	region, hasRegion := s.regions[id]
+	backend := s.backend
+	s.mutex.RUnlock()
+
+	if h.Persistence == "" || h.Persistence == PersistenceNone {
+		return nil, invalidField("persistence", "allocation %s has no persistence", id)
+	}
+	if !hasRegion {
+		return nil, fmt.Errorf("%w: allocation %s has no backing region", errInvalidRequest, id)
+	}
+
+	start := time.Now()
+	if err := backend.Sync(&h, region); err != nil {
+		return nil, err
+	}
+	result := &SyncResult{
+		HandleID:    id,
+		Persistence: h.Persistence,
+		Method:      "fsync",
+		SyncedAt:    time.Now(),
+		DurationMs:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if h.Persistence == PersistenceWriteBack {
+		result.Method = "checkpoint"
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if handle, exists := s.allocations[id]; exists {
+		synced := result.SyncedAt
+		handle.LastSyncedAt = &synced
+		if err := s.persist(handle); err != nil {
+			log.Printf("Recording sync of %s failed: %v", id, err)
+		}
+	}
+	return result, nil
+}
+
+// flushWriteBack checkpoints every write-back handle
+func (s *FFMService) flushWriteBack() {
+	s.mutex.RLock()
+	var ids []string
+	for id, handle := range s.allocations {
+		if handle.Persistence == PersistenceWriteBack && handle.State == StateActive {
+			ids = append(ids, id)
+		}
+	}
+	s.mutex.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if _, err := s.Sync(id); err != nil {
+			log.Printf("Write-back flush of %s failed: %v", id, err)
+		}
+	}
+}
+
+// runFlusher checkpoints write-back handles every interval and once more
+// when stopped
+func (s *FFMService) runFlusher(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			s.flushWriteBack()
+			return
+		case <-ticker.C:
+			s.flushWriteBack()
+		}
+	}
+}
+
+func (s *FFMService) handleSync(w http.ResponseWriter, r *http.Request) {
+	result, err := s.Sync(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
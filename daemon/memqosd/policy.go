@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FFMPolicy mirrors the layout of ffm_policy.yaml
+type FFMPolicy struct {
+	Tiers     map[string]TierSpec `yaml:"tiers"`
+	Bundles   []BundleSpec        `yaml:"bundles"`
+	Reconcile ReconcileSpec       `yaml:"reconcile"`
+}
+
+// BundleSpec declares a named allocation memqosd keeps in place
+type BundleSpec struct {
+	Name              string                  `yaml:"name"`
+	Bytes             string                  `yaml:"bytes"`
+	LatencyClass      string                  `yaml:"latency_class"`
+	BandwidthFloorGBs uint64                  `yaml:"bandwidth_floor_GBs"`
+	Persistence       string                  `yaml:"persistence"`
+	Shareable         bool                    `yaml:"shareable"`
+	SecurityDomain    string                  `yaml:"security_domain"`
+	Schedule          map[string]ScheduleSpec `yaml:"schedule"`
+}
+
+// ScheduleSpec is one named window of a bundle's schedule
+type ScheduleSpec struct {
+	FloorGBs uint64 `yaml:"floor_GBs"`
+	Start    string `yaml:"start"`
+	End      string `yaml:"end"`
+}
+
+// ReconcileSpec controls how declared bundles are reconciled
+type ReconcileSpec struct {
+	// Prune releases policy-managed handles whose bundle is no longer declared
+	Prune bool `yaml:"prune"`
+}
+
+// TierSpec describes one memory tier in ffm_policy.yaml
+type TierSpec struct {
+	Desc         string `yaml:"desc"`
+	Bytes        string `yaml:"bytes"`
+	BandwidthGBs uint64 `yaml:"bandwidth_GBs"`
+	GBpsHint     uint64 `yaml:"gbps_hint"`
+}
+
+// loadPolicy reads and parses an ffm_policy.yaml file
+func loadPolicy(path string) (*FFMPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %v", err)
+	}
+	var policy FFMPolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %v", path, err)
+	}
+	return &policy, nil
+}
+
+// tierCapacities converts the policy's tiers into a capacity inventory.
+// Tiers the policy omits keep their built-in defaults.
+func (p *FFMPolicy) tierCapacities() (map[string]*TierCapacity, error) {
+	tiers := defaultTiers()
+	for name, spec := range p.Tiers {
+		tier, ok := tiers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tier %q (expected T0..T3)", name)
+		}
+		if spec.Desc != "" {
+			tier.Desc = spec.Desc
+		}
+		if spec.Bytes != "" {
+			n, err := parseByteSize(spec.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("tier %s: %v", name, err)
+			}
+			tier.Bytes = n
+		}
+		switch {
+		case spec.BandwidthGBs > 0:
+			tier.BandwidthGBs = spec.BandwidthGBs
+		case spec.GBpsHint > 0:
+			tier.BandwidthGBs = spec.GBpsHint
+		}
+	}
+	return tiers, nil
+}
+
+// bundleRequests converts declared bundles into allocation requests keyed by
+// bundle name
+func (p *FFMPolicy) bundleRequests() (map[string]AllocationRequest, error) {
+	requests := make(map[string]AllocationRequest, len(p.Bundles))
+	for _, b := range p.Bundles {
+		if b.Name == "" {
+			return nil, fmt.Errorf("bundle name is required")
+		}
+		if _, dup := requests[b.Name]; dup {
+			return nil, fmt.Errorf("duplicate bundle %q", b.Name)
+		}
+		bytes, err := parseByteSize(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("bundle %s: %v", b.Name, err)
+		}
+
+		names := make([]string, 0, len(b.Schedule))
+		for name := range b.Schedule {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var windows []ScheduleWindow
+		for _, name := range names {
+			w := b.Schedule[name]
+			windows = append(windows, ScheduleWindow{Name: name, Start: w.Start, End: w.End, FloorGBs: w.FloorGBs})
+		}
+		if windows, err = normalizeSchedule(windows); err != nil {
+			return nil, fmt.Errorf("bundle %s: %v", b.Name, err)
+		}
+
+		requests[b.Name] = AllocationRequest{
+			Bytes:          bytes,
+			LatencyClass:   b.LatencyClass,
+			BandwidthFloor: b.BandwidthFloorGBs,
+			Persistence:    b.Persistence,
+			Shareable:      b.Shareable,
+			SecurityDomain: b.SecurityDomain,
+			Schedule:       windows,
+			Bundle:         b.Name,
+		}
+	}
+	return requests, nil
+}
+
+// parseByteSize parses sizes such as "256GiB", "1TB" or "4096"
+func parseByteSize(s string) (uint64, error) {
+	str := strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		mult   uint64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"PiB", 1 << 50},
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40}, {"PB", 1 << 50},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}, {"P", 1 << 50},
+		{"B", 1},
+	}
+	mult := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > ^uint64(0)/mult {
+		return 0, fmt.Errorf("size %q overflows", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+// Priority classes of FFM handles, highest first
+const (
+	PriorityGold   = "gold"
+	PrioritySilver = "silver"
+	PriorityBronze = "bronze"
+)
+
+// priorityRank orders priority classes; higher ranks are served first
+var priorityRank = map[string]int{
+	PriorityGold:   3,
+	PrioritySilver: 2,
+	PriorityBronze: 1,
+}
+
+// normalizePriority defaults an empty priority class to silver and rejects
+// unknown ones
+func normalizePriority(p string) (string, error) {
+	if p == "" {
+		return PrioritySilver, nil
+	}
+	if _, ok := priorityRank[p]; !ok {
+		return "", invalidField("priority", "unknown priority %q (expected gold, silver or bronze)", p)
+	}
+	return p, nil
+}
+
+// rank returns the handle's priority rank; handles recorded before priority
+// classes existed count as silver
+func (h *FFMHandle) rank() int {
+	if r, ok := priorityRank[h.Priority]; ok {
+		return r
+	}
+	return priorityRank[PrioritySilver]
+}
+
+// priorityWeight is each class's weight in bandwidth arbitration
+var priorityWeight = map[string]float64{
+	PriorityGold:   4,
+	PrioritySilver: 2,
+	PriorityBronze: 1,
+}
+
+// weight returns the handle's arbitration weight; handles recorded before
+// priority classes existed count as silver
+func (h *FFMHandle) weight() float64 {
+	if w, ok := priorityWeight[h.Priority]; ok {
+		return w
+	}
+	return priorityWeight[PrioritySilver]
+}
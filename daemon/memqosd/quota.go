@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// quotaFile holds quotas next to the allocation WAL
+const quotaFile = "quotas.json"
+
+// Quota limits what one security domain may allocate. Zero limits and
+// tiers missing from MaxBytes are unlimited.
+type Quota struct {
+	SecurityDomain  string            `json:"security_domain"`
+	MaxBytes        map[string]uint64 `json:"max_bytes,omitempty"` // per tier
+	MaxBandwidthGBs uint64            `json:"max_bandwidth_GBs,omitempty"`
+	MaxHandles      int               `json:"max_handles,omitempty"`
+}
+
+// QuotaUsage reports a domain's usage against its quota
+type QuotaUsage struct {
+	SecurityDomain string            `json:"security_domain"`
+	Quota          *Quota            `json:"quota,omitempty"`
+	Bytes          map[string]uint64 `json:"bytes"` // per tier
+	BandwidthGBs   uint64            `json:"bandwidth_GBs"`
+	Handles        int               `json:"handles"`
+}
+
+// QuotaError reports an allocation that would exceed a domain's quota
+type QuotaError struct {
+	SecurityDomain string `json:"security_domain"`
+	Resource       string `json:"resource"` // bytes, bandwidth, handles
+	Tier           string `json:"tier,omitempty"`
+	Requested      uint64 `json:"requested"`
+	Available      uint64 `json:"available"`
+	Limit          uint64 `json:"limit"`
+}
+
+func (e *QuotaError) Error() string {
+	resource := e.Resource
+	if e.Tier != "" {
+		resource = fmt.Sprintf("%s on tier %s", e.Resource, e.Tier)
+	}
+	return fmt.Sprintf("quota exceeded for security domain %q: %s requested %d, available %d of %d",
+		e.SecurityDomain, resource, e.Requested, e.Available, e.Limit)
+}
+
+// domainUsage sums what a domain holds, counting handles migrating onto a
+// tier against that tier as well, skipping the handle excludeID; callers
+// must hold s.mutex
+func (s *FFMService) domainUsage(domain, excludeID string) QuotaUsage {
+	usage := QuotaUsage{SecurityDomain: domain, Bytes: make(map[string]uint64)}
+	for id, h := range s.allocations {
+		if h.SecurityDomain != domain || id == excludeID {
+			continue
+		}
+		usage.Bytes[h.LatencyClass] += h.Bytes
+		if h.MigratingTo != "" {
+			usage.Bytes[h.MigratingTo] += h.Bytes
+		}
+		usage.BandwidthGBs += h.BandwidthFloor
+		usage.Handles++
+	}
+	return usage
+}
+
+// admitQuota checks that a handle holding bytes on tier with the given
+// bandwidth floor (in place of the handle excludeID, if any) fits the
+// domain's quota. The handle count only limits new handles. Callers must
+// hold s.mutex.
+func (s *FFMService) admitQuota(domain, tier string, bytes, bandwidth uint64, excludeID string) error {
+	quota, ok := s.quotas[domain]
+	if !ok {
+		return nil
+	}
+	usage := s.domainUsage(domain, excludeID)
+
+	if limit := quota.MaxBytes[tier]; limit > 0 {
+		if free := sub(limit, usage.Bytes[tier]); bytes > free {
+			return &QuotaError{SecurityDomain: domain, Resource: "bytes", Tier: tier, Requested: bytes, Available: free, Limit: limit}
+		}
+	}
+	if limit := quota.MaxBandwidthGBs; limit > 0 {
+		if free := sub(limit, usage.BandwidthGBs); bandwidth > free {
+			return &QuotaError{SecurityDomain: domain, Resource: "bandwidth", Requested: bandwidth, Available: free, Limit: limit}
+		}
+	}
+	if limit := quota.MaxHandles; limit > 0 && excludeID == "" && usage.Handles >= limit {
+		return &QuotaError{SecurityDomain: domain, Resource: "handles", Requested: 1, Available: 0, Limit: uint64(limit)}
+	}
+	return nil
+}
+
+// SetQuota creates or replaces the quota of a security domain. Lowering a
+// quota below current usage is allowed; it only blocks further growth.
+func (s *FFMService) SetQuota(q Quota) (*QuotaUsage, error) {
+	if q.SecurityDomain == "" {
+		return nil, invalidField("security_domain", "security_domain is required")
+	}
+	if q.MaxHandles < 0 {
+		return nil, invalidField("max_handles", "max_handles must not be negative")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for tier := range q.MaxBytes {
+		if _, ok := s.tiers[tier]; !ok {
+			return nil, invalidField("max_bytes", "unknown tier %q in max_bytes", tier)
+		}
+	}
+
+	previous, existed := s.quotas[q.SecurityDomain]
+	s.quotas[q.SecurityDomain] = &q
+	if err := s.saveQuotasLocked(); err != nil {
+		if existed {
+			s.quotas[q.SecurityDomain] = previous
+		} else {
+			delete(s.quotas, q.SecurityDomain)
+		}
+		return nil, fmt.Errorf("persist quota: %v", err)
+	}
+
+	usage := s.domainUsage(q.SecurityDomain, "")
+	quota := q
+	usage.Quota = &quota
+	return &usage, nil
+}
+
+// DeleteQuota removes a domain's quota, leaving it unlimited
+func (s *FFMService) DeleteQuota(domain string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous, exists := s.quotas[domain]
+	if !exists {
+		return notFound("no quota for security domain %q", domain)
+	}
+	delete(s.quotas, domain)
+	if err := s.saveQuotasLocked(); err != nil {
+		s.quotas[domain] = previous
+		return fmt.Errorf("persist quota: %v", err)
+	}
+	return nil
+}
+
+// QuotaUsage reports usage against quota for every domain that has a quota
+// or allocations
+func (s *FFMService) QuotaUsage() []QuotaUsage {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	domains := make(map[string]bool)
+	for domain := range s.quotas {
+		domains[domain] = true
+	}
+	for _, h := range s.allocations {
+		domains[h.SecurityDomain] = true
+	}
+
+	usage := make([]QuotaUsage, 0, len(domains))
+	for domain := range domains {
+		usage = append(usage, s.domainUsageWithQuota(domain))
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].SecurityDomain < usage[j].SecurityDomain })
+	return usage
+}
+
+// GetQuotaUsage reports usage against quota for one domain
+func (s *FFMService) GetQuotaUsage(domain string) *QuotaUsage {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	usage := s.domainUsageWithQuota(domain)
+	return &usage
+}
+
+// domainUsageWithQuota attaches a copy of the domain's quota to its usage;
+// callers must hold s.mutex
+func (s *FFMService) domainUsageWithQuota(domain string) QuotaUsage {
+	usage := s.domainUsage(domain, "")
+	if q, ok := s.quotas[domain]; ok {
+		quota := *q
+		usage.Quota = &quota
+	}
+	return usage
+}
+
+// loadQuotas reads persisted quotas from the state directory
+func loadQuotas(dir string) (map[string]*Quota, error) {
+	quotas := make(map[string]*Quota)
+	data, err := os.ReadFile(filepath.Join(dir, quotaFile))
+	if os.IsNotExist(err) {
+		return quotas, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Quota
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", quotaFile, err)
+	}
+	for i := range list {
+		quotas[list[i].SecurityDomain] = &list[i]
+	}
+	return quotas, nil
+}
+
+// saveQuotasLocked writes all quotas to the state directory; callers must
+// hold s.mutex
+func (s *FFMService) saveQuotasLocked() error {
+	if s.store == nil {
+		return nil
+	}
+	list := make([]Quota, 0, len(s.quotas))
+	for _, q := range s.quotas {
+		list = append(list, *q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SecurityDomain < list[j].SecurityDomain })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.store.dir, quotaFile), data)
+}
+
+func (s *FFMService) handleListQuotas(w http.ResponseWriter, r *http.Request) {
+	usage := s.QuotaUsage()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+func (s *FFMService) handleGetQuota(w http.ResponseWriter, r *http.Request) {
+	usage := s.GetQuotaUsage(mux.Vars(r)["domain"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+func (s *FFMService) handleSetQuota(w http.ResponseWriter, r *http.Request) {
+	var q Quota
+	if err := decodeBody(r, &q); err != nil {
+		writeError(w, err)
+		return
+	}
+	domain := mux.Vars(r)["domain"]
+	if q.SecurityDomain != "" && q.SecurityDomain != domain {
+		writeError(w, invalidField("security_domain", "security_domain does not match the URL"))
+		return
+	}
+	q.SecurityDomain = domain
+
+	usage, err := s.SetQuota(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+func (s *FFMService) handleDeleteQuota(w http.ResponseWriter, r *http.Request) {
+	if err := s.DeleteQuota(mux.Vars(r)["domain"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
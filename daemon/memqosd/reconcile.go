@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Plan action kinds
+const (
+	ActionCreate         = "create"
+	ActionBandwidth      = "adjust_bandwidth"
+	ActionMigrate        = "migrate"
+	ActionSchedule       = "update_schedule"
+	ActionRelease        = "release"
+	ActionTier           = "update_tier"
+	ActionUnreconcilable = "unreconcilable"
+)
+
+// PlanAction is one step needed to make live handles match the policy
+type PlanAction struct {
+	Action   string `json:"action"`
+	Bundle   string `json:"bundle,omitempty"`
+	Tier     string `json:"tier,omitempty"`
+	HandleID string `json:"handle_id,omitempty"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Applied  bool   `json:"applied"`
+	Error    string `json:"error,omitempty"`
+
+	request AllocationRequest
+}
+
+// ApplyPolicy installs a policy's tier inventory and declared bundles
+func (s *FFMService) ApplyPolicy(policy *FFMPolicy) error {
+	tiers, err := policy.tierCapacities()
+	if err != nil {
+		return err
+	}
+	bundles, err := policy.bundleRequests()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tiers = tiers
+	s.policy = policy
+	s.bundles = bundles
+	s.arbitrateLocked()
+	return nil
+}
+
+// Plan computes the actions reconciling the installed policy would take,
+// without applying them
+func (s *FFMService) Plan() []PlanAction {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	prune := s.policy != nil && s.policy.Reconcile.Prune
+	return s.planLocked(s.bundles, prune, time.Now())
+}
+
+// PlanFor computes the actions installing policy would take, so an edited
+// policy file can be reviewed before it is reloaded. Tier changes come first,
+// as ApplyPolicy installs them before any bundle is reconciled.
+func (s *FFMService) PlanFor(policy *FFMPolicy) ([]PlanAction, error) {
+	tiers, err := policy.tierCapacities()
+	if err != nil {
+		return nil, err
+	}
+	bundles, err := policy.bundleRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	plan := s.tierPlanLocked(tiers)
+	return append(plan, s.planLocked(bundles, policy.Reconcile.Prune, time.Now())...), nil
+}
+
+// tierPlanLocked diffs tiers against the installed tier inventory; callers
+// must hold s.mutex
+func (s *FFMService) tierPlanLocked(tiers map[string]*TierCapacity) []PlanAction {
+	names := make([]string, 0, len(tiers)+len(s.tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	for name := range s.tiers {
+		if _, ok := tiers[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var plan []PlanAction
+	for _, name := range names {
+		have, want := s.tiers[name], tiers[name]
+		if have != nil && want != nil && *have == *want {
+			continue
+		}
+		a := PlanAction{Action: ActionTier, Tier: name, From: "absent", To: "removed"}
+		if have != nil {
+			a.From = fmt.Sprintf("%d bytes, %d GB/s", have.Bytes, have.BandwidthGBs)
+		}
+		if want != nil {
+			a.To = fmt.Sprintf("%d bytes, %d GB/s", want.Bytes, want.BandwidthGBs)
+			if bytes, bandwidth, _ := s.tierUsage(name, ""); bytes > want.Bytes || bandwidth > want.BandwidthGBs {
+				a.Detail = fmt.Sprintf("%d bytes and %d GB/s already committed", bytes, bandwidth)
+			}
+		}
+		plan = append(plan, a)
+	}
+	return plan
+}
+
+// planLocked diffs bundles against live handles; callers must hold s.mutex
+func (s *FFMService) planLocked(bundles map[string]AllocationRequest, prune bool, now time.Time) []PlanAction {
+	live := make(map[string]*FFMHandle)
+	for _, h := range s.allocations {
+		if h.Bundle != "" && h.State == StateActive {
+			live[h.Bundle] = h
+		}
+	}
+
+	names := make([]string, 0, len(bundles))
+	for name := range bundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var plan []PlanAction
+	for _, name := range names {
+		want := bundles[name]
+		h, exists := live[name]
+		if !exists {
+			plan = append(plan, PlanAction{
+				Action:  ActionCreate,
+				Bundle:  name,
+				Detail:  fmt.Sprintf("%d bytes on %s, floor %d GB/s", want.Bytes, want.LatencyClass, want.BandwidthFloor),
+				request: want,
+			})
+			continue
+		}
+
+		// Properties fixed at allocation time cannot be changed in place
+		if h.Bytes != want.Bytes || h.Shareable != want.Shareable ||
+			h.SecurityDomain != want.SecurityDomain || h.Persistence != want.Persistence {
+			plan = append(plan, PlanAction{
+				Action:   ActionUnreconcilable,
+				Bundle:   name,
+				HandleID: h.ID,
+				Detail:   "bytes, shareable, security_domain or persistence differ; release the handle to recreate it",
+			})
+			continue
+		}
+
+		if !reflect.DeepEqual(nonEmpty(h.Schedule), nonEmpty(want.Schedule)) {
+			plan = append(plan, PlanAction{
+				Action:   ActionSchedule,
+				Bundle:   name,
+				HandleID: h.ID,
+				From:     fmt.Sprintf("%d windows", len(h.Schedule)),
+				To:       fmt.Sprintf("%d windows", len(want.Schedule)),
+				request:  want,
+			})
+		}
+
+		floor := want.BandwidthFloor
+		if w, ok := activeWindow(want.Schedule, now); ok {
+			floor = w.FloorGBs
+		}
+		if h.BandwidthFloor != floor {
+			plan = append(plan, PlanAction{
+				Action:   ActionBandwidth,
+				Bundle:   name,
+				HandleID: h.ID,
+				From:     fmt.Sprintf("%d", h.BandwidthFloor),
+				To:       fmt.Sprintf("%d", floor),
+				request:  AllocationRequest{BandwidthFloor: floor},
+			})
+		}
+
+		target := h.LatencyClass
+		if h.MigratingTo != "" {
+			target = h.MigratingTo
+		}
+		if target != want.LatencyClass {
+			plan = append(plan, PlanAction{
+				Action:   ActionMigrate,
+				Bundle:   name,
+				HandleID: h.ID,
+				From:     h.LatencyClass,
+				To:       want.LatencyClass,
+			})
+		}
+	}
+
+	if prune {
+		undeclared := make([]string, 0)
+		for name := range live {
+			if _, declared := bundles[name]; !declared {
+				undeclared = append(undeclared, name)
+			}
+		}
+		sort.Strings(undeclared)
+		for _, name := range undeclared {
+			h := live[name]
+			// Pruning never detaches consumers of a shared bundle
+			if h.RefCount > 0 {
+				plan = append(plan, PlanAction{
+					Action:   ActionUnreconcilable,
+					Bundle:   name,
+					HandleID: h.ID,
+					Detail:   fmt.Sprintf("bundle no longer declared but still shared by %d consumer(s); detach them to release it", h.RefCount),
+				})
+				continue
+			}
+			plan = append(plan, PlanAction{
+				Action:   ActionRelease,
+				Bundle:   name,
+				HandleID: h.ID,
+				Detail:   "bundle no longer declared",
+			})
+		}
+	}
+	return plan
+}
+
+// nonEmpty maps an empty schedule to nil so comparisons ignore the difference
+func nonEmpty(windows []ScheduleWindow) []ScheduleWindow {
+	if len(windows) == 0 {
+		return nil
+	}
+	return windows
+}
+
+// Reconcile applies the current plan and returns each action's outcome.
+// Actions are applied one by one through the regular service methods, so a
+// handle changed concurrently is simply picked up by the next reconcile.
+func (s *FFMService) Reconcile() []PlanAction {
+	plan := s.Plan()
+	for i := range plan {
+		a := &plan[i]
+		var err error
+		switch a.Action {
+		case ActionCreate:
+			var h *FFMHandle
+			if h, err = s.Allocate(a.request); err == nil {
+				a.HandleID = h.ID
+			}
+		case ActionSchedule:
+			err = s.setSchedule(a.HandleID, a.request.Schedule)
+		case ActionBandwidth:
+			err = s.AdjustBandwidth(a.HandleID, BandwidthAdjustRequest{FloorGBs: a.request.BandwidthFloor})
+		case ActionMigrate:
+			_, err = s.AdjustLatencyClass(a.HandleID, LatencyClassAdjustRequest{Target: a.To})
+		case ActionRelease:
+			_, err = s.Release(a.HandleID, false)
+		case ActionTier:
+			// ApplyPolicy has already installed the tier inventory
+			continue
+		case ActionUnreconcilable:
+			log.Printf("Bundle %s (%s) cannot be reconciled: %s", a.Bundle, a.HandleID, a.Detail)
+			continue
+		}
+		if err != nil {
+			a.Error = err.Error()
+			log.Printf("Reconcile %s of bundle %s failed: %v", a.Action, a.Bundle, err)
+			continue
+		}
+		a.Applied = true
+	}
+	return plan
+}
+
+// setSchedule replaces a handle's schedule; the scheduler applies the
+// active window on its next tick
+func (s *FFMService) setSchedule(id string, windows []ScheduleWindow) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return notFound("allocation %s not found", id)
+	}
+	if err := requireActive(handle); err != nil {
+		return err
+	}
+	if err := s.validateScheduleLocked(windows, handle.LatencyClass, handle.SecurityDomain); err != nil {
+		return err
+	}
+	oldSchedule, oldWindow := handle.Schedule, handle.ActiveWindow
+	handle.Schedule, handle.ActiveWindow = windows, ""
+	if err := s.persist(handle); err != nil {
+		handle.Schedule, handle.ActiveWindow = oldSchedule, oldWindow
+		return fmt.Errorf("persist schedule: %v", err)
+	}
+	return nil
+}
+
+// ReloadPolicy reads the policy file, installs it and reconciles
+func (s *FFMService) ReloadPolicy() error {
+	path := s.policyPath
+	policy, err := loadPolicy(path)
+	if err != nil {
+		return err
+	}
+	if err := s.ApplyPolicy(policy); err != nil {
+		return fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+	applied, failed := 0, 0
+	for _, a := range s.Reconcile() {
+		switch {
+		case a.Applied:
+			applied++
+		case a.Error != "":
+			failed++
+		}
+	}
+	log.Printf("Loaded policy %s: %d bundles, %d actions applied, %d failed",
+		path, len(policy.Bundles), applied, failed)
+	return nil
+}
+
+// handlePlan diffs the policy file on disk against live handles, falling
+// back to the installed policy when memqosd runs without a policy file
+func (s *FFMService) handlePlan(w http.ResponseWriter, r *http.Request) {
+	var plan []PlanAction
+	if s.policyPath != "" {
+		policy, err := loadPolicy(s.policyPath)
+		if err == nil {
+			plan, err = s.PlanFor(policy)
+		}
+		if err != nil {
+			writeErrorBody(w, http.StatusUnprocessableEntity, ErrorBody{
+				Code:    "invalid_policy",
+				Message: fmt.Sprintf("invalid policy %s: %v", s.policyPath, err),
+			})
+			return
+		}
+	} else {
+		plan = s.Plan()
+	}
+	if plan == nil {
+		plan = []PlanAction{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Region kinds
+const (
+	RegionMemfd = "memfd" // anonymous memory, gone when the last fd closes
+	RegionFile  = "file"  // file on a tmpfs or DAX mount
+)
+
+// RegionInfo describes the memory backing a handle
+type RegionInfo struct {
+	Kind string `json:"kind"`
+	Path string `json:"path,omitempty"` // file regions only
+	Size uint64 `json:"size"`
+	// RestoredFrom names the checkpoint a write-back region was refilled
+	// from after its working copy was lost
+	RestoredFrom string `json:"restored_from,omitempty"`
+}
+
+// Region is an open backing region; memqosd holds the fd for the lifetime of
+// the handle and hands duplicates to clients over the fd socket
+type Region struct {
+	RegionInfo
+	file    *os.File
+	mapping []byte // held while a NUMA policy is bound to the region
+}
+
+// RegionBackend creates the memory behind FFM handles
+type RegionBackend interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Create backs a new handle with Bytes of memory
+	Create(handle *FFMHandle) (*Region, error)
+	// Open re-attaches the region of a handle recovered after a restart,
+	// restoring it from its last checkpoint or creating it if it did not
+	// survive
+	Open(handle *FFMHandle) (*Region, error)
+	// Sync makes a handle's contents durable
+	Sync(handle *FFMHandle, region *Region) error
+	// Release frees a handle's region
+	Release(handle *FFMHandle, region *Region) error
+}
+
+// RegionConfig places file-backed regions. Handles without persistence get
+// anonymous memory. Write-back handles work on a copy in TmpfsDir that is
+// checkpointed to DAXDir; write-through and durable handles live on DAXDir.
+type RegionConfig struct {
+	TmpfsDir string
+	DAXDir   string
+}
+
+// memoryBackend backs handles with memfds and files according to Persistence
+type memoryBackend struct {
+	config RegionConfig
+	// mu orders checkpoint renames against Release so a checkpoint that
+	// finishes after its handle is freed is not left behind
+	mu sync.Mutex
+}
+
+// NewMemoryBackend returns the memfd/file region backend
+func NewMemoryBackend(config RegionConfig) (RegionBackend, error) {
+	for _, dir := range []string{config.TmpfsDir, config.DAXDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create region directory: %v", err)
+		}
+	}
+	// Drop checkpoints interrupted by a crash
+	partial, _ := filepath.Glob(filepath.Join(config.DAXDir, "*.ffm.*"))
+	for _, path := range partial {
+		os.Remove(path)
+	}
+	return &memoryBackend{config: config}, nil
+}
+
+func (b *memoryBackend) Name() string {
+	return fmt.Sprintf("memory (tmpfs %s, dax %s)", b.config.TmpfsDir, b.config.DAXDir)
+}
+
+// placement returns the directory a handle's file lives in, or "" for
+// anonymous memory
+func (b *memoryBackend) placement(handle *FFMHandle) string {
+	switch handle.Persistence {
+	case PersistenceWriteBack:
+		return b.config.TmpfsDir
+	case PersistenceWriteThrough, PersistenceDurable:
+		return b.config.DAXDir
+	default:
+		return ""
+	}
+}
+
+// checkpointPath is where a write-back handle's contents are flushed to
+func (b *memoryBackend) checkpointPath(handle *FFMHandle) string {
+	return filepath.Join(b.config.DAXDir, handle.ID+".ffm")
+}
+
+func (b *memoryBackend) Create(handle *FFMHandle) (*Region, error) {
+	dir := b.placement(handle)
+	if dir == "" {
+		f, err := createAnonymous("ffm-"+handle.ID, int64(handle.Bytes))
+		if err != nil {
+			return nil, fmt.Errorf("create anonymous region: %v", err)
+		}
+		return &Region{RegionInfo: RegionInfo{Kind: RegionMemfd, Size: handle.Bytes}, file: f}, nil
+	}
+
+	path := filepath.Join(dir, handle.ID+".ffm")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create region file: %v", err)
+	}
+	// Sized sparsely; pages are committed as they are touched
+	if err := f.Truncate(int64(handle.Bytes)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("size region file: %v", err)
+	}
+	return &Region{RegionInfo: RegionInfo{Kind: RegionFile, Path: path, Size: handle.Bytes}, file: f}, nil
+}
+
+func (b *memoryBackend) Open(handle *FFMHandle) (*Region, error) {
+	dir := b.placement(handle)
+	if dir == "" {
+		return b.Create(handle)
+	}
+
+	path := filepath.Join(dir, handle.ID+".ffm")
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return b.restore(handle)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open region file: %v", err)
+	}
+	return &Region{RegionInfo: RegionInfo{Kind: RegionFile, Path: path, Size: handle.Bytes}, file: f}, nil
+}
+
+// restore recreates a region that did not survive, refilling a write-back
+// handle's working copy from its last checkpoint
+func (b *memoryBackend) restore(handle *FFMHandle) (*Region, error) {
+	region, err := b.Create(handle)
+	if err != nil || handle.Persistence != PersistenceWriteBack {
+		return region, err
+	}
+
+	checkpoint, err := os.Open(b.checkpointPath(handle))
+	if os.IsNotExist(err) {
+		return region, nil
+	}
+	if err != nil {
+		b.Release(handle, region)
+		return nil, fmt.Errorf("open checkpoint: %v", err)
+	}
+	defer checkpoint.Close()
+	if err := copySparse(region.file, checkpoint, int64(handle.Bytes), nil); err != nil {
+		b.Release(handle, region)
+		return nil, fmt.Errorf("restore checkpoint: %v", err)
+	}
+	region.RestoredFrom = checkpoint.Name()
+	return region, nil
+}
+
+// Sync checkpoints a write-back handle's working copy to DAXDir and fsyncs
+// the files of write-through and durable handles
+func (b *memoryBackend) Sync(handle *FFMHandle, region *Region) error {
+	switch handle.Persistence {
+	case PersistenceWriteThrough, PersistenceDurable:
+		return region.file.Sync()
+	case PersistenceWriteBack:
+	default:
+		return fmt.Errorf("%w: allocation %s has no persistence", errInvalidRequest, handle.ID)
+	}
+
+	// Copy to a temporary file and rename it over the previous checkpoint
+	// so a crash mid-copy never leaves a torn checkpoint
+	path := b.checkpointPath(handle)
+	tmp, err := os.CreateTemp(b.config.DAXDir, handle.ID+".ffm.*")
+	if err != nil {
+		return fmt.Errorf("create checkpoint: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = copySparse(tmp, region.file, int64(region.Size), nil)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write checkpoint: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := os.Stat(region.Path); err != nil {
+		return fmt.Errorf("allocation %s was released during checkpoint", handle.ID)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("commit checkpoint: %v", err)
+	}
+	// Make the rename itself durable
+	if d, err := os.Open(b.config.DAXDir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (b *memoryBackend) Release(handle *FFMHandle, region *Region) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := region.file.Close(); err != nil {
+		return err
+	}
+	paths := []string{region.Path}
+	if handle.Persistence == PersistenceWriteBack {
+		paths = append(paths, b.checkpointPath(handle))
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySparse copies size bytes of src into dst, leaving holes where src
+// reads as zeros so sparse regions stay sparse. Only the data extents of src
+// are read, so flushing a mostly empty region costs what it holds, not its
+// size. Everything read, holes included, is also written to sum, when given.
+func copySparse(dst, src *os.File, size int64, sum hash.Hash) error {
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	end := size
+	if st.Size() < end {
+		end = st.Size()
+	}
+	extents, err := dataExtents(src, end)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	off := int64(0)
+	for _, e := range extents {
+		if sum != nil {
+			hashZeros(sum, zero, e[0]-off)
+		}
+		for off = e[0]; off < e[1]; {
+			chunk := buf
+			if rest := e[1] - off; rest < int64(len(chunk)) {
+				chunk = chunk[:rest]
+			}
+			n, err := src.ReadAt(chunk, off)
+			if sum != nil {
+				sum.Write(chunk[:n])
+			}
+			if n > 0 && !bytes.Equal(chunk[:n], zero[:n]) {
+				if _, werr := dst.WriteAt(chunk[:n], off); werr != nil {
+					return werr
+				}
+			}
+			off += int64(n)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				// src shrank under us; nothing more to read
+				return dst.Truncate(size)
+			}
+		}
+	}
+	if sum != nil {
+		hashZeros(sum, zero, end-off)
+	}
+	return dst.Truncate(size)
+}
+
+// hashZeros writes n zero bytes to sum
+func hashZeros(sum hash.Hash, zero []byte, n int64) {
+	for n > 0 {
+		chunk := zero
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		sum.Write(chunk)
+		n -= int64(len(chunk))
+	}
+}
+
+// SetRegionBackend installs the backend that backs handles with memory
+func (s *FFMService) SetRegionBackend(backend RegionBackend) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.backend = backend
+}
+
+// attachRegionLocked records a handle's open region; callers must hold
+// s.mutex
+func (s *FFMService) attachRegionLocked(handle *FFMHandle, region *Region) {
+	s.regions[handle.ID] = region
+	info := region.RegionInfo
+	handle.Region = &info
+	handle.FileDescriptors = []string{fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), region.file.Fd())}
+}
+
+// releaseRegionLocked frees a handle's region, if it has one; callers must
+// hold s.mutex
+func (s *FFMService) releaseRegionLocked(handle *FFMHandle) error {
+	region, ok := s.regions[handle.ID]
+	if !ok {
+		return nil
+	}
+	delete(s.regions, handle.ID)
+	if err := unbindRegion(region); err != nil {
+		log.Printf("Unmapping region of %s failed: %v", handle.ID, err)
+	}
+	return s.backend.Release(handle, region)
+}
+
+// openRegionsLocked re-attaches the regions of recovered handles; callers must
+// hold s.mutex
+func (s *FFMService) openRegionsLocked() error {
+	if s.backend == nil {
+		return nil
+	}
+	for id, handle := range s.allocations {
+		region, err := s.backend.Open(handle)
+		if err != nil {
+			return fmt.Errorf("open region of %s: %v", id, err)
+		}
+		if region.RestoredFrom != "" {
+			log.Printf("Restored region of %s from checkpoint %s", id, region.RestoredFrom)
+		}
+		s.attachRegionLocked(handle, region)
+		s.placeRegionLocked(handle, false)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// createAnonymous creates a memfd of size bytes
+func createAnonymous(name string, size int64) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "memfd:"+name)
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// defaultRegionConfig keeps volatile files on /dev/shm and durable ones
+// under the state directory until a DAX mount is configured
+func defaultRegionConfig(stateDir string) RegionConfig {
+	return RegionConfig{
+		TmpfsDir: "/dev/shm/memqosd",
+		DAXDir:   filepath.Join(stateDir, "regions"),
+	}
+}
+
+// dataExtents returns the [start, end) ranges of f below size that hold
+// data, skipping holes with SEEK_DATA and SEEK_HOLE. Seeking goes through a
+// private open of f so the offset of the file description shared with
+// clients is left alone. Filesystems that cannot report holes, and regions
+// that cannot be reopened, are treated as all data.
+func dataExtents(f *os.File, size int64) ([][2]int64, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	all := [][2]int64{{0, size}}
+	sc, err := f.SyscallConn()
+	if err != nil {
+		return all, nil
+	}
+	var private *os.File
+	sc.Control(func(fd uintptr) {
+		private, err = os.Open(fmt.Sprintf("/proc/self/fd/%d", fd))
+	})
+	if err != nil {
+		return all, nil
+	}
+	defer private.Close()
+	fd := int(private.Fd())
+
+	var extents [][2]int64
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		extents = append(extents, [2]int64{start, end})
+		off = end
+	}
+	return extents, nil
+}
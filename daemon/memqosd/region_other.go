@@ -0,0 +1,40 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// createAnonymous emulates a memfd with an unlinked temporary file
+func createAnonymous(name string, size int64) (*os.File, error) {
+	f, err := os.CreateTemp("", name+"-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// defaultRegionConfig keeps volatile files in the temp directory and durable
+// ones under the state directory
+func defaultRegionConfig(stateDir string) RegionConfig {
+	return RegionConfig{
+		TmpfsDir: filepath.Join(os.TempDir(), "memqosd"),
+		DAXDir:   filepath.Join(stateDir, "regions"),
+	}
+}
+
+// dataExtents reports all of f below size as data; hole detection is only
+// implemented on Linux
+func dataExtents(f *os.File, size int64) ([][2]int64, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	return [][2]int64{{0, size}}, nil
+}
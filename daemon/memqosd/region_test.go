@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopySparse(t *testing.T) {
+	dir := t.TempDir()
+	const size = 64 << 20
+	data := map[int64]string{4096: "head", 40 << 20: "middle", size - 4: "tail"}
+	want := make([]byte, size)
+
+	src, err := os.Create(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for off, s := range data {
+		copy(want[off:], s)
+		if _, err := src.WriteAt([]byte(s), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	extents, err := dataExtents(src, size)
+	if err != nil {
+		t.Fatalf("dataExtents: %v", err)
+	}
+	// Filesystems without hole reporting return one extent; either way
+	// every byte of data must be covered
+	for off := range data {
+		covered := false
+		for _, e := range extents {
+			covered = covered || (e[0] <= off && off < e[1])
+		}
+		if !covered {
+			t.Errorf("extents %v miss data at %d", extents, off)
+		}
+	}
+
+	sum := sha256.New()
+	if err := copySparse(dst, src, size, sum); err != nil {
+		t.Fatalf("copySparse: %v", err)
+	}
+
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("copy differs from source")
+	}
+	if wantSum := sha256.Sum256(want); !bytes.Equal(sum.Sum(nil), wantSum[:]) {
+		t.Error("checksum does not cover the holes")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Handle lifecycle states
+const (
+	StateActive   = "active"
+	StateDraining = "draining"
+	StateReleased = "released"
+)
+
+// Release frees an allocation. Shared handles with attached consumers are
+// refused unless force is set.
+func (s *FFMService) Release(id string, force bool) (*FFMHandle, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return nil, notFound("allocation %s not found", id)
+	}
+	if handle.State != StateActive {
+		return nil, fmt.Errorf("%w: allocation %s is %s", errHandleBusy, id, handle.State)
+	}
+	if handle.RefCount > 0 && !force {
+		return nil, fmt.Errorf("%w: allocation %s is still shared by %d consumer(s)", errHandleBusy, id, handle.RefCount)
+	}
+
+	if err := s.releaseLocked(handle); err != nil {
+		return nil, err
+	}
+	s.emitEvent(Event{
+		Type:           "released",
+		HandleID:       handle.ID,
+		SecurityDomain: handle.SecurityDomain,
+		Before:         map[string]interface{}{"state": StateActive, "refcount": handle.RefCount},
+		After:          map[string]interface{}{"state": StateReleased},
+	})
+	released := *handle
+	return redactDescriptors(&released), nil
+}
+
+// releaseLocked drives a handle through draining to released and drops it
+// from the service; callers must hold s.mutex
+func (s *FFMService) releaseLocked(handle *FFMHandle) error {
+	if m, ok := s.migrations[handle.MigrationID]; ok && m.State == MigrationRunning {
+		s.cancelMigrationLocked(m, "allocation released")
+	}
+
+	// Record draining first so a crash mid-release is finished on recovery
+	handle.State = StateDraining
+	if err := s.persist(handle); err != nil {
+		handle.State = StateActive
+		return fmt.Errorf("persist draining state: %v", err)
+	}
+
+	// From here on the release is finished in memory even if the delete
+	// cannot be recorded: the draining record makes OpenStore finish it
+	if s.store != nil {
+		if err := s.store.Delete(handle.ID, s.nextID); err != nil {
+			log.Printf("Failed to persist release of %s, recovery will finish it: %v", handle.ID, err)
+		}
+	}
+	handle.State = StateReleased
+	delete(s.allocations, handle.ID)
+	s.arbitrateLocked()
+	if err := s.releaseRegionLocked(handle); err != nil {
+		log.Printf("Failed to free region of %s: %v", handle.ID, err)
+	}
+	for mid, m := range s.migrations {
+		if m.HandleID == handle.ID {
+			delete(s.migrations, mid)
+		}
+	}
+
+	// Update metrics
+	s.metrics.AllocationsTotal.Set(float64(len(s.allocations)))
+	s.metrics.BandwidthTotal.Sub(float64(handle.BandwidthFloor))
+	return nil
+}
+
+// requireActive rejects changes to handles that are being cloned or released
+func requireActive(handle *FFMHandle) error {
+	if handle.State != StateActive {
+		return fmt.Errorf("%w: allocation %s is %s", errHandleBusy, handle.ID, handle.State)
+	}
+	return nil
+}
+
+func (s *FFMService) handleRelease(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	force := r.URL.Query().Get("force") == "true"
+
+	handle, err := s.Release(id, force)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handle)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// scheduleHorizon bounds how far ahead upcoming transitions are listed
+const scheduleHorizon = 24 * time.Hour
+
+// defaultWindows supplies times for the window names used in ffm_policy.yaml
+var defaultWindows = map[string][2]string{
+	"peak":    {"08:00", "20:00"},
+	"offpeak": {"20:00", "08:00"},
+}
+
+// ScheduleWindow applies a bandwidth floor during a daily time window.
+// Times are HH:MM in the daemon's local time; a window whose end is before
+// its start wraps past midnight, and start == end covers the whole day.
+type ScheduleWindow struct {
+	Name     string `json:"name"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	FloorGBs uint64 `json:"floor_GBs"`
+}
+
+// ScheduleTransition is an upcoming change of the active window
+type ScheduleTransition struct {
+	At       time.Time `json:"at"`
+	Window   string    `json:"window"`
+	FloorGBs uint64    `json:"floor_GBs"`
+}
+
+// normalizeSchedule fills default times for well-known window names and
+// validates every window
+func normalizeSchedule(windows []ScheduleWindow) ([]ScheduleWindow, error) {
+	out := make([]ScheduleWindow, 0, len(windows))
+	seen := make(map[string]bool)
+	for _, w := range windows {
+		if w.Name == "" {
+			return nil, invalidField("schedule", "schedule window name is required")
+		}
+		if seen[w.Name] {
+			return nil, invalidField("schedule", "duplicate schedule window %q", w.Name)
+		}
+		seen[w.Name] = true
+		if w.Start == "" && w.End == "" {
+			def, ok := defaultWindows[w.Name]
+			if !ok {
+				return nil, invalidField("schedule", "schedule window %q needs start and end", w.Name)
+			}
+			w.Start, w.End = def[0], def[1]
+		}
+		if _, err := clockMinutes(w.Start); err != nil {
+			return nil, invalidField("schedule", "window %q start: %v", w.Name, err)
+		}
+		if _, err := clockMinutes(w.End); err != nil {
+			return nil, invalidField("schedule", "window %q end: %v", w.Name, err)
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// validateScheduleLocked rejects windows whose floor could never be applied
+// to a handle on tier in domain: above the tier's bandwidth budget or the
+// domain's bandwidth quota. Callers must hold s.mutex.
+func (s *FFMService) validateScheduleLocked(windows []ScheduleWindow, tier, domain string) error {
+	capacity, ok := s.tiers[tier]
+	if !ok {
+		return nil // reported by validateAllocationLocked
+	}
+	var quotaLimit uint64
+	if q, ok := s.quotas[domain]; ok {
+		quotaLimit = q.MaxBandwidthGBs
+	}
+	for _, w := range windows {
+		if w.FloorGBs > capacity.BandwidthGBs {
+			return invalidField("schedule", "window %q floor of %d GB/s exceeds the %d GB/s budget of tier %s",
+				w.Name, w.FloorGBs, capacity.BandwidthGBs, tier)
+		}
+		if quotaLimit > 0 && w.FloorGBs > quotaLimit {
+			return invalidField("schedule", "window %q floor of %d GB/s exceeds the %d GB/s bandwidth quota of security domain %q",
+				w.Name, w.FloorGBs, quotaLimit, domain)
+		}
+	}
+	return nil
+}
+
+// clockMinutes parses HH:MM into minutes after midnight
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether the window covers t
+func (w ScheduleWindow) contains(t time.Time) bool {
+	start, _ := clockMinutes(w.Start)
+	end, _ := clockMinutes(w.End)
+	now := t.Hour()*60 + t.Minute()
+	switch {
+	case start == end:
+		return true
+	case start < end:
+		return now >= start && now < end
+	default:
+		return now >= start || now < end
+	}
+}
+
+// activeWindow returns the first window covering t, if any
+func activeWindow(windows []ScheduleWindow, t time.Time) (ScheduleWindow, bool) {
+	for _, w := range windows {
+		if w.contains(t) {
+			return w, true
+		}
+	}
+	return ScheduleWindow{}, false
+}
+
+// upcomingTransitions lists the window changes within scheduleHorizon
+func upcomingTransitions(windows []ScheduleWindow, now time.Time) []ScheduleTransition {
+	var transitions []ScheduleTransition
+	current, _ := activeWindow(windows, now)
+	for _, w := range windows {
+		for _, edge := range []string{w.Start, w.End} {
+			m, _ := clockMinutes(edge)
+			at := time.Date(now.Year(), now.Month(), now.Day(), m/60, m%60, 0, 0, now.Location())
+			if !at.After(now) {
+				at = at.Add(24 * time.Hour)
+			}
+			if at.Sub(now) > scheduleHorizon {
+				continue
+			}
+			transitions = append(transitions, ScheduleTransition{At: at})
+		}
+	}
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].At.Before(transitions[j].At) })
+
+	// Resolve which window each edge activates and drop edges that change nothing
+	out := transitions[:0]
+	prev := current.Name
+	for _, tr := range transitions {
+		if len(out) > 0 && tr.At.Equal(out[len(out)-1].At) {
+			continue
+		}
+		next, ok := activeWindow(windows, tr.At)
+		if !ok {
+			next = ScheduleWindow{}
+		}
+		if next.Name == prev {
+			continue
+		}
+		tr.Window, tr.FloorGBs = next.Name, next.FloorGBs
+		out = append(out, tr)
+		prev = next.Name
+	}
+	return out
+}
+
+// applySchedules moves every scheduled handle onto the floor of its active
+// window; handles outside all windows keep their current floor
+func (s *FFMService) applySchedules(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, handle := range s.allocations {
+		if len(handle.Schedule) == 0 || handle.State != StateActive {
+			continue
+		}
+		w, ok := activeWindow(handle.Schedule, now)
+		if !ok || w.Name == handle.ActiveWindow {
+			continue
+		}
+
+		oldFloor := handle.BandwidthFloor
+		if err := s.setBandwidthFloor(handle, w.FloorGBs); err != nil {
+			// Retried on every tick until it fits, but reported once
+			if handle.failedWindow != w.Name {
+				handle.failedWindow = w.Name
+				s.emitEvent(Event{
+					Type:           "schedule_transition_failed",
+					HandleID:       handle.ID,
+					SecurityDomain: handle.SecurityDomain,
+					Detail:         fmt.Sprintf("window %q, floor %d GB/s: %v", w.Name, w.FloorGBs, err),
+				})
+			}
+			continue
+		}
+		handle.failedWindow = ""
+		previous := handle.ActiveWindow
+		handle.ActiveWindow = w.Name
+		if err := s.persist(handle); err != nil {
+			log.Printf("Failed to persist active window of %s: %v", handle.ID, err)
+		}
+		s.emitEvent(Event{
+			Type:           "schedule_transition",
+			HandleID:       handle.ID,
+			SecurityDomain: handle.SecurityDomain,
+			Detail:         fmt.Sprintf("window %q -> %q, floor %d -> %d GB/s", previous, w.Name, oldFloor, w.FloorGBs),
+			Before:         map[string]interface{}{"active_window": previous, "bandwidth_floor_GBs": oldFloor},
+			After:          map[string]interface{}{"active_window": w.Name, "bandwidth_floor_GBs": w.FloorGBs},
+		})
+	}
+}
+
+// runScheduler applies schedule windows as their boundaries pass
+func (s *FFMService) runScheduler(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.applySchedules(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.applySchedules(now)
+		}
+	}
+}
+
+// withUpcomingTransitions fills the computed schedule fields of a handle copy
+func withUpcomingTransitions(handle *FFMHandle, now time.Time) *FFMHandle {
+	if len(handle.Schedule) > 0 {
+		handle.UpcomingTransitions = upcomingTransitions(handle.Schedule, now)
+	}
+	return handle
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleFloors(t *testing.T) {
+	s := NewFFMService()
+	now := time.Now()
+	later := []ScheduleWindow{{
+		Name:  "burst",
+		Start: now.Add(time.Hour).Format("15:04"),
+		End:   now.Add(2 * time.Hour).Format("15:04"),
+	}}
+
+	// A window floor above the tier budget is refused up front, even when
+	// the window is not active yet
+	later[0].FloorGBs = 500
+	_, err := s.Allocate(AllocationRequest{Bytes: 1 << 30, LatencyClass: "T2", Schedule: later})
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.Field != "schedule" {
+		t.Fatalf("window floor over the T2 budget: got %v, want a schedule error", err)
+	}
+
+	// A floor that fits the budget but not the current usage is retried
+	// each tick and reported once
+	if _, err := s.Allocate(AllocationRequest{Bytes: 1 << 30, LatencyClass: "T2", BandwidthFloor: 350}); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	later[0].FloorGBs = 100
+	h, err := s.Allocate(AllocationRequest{Bytes: 1 << 30, LatencyClass: "T2", Schedule: later})
+	if err != nil {
+		t.Fatalf("allocate scheduled: %v", err)
+	}
+	tick := now.Add(90 * time.Minute)
+	for i := 0; i < 3; i++ {
+		s.applySchedules(tick.Add(time.Duration(i) * 30 * time.Second))
+	}
+	failures := 0
+	for _, ev := range s.events {
+		if ev.Type == "schedule_transition_failed" && ev.HandleID == h.ID {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Errorf("%d schedule_transition_failed events over three ticks, want 1", failures)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Consumer is a process attached to a shared FFM handle
+type Consumer struct {
+	ID             string    `json:"id"`
+	PID            int       `json:"pid,omitempty"`
+	Pod            string    `json:"pod,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	SecurityDomain string    `json:"security_domain"`
+	Descriptor     string    `json:"descriptor,omitempty"` // only in the attach response
+	AttachedAt     time.Time `json:"attached_at"`
+}
+
+// AttachRequest represents a request to attach a consumer to a handle
+type AttachRequest struct {
+	PID            int    `json:"pid,omitempty"`
+	Pod            string `json:"pod,omitempty"`
+	Tenant         string `json:"tenant,omitempty"`
+	SecurityDomain string `json:"security_domain"`
+}
+
+// DetachRequest identifies the consumer to detach
+type DetachRequest struct {
+	ConsumerID string `json:"consumer_id"`
+}
+
+// newDescriptor returns an unguessable descriptor for handle id, presented
+// on the fd socket to obtain the handle's region fd
+func newDescriptor(id string) (string, error) {
+	token := make([]byte, 12)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ffmd:%s:%s", id, hex.EncodeToString(token)), nil
+}
+
+// redactDescriptors clears the fd socket descriptors from a copy of a
+// handle. Only the alloc and attach responses carry them to their holder.
+func redactDescriptors(c *FFMHandle) *FFMHandle {
+	c.OwnerDescriptor = ""
+	if len(c.Consumers) > 0 {
+		consumers := make([]Consumer, len(c.Consumers))
+		for i, consumer := range c.Consumers {
+			consumer.Descriptor = ""
+			consumers[i] = consumer
+		}
+		c.Consumers = consumers
+	}
+	return c
+}
+
+// Attach records a new consumer of a shareable handle and issues it a
+// descriptor. A pid/pod that is already attached is refused rather than
+// handed the existing descriptor; it must detach first.
+func (s *FFMService) Attach(id string, req AttachRequest) (*Consumer, error) {
+	if req.PID == 0 && req.Pod == "" {
+		return nil, invalidField("pid", "pid or pod is required")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return nil, notFound("allocation %s not found", id)
+	}
+	if err := requireActive(handle); err != nil {
+		return nil, err
+	}
+	if !handle.Shareable {
+		return nil, fmt.Errorf("%w: allocation %s is not shareable", errHandleBusy, id)
+	}
+	if req.SecurityDomain != handle.SecurityDomain {
+		return nil, fmt.Errorf("%w: security domain %q cannot attach to allocation in %q",
+			errForbidden, req.SecurityDomain, handle.SecurityDomain)
+	}
+
+	for _, c := range handle.Consumers {
+		if c.PID == req.PID && c.Pod == req.Pod {
+			return nil, invalidField("pid", "pid %d, pod %q is already attached to allocation %s as %s; detach it first",
+				req.PID, req.Pod, id, c.ID)
+		}
+	}
+
+	// The public consumer ID is drawn separately so it reveals nothing of
+	// the descriptor
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	descriptor, err := newDescriptor(id)
+	if err != nil {
+		return nil, err
+	}
+	consumer := Consumer{
+		ID:             fmt.Sprintf("%s-c%s", id, hex.EncodeToString(suffix)),
+		PID:            req.PID,
+		Pod:            req.Pod,
+		Tenant:         req.Tenant,
+		SecurityDomain: req.SecurityDomain,
+		Descriptor:     descriptor,
+		AttachedAt:     time.Now(),
+	}
+
+	handle.Consumers = append(handle.Consumers, consumer)
+	handle.RefCount = len(handle.Consumers)
+	if err := s.persist(handle); err != nil {
+		handle.Consumers = handle.Consumers[:len(handle.Consumers)-1]
+		handle.RefCount = len(handle.Consumers)
+		return nil, fmt.Errorf("persist attach: %v", err)
+	}
+
+	s.emitEvent(Event{
+		Type:           "attached",
+		HandleID:       id,
+		SecurityDomain: handle.SecurityDomain,
+		Detail:         fmt.Sprintf("%s (pid %d, pod %q), refcount %d", consumer.ID, consumer.PID, consumer.Pod, handle.RefCount),
+		Before:         map[string]interface{}{"refcount": handle.RefCount - 1},
+		After:          map[string]interface{}{"refcount": handle.RefCount},
+	})
+	return &consumer, nil
+}
+
+// Detach removes a consumer from a handle and returns the updated handle,
+// without the descriptors of the consumers still attached
+func (s *FFMService) Detach(id string, req DetachRequest) (*FFMHandle, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return nil, notFound("allocation %s not found", id)
+	}
+
+	idx := -1
+	for i, c := range handle.Consumers {
+		if c.ID == req.ConsumerID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, notFound("consumer %s not attached to allocation %s", req.ConsumerID, id)
+	}
+
+	previous := handle.Consumers
+	handle.Consumers = append(append([]Consumer{}, previous[:idx]...), previous[idx+1:]...)
+	handle.RefCount = len(handle.Consumers)
+	if err := s.persist(handle); err != nil {
+		handle.Consumers = previous
+		handle.RefCount = len(previous)
+		return nil, fmt.Errorf("persist detach: %v", err)
+	}
+
+	s.emitEvent(Event{
+		Type:           "detached",
+		HandleID:       id,
+		SecurityDomain: handle.SecurityDomain,
+		Detail:         fmt.Sprintf("%s, refcount %d", req.ConsumerID, handle.RefCount),
+		Before:         map[string]interface{}{"refcount": len(previous)},
+		After:          map[string]interface{}{"refcount": handle.RefCount},
+	})
+	c := *handle
+	return redactDescriptors(&c), nil
+}
+
+func (s *FFMService) handleAttach(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req AttachRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	consumer, err := s.Attach(id, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(consumer)
+}
+
+func (s *FFMService) handleDetach(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req DetachRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	handle, err := s.Detach(id, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handle)
+}
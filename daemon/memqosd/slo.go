@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultSLOWindow = time.Minute
+	// sloMinSamples avoids judging a handle on one or two readings
+	sloMinSamples = 3
+	// sloBandwidthTolerance is how far below its floor a handle may run
+	sloBandwidthTolerance = 0.05
+	// maxSLOViolations bounds the violation history kept per handle
+	maxSLOViolations = 64
+)
+
+// SLO kinds
+const (
+	SLOBandwidth = "bandwidth"
+	SLOTailP99   = "tail_p99"
+)
+
+// sloP99TargetMs is the tail latency objective of each tier
+var sloP99TargetMs = map[string]float64{
+	"T0": 1,
+	"T1": 2,
+	"T2": 5,
+	"T3": 25,
+}
+
+// fasterTier is the tier a handle is promoted to when it misses its SLO
+var fasterTier = map[string]string{
+	"T1": "T0",
+	"T2": "T1",
+	"T3": "T2",
+}
+
+// SLOViolation is a period during which a handle missed an objective
+type SLOViolation struct {
+	Kind        string     `json:"kind"`
+	Tier        string     `json:"tier"`
+	Target      float64    `json:"target"`
+	Observed    float64    `json:"observed"` // worst window average seen
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	Remediation string     `json:"remediation,omitempty"`
+}
+
+// SLOStatus reports a handle's objectives, current window and violations
+type SLOStatus struct {
+	HandleID        string         `json:"handle_id"`
+	WindowSeconds   float64        `json:"window_s"`
+	Samples         int            `json:"samples"`
+	FloorGBs        uint64         `json:"floor_GBs"`
+	AvgAchievedGBs  float64        `json:"avg_achieved_GBs"`
+	P99TargetMs     float64        `json:"p99_target_ms"`
+	AvgTailP99Ms    float64        `json:"avg_tail_p99_ms"`
+	Violating       []string       `json:"violating"`
+	Violations      []SLOViolation `json:"violations"`
+	RemediationMode bool           `json:"remediation_enabled"`
+}
+
+// sloSample is one telemetry reading kept in the sliding window
+type sloSample struct {
+	at        time.Time
+	achieved  float64
+	tailP99Ms float64
+}
+
+// sloTracker holds the sliding window and violations of one handle
+type sloTracker struct {
+	tier       string
+	samples    []sloSample
+	open       map[string]*SLOViolation // by kind
+	violations []*SLOViolation
+}
+
+// ConfigureSLO sets the evaluation window and whether violations are
+// remediated automatically
+func (s *FFMService) ConfigureSLO(window time.Duration, remediate bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sloWindow = window
+	s.sloRemediate = remediate
+}
+
+// windowAverages averages the samples still inside the window
+func (t *sloTracker) windowAverages() (achieved, tailP99Ms float64) {
+	for _, smp := range t.samples {
+		achieved += smp.achieved
+		tailP99Ms += smp.tailP99Ms
+	}
+	n := float64(len(t.samples))
+	return achieved / n, tailP99Ms / n
+}
+
+// evaluateSLOLocked adds a telemetry sample to the handle's window and opens
+// or closes violations; callers must hold s.mutex for writing
+func (s *FFMService) evaluateSLOLocked(handle *FFMHandle, sample TelemetryResponse, now time.Time) {
+	t, ok := s.slo[handle.ID]
+	if !ok {
+		t = &sloTracker{tier: handle.LatencyClass, open: make(map[string]*SLOViolation)}
+		s.slo[handle.ID] = t
+	}
+	if t.tier != handle.LatencyClass {
+		// Readings from the previous tier say nothing about the new one
+		for kind := range t.open {
+			s.checkSLOLocked(handle, t, kind, false, 0, 0, now)
+		}
+		t.tier, t.samples = handle.LatencyClass, nil
+	}
+	t.samples = append(t.samples, sloSample{at: now, achieved: float64(sample.AchievedGBs), tailP99Ms: sample.TailP99Ms})
+	cutoff := now.Add(-s.sloWindow)
+	for len(t.samples) > 0 && t.samples[0].at.Before(cutoff) {
+		t.samples = t.samples[1:]
+	}
+	if len(t.samples) < sloMinSamples {
+		return
+	}
+
+	achieved, tailP99Ms := t.windowAverages()
+	floor := float64(handle.BandwidthFloor)
+	target := sloP99TargetMs[handle.LatencyClass]
+
+	s.checkSLOLocked(handle, t, SLOBandwidth, floor > 0 && achieved < floor*(1-sloBandwidthTolerance), floor, achieved, now)
+	s.checkSLOLocked(handle, t, SLOTailP99, target > 0 && tailP99Ms > target, target, tailP99Ms, now)
+}
+
+// checkSLOLocked opens, updates or closes the violation of one kind;
+// callers must hold s.mutex for writing
+func (s *FFMService) checkSLOLocked(handle *FFMHandle, t *sloTracker, kind string, violated bool, target, observed float64, now time.Time) {
+	v, open := t.open[kind]
+	switch {
+	case violated && !open:
+		v = &SLOViolation{Kind: kind, Tier: handle.LatencyClass, Target: target, Observed: observed, StartedAt: now}
+		t.open[kind] = v
+		t.violations = append(t.violations, v)
+		if len(t.violations) > maxSLOViolations {
+			t.violations = t.violations[len(t.violations)-maxSLOViolations:]
+		}
+		s.metrics.SLOViolations.WithLabelValues(handle.LatencyClass, handle.SecurityDomain, kind).Inc()
+		s.emitEvent(Event{
+			Type:           "slo_violation",
+			HandleID:       handle.ID,
+			SecurityDomain: handle.SecurityDomain,
+			Detail:         fmt.Sprintf("%s on %s: observed %.2f, target %.2f", kind, handle.LatencyClass, observed, target),
+		})
+		if s.sloRemediate {
+			v.Remediation = s.remediateLocked(handle, kind)
+		}
+	case violated && open:
+		if (kind == SLOBandwidth && observed < v.Observed) || (kind == SLOTailP99 && observed > v.Observed) {
+			v.Observed = observed
+		}
+	case !violated && open:
+		ended := now
+		v.EndedAt = &ended
+		delete(t.open, kind)
+		s.emitEvent(Event{
+			Type:           "slo_recovered",
+			HandleID:       handle.ID,
+			SecurityDomain: handle.SecurityDomain,
+			Detail:         fmt.Sprintf("%s on %s after %s", kind, v.Tier, now.Sub(v.StartedAt).Round(time.Second)),
+		})
+	}
+}
+
+// remediateLocked tries to restore a handle's SLO, first by lowering the
+// floors of lower-priority neighbours on its tier, then by promoting it to a
+// faster tier unless it is bronze. It returns a description of what was
+// done. Callers must hold s.mutex for writing.
+func (s *FFMService) remediateLocked(handle *FFMHandle, kind string) string {
+	action := ""
+	if kind == SLOBandwidth {
+		action = s.throttleNeighboursLocked(handle)
+	}
+	if action == "" {
+		target, ok := fasterTier[handle.LatencyClass]
+		if ok && handle.MigrationID == "" && handle.Priority != PriorityBronze {
+			if m, err := s.startMigration(handle, target); err != nil {
+				log.Printf("SLO remediation of %s: cannot migrate to %s: %v", handle.ID, target, err)
+			} else {
+				action = fmt.Sprintf("migrating to %s (%s)", target, m.ID)
+			}
+		}
+	}
+	if action == "" {
+		return "none available"
+	}
+
+	s.metrics.SLORemediations.WithLabelValues(handle.LatencyClass, handle.SecurityDomain, kind).Inc()
+	s.emitEvent(Event{
+		Type:           "slo_remediation",
+		HandleID:       handle.ID,
+		SecurityDomain: handle.SecurityDomain,
+		Detail:         action,
+	})
+	return action
+}
+
+// throttleNeighboursLocked frees tier bandwidth by lowering lower-priority
+// neighbours' floors until committed floors drop back under the contention
+// threshold, taking at most half of any neighbour's floor. It returns a
+// description of the changes, or "" if nothing could be freed. Callers must
+// hold s.mutex for writing.
+func (s *FFMService) throttleNeighboursLocked(handle *FFMHandle) string {
+	load := s.tierLoad(handle)
+	excess := float64(load.CommittedBandwidthGBs) - contentionThreshold*float64(load.BandwidthGBs)
+	if excess <= 0 {
+		return ""
+	}
+
+	var neighbours []*FFMHandle
+	for _, h := range s.allocations {
+		if h.LatencyClass == handle.LatencyClass && h.State == StateActive &&
+			h.rank() < handle.rank() && h.BandwidthFloor > 1 {
+			neighbours = append(neighbours, h)
+		}
+	}
+	// Lowest priority first, then largest floor
+	sort.Slice(neighbours, func(i, j int) bool {
+		if neighbours[i].rank() != neighbours[j].rank() {
+			return neighbours[i].rank() < neighbours[j].rank()
+		}
+		if neighbours[i].BandwidthFloor != neighbours[j].BandwidthFloor {
+			return neighbours[i].BandwidthFloor > neighbours[j].BandwidthFloor
+		}
+		return neighbours[i].ID < neighbours[j].ID
+	})
+
+	need := uint64(excess + 0.5)
+	action := ""
+	for _, n := range neighbours {
+		if need == 0 {
+			break
+		}
+		cut := n.BandwidthFloor / 2
+		if cut > need {
+			cut = need
+		}
+		oldFloor := n.BandwidthFloor
+		if err := s.setBandwidthFloor(n, oldFloor-cut); err != nil {
+			log.Printf("SLO remediation of %s: cannot lower floor of %s: %v", handle.ID, n.ID, err)
+			continue
+		}
+		need -= cut
+		s.emitEvent(Event{
+			Type:           "throttled",
+			HandleID:       n.ID,
+			SecurityDomain: n.SecurityDomain,
+			Detail:         fmt.Sprintf("floor %d -> %d GB/s to restore the SLO of %s", oldFloor, n.BandwidthFloor, handle.ID),
+			Before:         map[string]interface{}{"bandwidth_floor_GBs": oldFloor},
+			After:          map[string]interface{}{"bandwidth_floor_GBs": n.BandwidthFloor},
+		})
+		if action != "" {
+			action += ", "
+		}
+		action += fmt.Sprintf("lowered %s (%s) floor %d -> %d GB/s", n.ID, n.Priority, oldFloor, n.BandwidthFloor)
+	}
+	return action
+}
+
+// SLO returns the SLO status of a handle
+func (s *FFMService) SLO(id string) (*SLOStatus, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return nil, notFound("allocation %s not found", id)
+	}
+
+	status := &SLOStatus{
+		HandleID:        id,
+		WindowSeconds:   s.sloWindow.Seconds(),
+		FloorGBs:        handle.BandwidthFloor,
+		P99TargetMs:     sloP99TargetMs[handle.LatencyClass],
+		Violating:       []string{},
+		Violations:      []SLOViolation{},
+		RemediationMode: s.sloRemediate,
+	}
+	t, ok := s.slo[id]
+	if !ok {
+		return status, nil
+	}
+	status.Samples = len(t.samples)
+	if len(t.samples) > 0 {
+		status.AvgAchievedGBs, status.AvgTailP99Ms = t.windowAverages()
+	}
+	for kind := range t.open {
+		status.Violating = append(status.Violating, kind)
+	}
+	sort.Strings(status.Violating)
+	for _, v := range t.violations {
+		status.Violations = append(status.Violations, *v)
+	}
+	return status, nil
+}
+
+func (s *FFMService) handleGetSLO(w http.ResponseWriter, r *http.Request) {
+	status, err := s.SLO(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
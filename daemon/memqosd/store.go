@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "allocations.wal"
+	snapshotFileName = "allocations.snapshot.json"
+
+	// snapshotEvery bounds WAL growth: once this many records have been
+	// appended since the last snapshot, the next checkpoint compacts the log.
+	snapshotEvery = 1024
+)
+
+// walRecord is one line of the write-ahead log
+type walRecord struct {
+	Seq    uint64     `json:"seq"`
+	Op     string     `json:"op"` // put, delete
+	ID     string     `json:"id"`
+	Handle *FFMHandle `json:"handle,omitempty"`
+	NextID int        `json:"next_id"`
+	At     time.Time  `json:"at"`
+}
+
+// storeSnapshot is the compacted state written periodically
+type storeSnapshot struct {
+	Seq         uint64       `json:"seq"`
+	NextID      int          `json:"next_id"`
+	Allocations []*FFMHandle `json:"allocations"`
+	TakenAt     time.Time    `json:"taken_at"`
+}
+
+// allocationStore persists FFM handles as a write-ahead log plus snapshot
+type allocationStore struct {
+	dir       string
+	wal       *os.File
+	seq       uint64
+	sinceSnap int
+	mutex     sync.Mutex
+}
+
+// openAllocationStore opens (or creates) the store in dir and replays it,
+// returning the recovered allocations and next ID.
+func openAllocationStore(dir string) (*allocationStore, map[string]*FFMHandle, int, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, nil, 0, fmt.Errorf("create state dir: %v", err)
+	}
+
+	st := &allocationStore{dir: dir}
+	allocations := make(map[string]*FFMHandle)
+	nextID := 1
+
+	// Load snapshot first
+	snap, err := readSnapshot(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if snap != nil {
+		for _, h := range snap.Allocations {
+			allocations[h.ID] = h
+		}
+		nextID = snap.NextID
+		st.seq = snap.Seq
+	}
+
+	// Replay WAL records newer than the snapshot
+	walPath := filepath.Join(dir, walFileName)
+	replayed, validSize, err := replayWAL(walPath, st.seq, func(rec walRecord) {
+		switch rec.Op {
+		case "put":
+			if rec.Handle != nil {
+				allocations[rec.ID] = rec.Handle
+			}
+		case "delete":
+			delete(allocations, rec.ID)
+		}
+		if rec.NextID > nextID {
+			nextID = rec.NextID
+		}
+		st.seq = rec.Seq
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// Never hand out an ID that is already in use, even if next_id was lost
+	for id := range allocations {
+		var n int
+		if _, err := fmt.Sscanf(id, "ffm-%x", &n); err == nil && n >= nextID {
+			nextID = n + 1
+		}
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("open wal: %v", err)
+	}
+	// Drop a torn trailing record left by a crash mid-write
+	if err := wal.Truncate(validSize); err != nil {
+		wal.Close()
+		return nil, nil, 0, fmt.Errorf("truncate wal: %v", err)
+	}
+	if _, err := wal.Seek(validSize, io.SeekStart); err != nil {
+		wal.Close()
+		return nil, nil, 0, fmt.Errorf("seek wal: %v", err)
+	}
+	st.wal = wal
+	st.sinceSnap = replayed
+
+	log.Printf("Recovered %d FFM allocations from %s (%d WAL records replayed, next ID %d)",
+		len(allocations), dir, replayed, nextID)
+	return st, allocations, nextID, nil
+}
+
+// readSnapshot loads the snapshot file; a missing file is not an error
+func readSnapshot(path string) (*storeSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %v", err)
+	}
+	var snap storeSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("decode snapshot: %v", err)
+	}
+	return &snap, nil
+}
+
+// replayWAL applies every record with a sequence number above afterSeq and
+// returns how many were applied plus the byte length of the intact prefix.
+func replayWAL(path string, afterSeq uint64, apply func(walRecord)) (int, int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("open wal: %v", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	applied := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding torn WAL record at offset %d", offset)
+			}
+			break
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("read wal: %v", err)
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("Discarding corrupt WAL record at offset %d: %v", offset, err)
+			break
+		}
+		offset += int64(len(line))
+		if rec.Seq <= afterSeq {
+			continue
+		}
+		apply(rec)
+		applied++
+	}
+	return applied, offset, nil
+}
+
+// Put records the full state of a handle
+func (st *allocationStore) Put(handle *FFMHandle, nextID int) error {
+	h := *handle
+	h.UpcomingTransitions = nil // derived on read
+	return st.append(walRecord{Op: "put", ID: handle.ID, Handle: &h, NextID: nextID})
+}
+
+// Delete records the removal of a handle
+func (st *allocationStore) Delete(id string, nextID int) error {
+	return st.append(walRecord{Op: "delete", ID: id, NextID: nextID})
+}
+
+func (st *allocationStore) append(rec walRecord) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	rec.Seq = st.seq + 1
+	rec.At = time.Now()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := st.wal.Write(line); err != nil {
+		return fmt.Errorf("append wal: %v", err)
+	}
+	if err := st.wal.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %v", err)
+	}
+	st.seq = rec.Seq
+	st.sinceSnap++
+	return nil
+}
+
+// NeedsSnapshot reports whether the WAL has grown enough to compact
+func (st *allocationStore) NeedsSnapshot() bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.sinceSnap >= snapshotEvery
+}
+
+// Snapshot writes the given state atomically and truncates the WAL
+func (st *allocationStore) Snapshot(allocations map[string]*FFMHandle, nextID int) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	snap := storeSnapshot{
+		Seq:         st.seq,
+		NextID:      nextID,
+		Allocations: make([]*FFMHandle, 0, len(allocations)),
+		TakenAt:     time.Now(),
+	}
+	for _, h := range allocations {
+		c := *h
+		snap.Allocations = append(snap.Allocations, &c)
+	}
+	sort.Slice(snap.Allocations, func(i, j int) bool {
+		return snap.Allocations[i].ID < snap.Allocations[j].ID
+	})
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(st.dir, snapshotFileName), data); err != nil {
+		return fmt.Errorf("write snapshot: %v", err)
+	}
+
+	// Records up to snap.Seq are now covered by the snapshot
+	if err := st.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %v", err)
+	}
+	if _, err := st.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %v", err)
+	}
+	st.sinceSnap = 0
+	return nil
+}
+
+// Close flushes and closes the WAL
+func (st *allocationStore) Close() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if err := st.wal.Sync(); err != nil {
+		return err
+	}
+	return st.wal.Close()
+}
+
+// writeFileAtomic writes data to a temp file and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// OpenStore recovers allocations from dir and enables durable state
+func (s *FFMService) OpenStore(dir string) error {
+	st, allocations, nextID, err := openAllocationStore(dir)
+	if err != nil {
+		return err
+	}
+	quotas, err := loadQuotas(dir)
+	if err != nil {
+		st.Close()
+		return err
+	}
+	snapshots, nextSnapshotID, err := loadSnapshots(dir)
+	if err != nil {
+		st.Close()
+		return fmt.Errorf("load snapshots: %v", err)
+	}
+	journal, events, err := openEventJournal(dir)
+	if err != nil {
+		st.Close()
+		return fmt.Errorf("open event journal: %v", err)
+	}
+	var seq uint64
+	if len(events) > 0 {
+		seq = events[len(events)-1].Seq
+	}
+	if err := s.webhooks.open(dir, seq); err != nil {
+		st.Close()
+		journal.Close()
+		return fmt.Errorf("load webhooks: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.store = st
+	s.allocations = allocations
+	s.nextID = nextID
+	s.quotas = quotas
+	s.snapshots = snapshots
+	s.nextSnapshotID = nextSnapshotID
+	s.snapshotDir = filepath.Join(dir, snapshotDirName)
+	// Event sequence numbers continue across restarts so cursors stay valid
+	s.journal = journal
+	s.events = events
+	s.eventSeq = seq
+
+	var bandwidth uint64
+	for id, h := range allocations {
+		// In-flight migrations do not survive a restart
+		h.MigrationID, h.MigratingTo = "", ""
+		switch h.State {
+		case "":
+			h.State = StateActive
+		case StateDraining, StateCloning:
+			// Finish a release interrupted by a crash; a half-filled clone
+			// is released too, as its contents cannot be trusted
+			if err := st.Delete(id, nextID); err != nil {
+				return fmt.Errorf("finish release of %s: %v", id, err)
+			}
+			delete(allocations, id)
+			if s.backend != nil {
+				if region, err := s.backend.Open(h); err == nil {
+					s.backend.Release(h, region)
+				}
+			}
+			log.Printf("Completed interrupted release of %s", id)
+			continue
+		}
+		bandwidth += h.BandwidthFloor
+		// Handles recorded before the fd socket required descriptors get
+		// an owner descriptor now
+		if h.OwnerDescriptor == "" {
+			if h.OwnerDescriptor, err = newDescriptor(id); err != nil {
+				return err
+			}
+			if err := st.Put(h, nextID); err != nil {
+				return fmt.Errorf("persist owner descriptor of %s: %v", id, err)
+			}
+		}
+		// Handles recorded before leases were enforced get a fresh lease
+		if h.LeaseExpiresAt.IsZero() {
+			if h.PolicyLeaseTTL <= 0 {
+				h.PolicyLeaseTTL = defaultLeaseTTL
+			}
+			h.LeaseExpiresAt = time.Now().Add(time.Duration(h.PolicyLeaseTTL) * time.Second)
+		}
+	}
+	s.metrics.AllocationsTotal.Set(float64(len(allocations)))
+	s.metrics.BandwidthTotal.Set(float64(bandwidth))
+	s.arbitrateLocked()
+	return s.openRegionsLocked()
+}
+
+// persist records a handle's current state; callers must hold s.mutex
+func (s *FFMService) persist(handle *FFMHandle) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.Put(handle, s.nextID)
+}
+
+// checkpoint compacts the WAL into a fresh snapshot
+func (s *FFMService) checkpoint() error {
+	if s.store == nil {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.store.Snapshot(s.allocations, s.nextID)
+}
+
+// runCheckpoints snapshots periodically, or sooner once the WAL grows large
+func (s *FFMService) runCheckpoints(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	poll := time.NewTicker(5 * time.Second)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-poll.C:
+			if s.store == nil || !s.store.NeedsSnapshot() {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if err := s.checkpoint(); err != nil {
+			log.Printf("Snapshot failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultStreamInterval = time.Second
+	minStreamInterval     = 100 * time.Millisecond
+	maxStreamInterval     = time.Minute
+	// streamWriteTimeout disconnects clients that stop reading
+	streamWriteTimeout = 10 * time.Second
+	// maxStreams bounds concurrent telemetry streams
+	maxStreams = 256
+)
+
+// TelemetryEvent is one streamed telemetry sample
+type TelemetryEvent struct {
+	HandleID string    `json:"handle_id"`
+	At       time.Time `json:"at"`
+	TelemetryResponse
+}
+
+// streamHub tracks open telemetry streams so they can be ended on shutdown
+type streamHub struct {
+	open   atomic.Int32
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{closed: make(chan struct{})}
+}
+
+// acquire reserves a stream slot and reports whether one was free
+func (h *streamHub) acquire() bool {
+	if h.open.Add(1) > maxStreams {
+		h.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (h *streamHub) release() {
+	h.open.Add(-1)
+}
+
+// Close ends every open stream; it is safe to call more than once
+func (h *streamHub) Close() {
+	h.once.Do(func() { close(h.closed) })
+}
+
+// CloseStreams ends all telemetry streams, letting HTTP shutdown complete
+func (s *FFMService) CloseStreams() {
+	s.streams.Close()
+}
+
+// sampleEvent takes a fresh telemetry sample of one handle without
+// recording it
+func (s *FFMService) sampleEvent(id string, now time.Time) (*TelemetryEvent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	handle, exists := s.allocations[id]
+	if !exists {
+		return nil, notFound("allocation %s not found", id)
+	}
+	sample, err := s.telemetrySource.Sample(handle, s.tierLoad(handle), now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: telemetry for allocation %s: %v", errUnavailable, id, err)
+	}
+	return &TelemetryEvent{HandleID: id, At: now, TelemetryResponse: sample}, nil
+}
+
+// sampleDomain takes a fresh telemetry sample of every active handle in a
+// security domain, ordered by handle ID
+func (s *FFMService) sampleDomain(domain string, now time.Time) []TelemetryEvent {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var events []TelemetryEvent
+	for id, handle := range s.allocations {
+		if handle.SecurityDomain != domain || handle.State != StateActive {
+			continue
+		}
+		sample, err := s.telemetrySource.Sample(handle, s.tierLoad(handle), now)
+		if err != nil {
+			continue
+		}
+		events = append(events, TelemetryEvent{HandleID: id, At: now, TelemetryResponse: sample})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].HandleID < events[j].HandleID })
+	return events
+}
+
+// sseStream writes Server-Sent Events with a per-write deadline
+type sseStream struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	seq uint64
+}
+
+// startSSE switches the response to an event stream
+func startSSE(w http.ResponseWriter) *sseStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &sseStream{w: w, rc: http.NewResponseController(w)}
+}
+
+// send writes one event and flushes it. A client that does not drain the
+// stream within streamWriteTimeout gets an error and is disconnected.
+func (st *sseStream) send(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	st.seq++
+	st.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := fmt.Fprintf(st.w, "event: %s\nid: %d\ndata: %s\n\n", event, st.seq, data); err != nil {
+		return err
+	}
+	return st.rc.Flush()
+}
+
+// parseStreamInterval reads the client-chosen sample interval
+func parseStreamInterval(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("interval")
+	if v == "" {
+		return defaultStreamInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, invalidField("interval", "invalid interval %q", v)
+	}
+	if d < minStreamInterval || d > maxStreamInterval {
+		return 0, invalidField("interval", "interval must be between %s and %s", minStreamInterval, maxStreamInterval)
+	}
+	return d, nil
+}
+
+// streamLoop calls tick every interval until the client goes away, the
+// daemon shuts down or tick fails. Ticks missed while a slow client is
+// being written to are dropped rather than queued.
+func (s *FFMService) streamLoop(st *sseStream, r *http.Request, interval time.Duration, tick func(time.Time) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if err := tick(time.Now()); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.streams.closed:
+			st.send("shutdown", map[string]string{"reason": "memqosd shutting down"})
+			return
+		case now := <-ticker.C:
+			if err := tick(now); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *FFMService) handleTelemetryStream(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	interval, err := parseStreamInterval(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := s.sampleEvent(id, time.Now()); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.streams.acquire() {
+		writeError(w, fmt.Errorf("%w: too many telemetry streams", errUnavailable))
+		return
+	}
+	defer s.streams.release()
+
+	st := startSSE(w)
+	s.streamLoop(st, r, interval, func(now time.Time) error {
+		event, err := s.sampleEvent(id, now)
+		if err != nil {
+			// The handle was released
+			st.send("end", map[string]string{"handle_id": id, "reason": err.Error()})
+			return err
+		}
+		return st.send("telemetry", event)
+	})
+}
+
+func (s *FFMService) handleDomainTelemetryStream(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("security_domain")
+	if domain == "" {
+		writeError(w, invalidField("security_domain", "security_domain is required"))
+		return
+	}
+	interval, err := parseStreamInterval(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.streams.acquire() {
+		writeError(w, fmt.Errorf("%w: too many telemetry streams", errUnavailable))
+		return
+	}
+	defer s.streams.release()
+
+	st := startSSE(w)
+	s.streamLoop(st, r, interval, func(now time.Time) error {
+		for _, event := range s.sampleDomain(domain, now) {
+			if err := st.send("telemetry", event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
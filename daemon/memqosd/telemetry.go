@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// TelemetrySource produces telemetry samples for handles
+type TelemetrySource interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Sample returns the telemetry of handle at now given the load on its tier
+	Sample(handle *FFMHandle, load TierLoad, now time.Time) (TelemetryResponse, error)
+}
+
+// TierLoad is the tier context a handle is sampled in
+type TierLoad struct {
+	Tier                  string
+	BandwidthGBs          uint64 // tier budget
+	CommittedBandwidthGBs uint64 // sum of floors on the tier
+	Allocations           int
+	GrantedGBs            float64 // the handle's arbitrated bandwidth
+}
+
+// tierProfile holds the simulator's physical model of one tier
+type tierProfile struct {
+	baseP99Ms     float64 // p99 latency of an idle tier
+	idleWPerGiB   float64 // static power per GiB held
+	dynamicWPerGB float64 // dynamic power per GB/s moved
+}
+
+var tierProfiles = map[string]tierProfile{
+	"T0": {baseP99Ms: 0.25, idleWPerGiB: 0.004, dynamicWPerGB: 0.010},
+	"T1": {baseP99Ms: 0.60, idleWPerGiB: 0.010, dynamicWPerGB: 0.025},
+	"T2": {baseP99Ms: 1.80, idleWPerGiB: 0.012, dynamicWPerGB: 0.040},
+	"T3": {baseP99Ms: 8.00, idleWPerGiB: 0.002, dynamicWPerGB: 0.080},
+}
+
+const (
+	ambientC        = 35.0
+	thermalCPerW    = 0.45 // steady-state temperature rise per watt
+	maxTemperatureC = 95.0
+	jitterFraction  = 0.03 // +-3% deterministic noise on every reading
+
+	// contentionThreshold is the share of a tier's bandwidth budget that
+	// committed floors can use before they crowd each other out
+	contentionThreshold = 0.8
+)
+
+// simulatedSource derives telemetry from tier, arbitrated bandwidth and
+// contention. Output depends only on its inputs and the second of now, so it
+// is reproducible.
+type simulatedSource struct{}
+
+// NewSimulatedSource returns the deterministic load simulator
+func NewSimulatedSource() TelemetrySource {
+	return simulatedSource{}
+}
+
+func (simulatedSource) Name() string { return "simulator" }
+
+func (simulatedSource) Sample(handle *FFMHandle, load TierLoad, now time.Time) (TelemetryResponse, error) {
+	profile, ok := tierProfiles[handle.LatencyClass]
+	if !ok {
+		profile = tierProfiles["T3"]
+	}
+
+	// Tier utilization from committed floors
+	util := 0.0
+	if load.BandwidthGBs > 0 {
+		util = math.Min(float64(load.CommittedBandwidthGBs)/float64(load.BandwidthGBs), 0.99)
+	}
+	achieved := load.GrantedGBs
+
+	// Queueing delay grows like an M/M/1 queue as the tier saturates
+	p99 := profile.baseP99Ms * (1 + util*util/(1-util))
+	if handle.MigratingTo != "" {
+		p99 *= 1.25 // page copies compete with the workload
+	}
+
+	power := profile.idleWPerGiB*float64(handle.Bytes>>30) + profile.dynamicWPerGB*achieved
+	temperature := math.Min(ambientC+thermalCPerW*power, maxTemperatureC)
+
+	j := jitter(handle.ID, now)
+	return TelemetryResponse{
+		AchievedGBs: uint64(math.Round(achieved * (1 + j))),
+		MovedPages:  handle.MovedPages,
+		TailP99Ms:   round2(p99 * (1 - j)),
+		Temperature: round2(temperature * (1 + j/4)),
+		PowerW:      round2(power * (1 + j)),
+		Utilization: round2(util * 100),
+	}, nil
+}
+
+// jitter returns a reproducible value in [-jitterFraction, jitterFraction]
+// for a handle and second
+func jitter(id string, now time.Time) float64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", id, now.Unix())
+	return (float64(h.Sum64()%2001)/1000 - 1) * jitterFraction
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// TraceSample is one recorded reading in a telemetry trace. Samples apply to
+// a handle ID, or failing that to every handle on a tier, or to all handles
+// when both are empty.
+type TraceSample struct {
+	OffsetMs int64  `json:"offset_ms"`
+	HandleID string `json:"handle_id,omitempty"`
+	Tier     string `json:"tier,omitempty"`
+	TelemetryResponse
+}
+
+// replaySource plays recorded traces back in a loop, relative to when it
+// was opened
+type replaySource struct {
+	path     string
+	started  time.Time
+	traces   map[string][]TraceSample // keyed by handle ID, tier or ""
+	fallback TelemetrySource
+}
+
+// NewReplaySource loads a JSON-lines trace file. Handles the trace does not
+// cover are sampled from fallback.
+func NewReplaySource(path string, fallback TelemetrySource) (TelemetrySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open trace: %v", err)
+	}
+	defer f.Close()
+
+	traces := make(map[string][]TraceSample)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var sample TraceSample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		key := sample.HandleID
+		if key == "" {
+			key = sample.Tier
+		}
+		traces[key] = append(traces[key], sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read trace: %v", err)
+	}
+	if len(traces) == 0 {
+		return nil, fmt.Errorf("trace %s has no samples", path)
+	}
+	for _, samples := range traces {
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].OffsetMs < samples[j].OffsetMs })
+	}
+
+	return &replaySource{path: path, started: time.Now(), traces: traces, fallback: fallback}, nil
+}
+
+func (r *replaySource) Name() string { return "replay:" + r.path }
+
+func (r *replaySource) Sample(handle *FFMHandle, load TierLoad, now time.Time) (TelemetryResponse, error) {
+	samples, ok := r.traces[handle.ID]
+	if !ok {
+		samples, ok = r.traces[handle.LatencyClass]
+	}
+	if !ok {
+		samples, ok = r.traces[""]
+	}
+	if !ok {
+		if r.fallback == nil {
+			return TelemetryResponse{}, fmt.Errorf("no trace for allocation %s on tier %s", handle.ID, handle.LatencyClass)
+		}
+		return r.fallback.Sample(handle, load, now)
+	}
+
+	// Loop the trace; its length is the last offset plus one sample period
+	period := int64(1000)
+	if len(samples) > 1 {
+		period = samples[1].OffsetMs - samples[0].OffsetMs
+	}
+	length := samples[len(samples)-1].OffsetMs + period
+	if length <= 0 {
+		length = 1
+	}
+	elapsed := now.Sub(r.started).Milliseconds() % length
+
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].OffsetMs > elapsed })
+	if i > 0 {
+		i--
+	}
+	sample := samples[i].TelemetryResponse
+	sample.MovedPages = handle.MovedPages
+	return sample, nil
+}
+
+// telemetrySourceFromEnv picks the telemetry backend: a replay of
+// MEMQOSD_TELEMETRY_TRACE when set, the simulator otherwise
+func telemetrySourceFromEnv() (TelemetrySource, error) {
+	sim := NewSimulatedSource()
+	path := os.Getenv("MEMQOSD_TELEMETRY_TRACE")
+	if path == "" {
+		return sim, nil
+	}
+	return NewReplaySource(path, sim)
+}
+
+// SetTelemetrySource replaces the telemetry backend
+func (s *FFMService) SetTelemetrySource(source TelemetrySource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.telemetrySource = source
+}
+
+// tierLoad reports the load on handle's tier and the bandwidth arbitration
+// granted handle; callers must hold s.mutex
+func (s *FFMService) tierLoad(handle *FFMHandle) TierLoad {
+	tier := handle.LatencyClass
+	load := TierLoad{Tier: tier, GrantedGBs: s.grantedBandwidth(handle)}
+	if capacity, ok := s.tiers[tier]; ok {
+		load.BandwidthGBs = capacity.BandwidthGBs
+	}
+	_, load.CommittedBandwidthGBs, load.Allocations = s.tierUsage(tier, "")
+	return load
+}
+
+// sampleLocked takes a telemetry sample of handle, records it as the latest
+// reading and updates the handle's achieved bandwidth and tail latency;
+// callers must hold s.mutex for writing
+func (s *FFMService) sampleLocked(handle *FFMHandle, now time.Time) (TelemetryResponse, error) {
+	sample, err := s.telemetrySource.Sample(handle, s.tierLoad(handle), now)
+	if err != nil {
+		return TelemetryResponse{}, err
+	}
+	handle.AchievedBandwidth = sample.AchievedGBs
+	handle.TailP99Ms = sample.TailP99Ms
+	s.telemetry[handle.ID] = sample
+	return sample, nil
+}
+
+// sampleTelemetry samples every active handle and feeds the tail latency
+// histogram
+func (s *FFMService) sampleTelemetry(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, handle := range s.allocations {
+		if handle.State != StateActive {
+			continue
+		}
+		sample, err := s.sampleLocked(handle, now)
+		if err != nil {
+			log.Printf("Telemetry sample of %s failed: %v", id, err)
+			continue
+		}
+		s.metrics.LatencyP99.Observe(sample.TailP99Ms / 1000)
+		s.evaluateSLOLocked(handle, sample, now)
+	}
+	for id := range s.telemetry {
+		if _, exists := s.allocations[id]; !exists {
+			delete(s.telemetry, id)
+			delete(s.slo, id)
+		}
+	}
+}
+
+// runTelemetry samples all handles every interval
+func (s *FFMService) runTelemetry(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.sampleTelemetry(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.sampleTelemetry(now)
+		}
+	}
+}
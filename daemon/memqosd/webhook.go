@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// webhookFile holds subscriptions and their dead letters
+	webhookFile = "webhooks.json"
+	// webhookTimeout bounds one delivery attempt
+	webhookTimeout = 5 * time.Second
+	// webhookAttempts is how often an event is tried before it is dead-lettered
+	webhookAttempts = 5
+	// webhookBackoff is the delay before the first retry; it doubles after
+	webhookBackoff = time.Second
+	// webhookQueueSize bounds undelivered events per subscription
+	webhookQueueSize = 1024
+	// maxDeadLetters bounds the dead letters kept per subscription
+	maxDeadLetters = 256
+	// webhookSaveInterval is how often delivery progress and dead letters
+	// are saved
+	webhookSaveInterval = 2 * time.Second
+)
+
+// Webhook is a subscription that receives events as signed HTTP POSTs.
+// Each request carries X-Memqosd-Timestamp and X-Memqosd-Signature, the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret. Every attempt
+// is signed afresh, so receivers can reject stale timestamps as replays.
+type Webhook struct {
+	ID             string     `json:"id"`
+	URL            string     `json:"url"`
+	Secret         string     `json:"secret,omitempty"`
+	Types          []string   `json:"types,omitempty"` // event type patterns, e.g. migration_*
+	SecurityDomain string     `json:"security_domain,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Cursor         uint64     `json:"cursor"` // last event delivered or dead-lettered; later ones are replayed on restart
+	Delivered      uint64     `json:"delivered"`
+	DeadLettered   uint64     `json:"dead_lettered"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+}
+
+// WebhookRequest is the body of POST /v1/ffm/webhooks. An empty secret is
+// generated and returned once.
+type WebhookRequest struct {
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret,omitempty"`
+	Types          []string `json:"types,omitempty"`
+	SecurityDomain string   `json:"security_domain,omitempty"`
+}
+
+// DeadLetter is an event a webhook failed to accept
+type DeadLetter struct {
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	At       time.Time `json:"at"`
+}
+
+// webhookSub is a subscription with its delivery queue
+type webhookSub struct {
+	hook  Webhook
+	dead  []DeadLetter
+	queue chan Event
+	stop  chan struct{}
+}
+
+// webhookState is the persisted form of a subscription
+type webhookState struct {
+	Webhook
+	DeadLetters []DeadLetter `json:"dead_letters,omitempty"`
+}
+
+// webhookHub delivers events to subscriptions, one goroutine each so a slow
+// receiver only delays itself. Events are delivered in order; an event that
+// fails every attempt is dead-lettered and delivery moves on. Delivery
+// progress and dead letters are saved in the background, so publishing
+// never waits on disk.
+type webhookHub struct {
+	mu     sync.Mutex
+	dir    string // empty keeps subscriptions in memory only
+	client *http.Client
+	subs   map[string]*webhookSub
+	nextID int
+	closed bool
+	seq    uint64 // of the last event published
+	wg     sync.WaitGroup
+
+	dirty     bool   // changed since the last save
+	version   uint64 // of the last marshalled state
+	stopSaves chan struct{}
+
+	// saveMu orders writes of webhookFile; it is taken after mu
+	saveMu  sync.Mutex
+	written uint64 // version on disk
+}
+
+func newWebhookHub() *webhookHub {
+	return &webhookHub{
+		client:    &http.Client{Timeout: webhookTimeout},
+		subs:      make(map[string]*webhookSub),
+		nextID:    1,
+		stopSaves: make(chan struct{}),
+	}
+}
+
+// open loads persisted subscriptions from dir and starts delivering to them.
+// Journaled events past a subscription's cursor, queued but not delivered
+// when memqosd stopped, are queued again; seq is the last journaled event.
+func (h *webhookHub) open(dir string, seq uint64) error {
+	data, err := os.ReadFile(filepath.Join(dir, webhookFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var states []webhookState
+	if err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			return fmt.Errorf("parse %s: %v", webhookFile, err)
+		}
+	}
+
+	var replay []Event
+	since := seq
+	for _, st := range states {
+		if st.Cursor < since {
+			since = st.Cursor
+		}
+	}
+	if since < seq {
+		page, err := readEventJournal(filepath.Join(dir, eventJournalFile), EventQuery{Since: since, Limit: maxJournalEvents})
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read event journal: %v", err)
+		}
+		if page.Truncated {
+			log.Printf("Webhooks: events after %d were dropped from the journal and cannot be replayed", since)
+		}
+		replay = page.Events
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dir = dir
+	h.seq = seq
+	go h.runSaves(webhookSaveInterval)
+	for _, st := range states {
+		sub := &webhookSub{hook: st.Webhook, dead: st.DeadLetters}
+		h.startLocked(sub)
+		var n int
+		if _, err := fmt.Sscanf(st.ID, "wh-%x", &n); err == nil && n >= h.nextID {
+			h.nextID = n + 1
+		}
+		replayed := 0
+		for _, ev := range replay {
+			if ev.Seq > sub.hook.Cursor && sub.hook.matches(ev) {
+				h.queueLocked(sub, ev)
+				replayed++
+			}
+		}
+		if replayed > 0 {
+			log.Printf("Webhook %s: replaying %d undelivered event(s)", sub.hook.ID, replayed)
+		}
+	}
+	return nil
+}
+
+// startLocked registers sub and starts its delivery goroutine; callers must
+// hold h.mu
+func (h *webhookHub) startLocked(sub *webhookSub) {
+	sub.queue = make(chan Event, webhookQueueSize)
+	sub.stop = make(chan struct{})
+	h.subs[sub.hook.ID] = sub
+	h.wg.Add(1)
+	go h.run(sub)
+}
+
+// marshalLocked returns every subscription in its persisted form and the
+// version of that state; callers must hold h.mu
+func (h *webhookHub) marshalLocked() ([]byte, uint64, error) {
+	states := make([]webhookState, 0, len(h.subs))
+	for _, sub := range h.subs {
+		states = append(states, webhookState{Webhook: sub.hook, DeadLetters: sub.dead})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	h.version++
+	h.dirty = false
+	return data, h.version, nil
+}
+
+// write saves a marshalled state unless a newer one was already written
+func (h *webhookHub) write(data []byte, version uint64) error {
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	if version <= h.written {
+		return nil
+	}
+	if err := writeFileAtomic(filepath.Join(h.dir, webhookFile), data); err != nil {
+		return err
+	}
+	h.written = version
+	return nil
+}
+
+// saveLocked writes every subscription to the state directory now; callers
+// must hold h.mu. It is for changes made through the API, which report
+// whether they were persisted.
+func (h *webhookHub) saveLocked() error {
+	if h.dir == "" {
+		return nil
+	}
+	data, version, err := h.marshalLocked()
+	if err != nil {
+		return err
+	}
+	return h.write(data, version)
+}
+
+// saveIfDirty writes subscriptions if delivery changed them since the last
+// save, without holding h.mu while writing
+func (h *webhookHub) saveIfDirty() error {
+	h.mu.Lock()
+	if h.dir == "" || !h.dirty {
+		h.mu.Unlock()
+		return nil
+	}
+	data, version, err := h.marshalLocked()
+	h.mu.Unlock()
+	if err == nil {
+		err = h.write(data, version)
+	}
+	if err != nil {
+		h.mu.Lock()
+		h.dirty = true
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// runSaves saves delivery progress every interval until the hub closes
+func (h *webhookHub) runSaves(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stopSaves:
+			return
+		case <-ticker.C:
+			if err := h.saveIfDirty(); err != nil {
+				log.Printf("Failed to save webhooks: %v", err)
+			}
+		}
+	}
+}
+
+// matches reports whether the subscription wants ev
+func (w *Webhook) matches(ev Event) bool {
+	if w.SecurityDomain != "" && ev.SecurityDomain != w.SecurityDomain {
+		return false
+	}
+	if len(w.Types) == 0 {
+		return true
+	}
+	for _, pattern := range w.Types {
+		if ok, _ := path.Match(pattern, ev.Type); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// publish queues ev for every matching subscription without blocking or
+// touching disk; a full queue dead-letters the event
+func (h *webhookHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.seq = ev.Seq
+	for _, sub := range h.subs {
+		if sub.hook.matches(ev) {
+			h.queueLocked(sub, ev)
+		}
+	}
+}
+
+// queueLocked queues ev for delivery to sub, dead-lettering it when the
+// queue is full; callers must hold h.mu
+func (h *webhookHub) queueLocked(sub *webhookSub, ev Event) {
+	select {
+	case sub.queue <- ev:
+	default:
+		h.deadLetterLocked(sub, ev, 0, "delivery queue full")
+	}
+}
+
+// deadLetterLocked records an undeliverable event; callers must hold h.mu
+func (h *webhookHub) deadLetterLocked(sub *webhookSub, ev Event, attempts int, reason string) {
+	sub.dead = append(sub.dead, DeadLetter{Event: ev, Attempts: attempts, Error: reason, At: time.Now()})
+	if len(sub.dead) > maxDeadLetters {
+		sub.dead = sub.dead[len(sub.dead)-maxDeadLetters:]
+	}
+	sub.hook.DeadLettered++
+	sub.hook.LastError = reason
+	if ev.Seq > sub.hook.Cursor {
+		sub.hook.Cursor = ev.Seq
+	}
+	h.dirty = true
+	log.Printf("Webhook %s: dead-lettered event %d after %d attempt(s): %s", sub.hook.ID, ev.Seq, attempts, reason)
+}
+
+// run delivers queued events to one subscription until it is stopped
+func (h *webhookHub) run(sub *webhookSub) {
+	defer h.wg.Done()
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case ev := <-sub.queue:
+			attempts, err := h.deliver(sub, ev)
+			now := time.Now()
+			h.mu.Lock()
+			sub.hook.LastAttemptAt = &now
+			if err != nil {
+				h.deadLetterLocked(sub, ev, attempts, err.Error())
+			} else {
+				sub.hook.Delivered++
+				sub.hook.LastError = ""
+				if ev.Seq > sub.hook.Cursor {
+					sub.hook.Cursor = ev.Seq
+				}
+				h.dirty = true
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// retryableError marks delivery failures worth another attempt
+type retryableError struct{ error }
+
+// deliver POSTs ev to the subscription, retrying network errors, 429s and
+// 5xx responses with exponential backoff. It returns the attempts made.
+func (h *webhookHub) deliver(sub *webhookSub, ev Event) (int, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+	h.mu.Lock()
+	target, secret := sub.hook.URL, sub.hook.Secret
+	h.mu.Unlock()
+
+	backoff := webhookBackoff
+	var lastErr error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-sub.stop:
+				return attempt - 1, fmt.Errorf("memqosd stopped before delivery: %v", lastErr)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		lastErr = h.post(target, secret, ev, body)
+		if lastErr == nil {
+			return attempt, nil
+		}
+		if _, ok := lastErr.(retryableError); !ok {
+			return attempt, lastErr
+		}
+	}
+	return webhookAttempts, lastErr
+}
+
+// post makes one signed delivery attempt
+func (h *webhookHub) post(target, secret string, ev Event, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Memqosd-Event", ev.Type)
+	req.Header.Set("X-Memqosd-Delivery", strconv.FormatUint(ev.Seq, 10))
+	req.Header.Set("X-Memqosd-Timestamp", timestamp)
+	req.Header.Set("X-Memqosd-Signature", "sha256="+signWebhook(secret, timestamp, body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryableError{fmt.Errorf("receiver returned HTTP %d", resp.StatusCode)}
+	default:
+		return fmt.Errorf("receiver returned HTTP %d", resp.StatusCode)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close stops delivery, dead-letters events still queued so they can be
+// redelivered after a restart, and saves subscriptions
+func (h *webhookHub) Close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.stopSaves)
+	for _, sub := range h.subs {
+		close(sub.stop)
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range h.subs {
+		for len(sub.queue) > 0 {
+			h.deadLetterLocked(sub, <-sub.queue, 0, "memqosd stopped before delivery")
+		}
+	}
+	if err := h.saveLocked(); err != nil {
+		log.Printf("Failed to save webhooks: %v", err)
+	}
+}
+
+// redacted returns a copy of the subscription without its secret
+func (sub *webhookSub) redacted() Webhook {
+	w := sub.hook
+	w.Secret = ""
+	w.Types = append([]string(nil), w.Types...)
+	return w
+}
+
+// Create adds a subscription. The returned copy is the only one that
+// includes the secret.
+func (h *webhookHub) Create(req WebhookRequest) (*Webhook, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, invalidField("url", "url must be an absolute http or https URL, got %q", req.URL)
+	}
+	for _, pattern := range req.Types {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, invalidField("types", "invalid event type pattern %q", pattern)
+		}
+	}
+	if req.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		req.Secret = hex.EncodeToString(buf)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, fmt.Errorf("%w: memqosd is shutting down", errUnavailable)
+	}
+	sub := &webhookSub{hook: Webhook{
+		ID:             fmt.Sprintf("wh-%04x", h.nextID),
+		URL:            req.URL,
+		Secret:         req.Secret,
+		Types:          req.Types,
+		SecurityDomain: req.SecurityDomain,
+		CreatedAt:      time.Now(),
+		Cursor:         h.seq, // earlier events are not replayed to it
+	}}
+	h.nextID++
+	h.startLocked(sub)
+	if err := h.saveLocked(); err != nil {
+		close(sub.stop)
+		delete(h.subs, sub.hook.ID)
+		return nil, fmt.Errorf("persist webhook: %v", err)
+	}
+	w := sub.hook
+	return &w, nil
+}
+
+// List returns all subscriptions ordered by ID, without secrets
+func (h *webhookHub) List() []Webhook {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]Webhook, 0, len(h.subs))
+	for _, sub := range h.subs {
+		list = append(list, sub.redacted())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Get returns one subscription without its secret
+func (h *webhookHub) Get(id string) (*Webhook, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.subs[id]
+	if !ok {
+		return nil, notFound("webhook %s not found", id)
+	}
+	w := sub.redacted()
+	return &w, nil
+}
+
+// Delete removes a subscription; queued events are dropped
+func (h *webhookHub) Delete(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.subs[id]
+	if !ok {
+		return notFound("webhook %s not found", id)
+	}
+	close(sub.stop)
+	delete(h.subs, id)
+	return h.saveLocked()
+}
+
+// DeadLetters returns a subscription's dead letters, oldest first
+func (h *webhookHub) DeadLetters(id string) ([]DeadLetter, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.subs[id]
+	if !ok {
+		return nil, notFound("webhook %s not found", id)
+	}
+	return append([]DeadLetter{}, sub.dead...), nil
+}
+
+// Redeliver queues a subscription's dead letters again and clears them,
+// returning how many were queued
+func (h *webhookHub) Redeliver(id string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub, ok := h.subs[id]
+	if !ok {
+		return 0, notFound("webhook %s not found", id)
+	}
+	queued := 0
+	for _, d := range sub.dead {
+		select {
+		case sub.queue <- d.Event:
+			queued++
+			continue
+		default:
+		}
+		break
+	}
+	sub.dead = sub.dead[queued:]
+	if err := h.saveLocked(); err != nil {
+		return queued, fmt.Errorf("persist webhook: %v", err)
+	}
+	if len(sub.dead) > 0 {
+		return queued, fmt.Errorf("%w: webhook %s queue is full, %d dead letter(s) left", errHandleBusy, id, len(sub.dead))
+	}
+	return queued, nil
+}
+
+func (s *FFMService) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	hook, err := s.webhooks.Create(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func (s *FFMService) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.webhooks.List())
+}
+
+func (s *FFMService) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := s.webhooks.Get(mux.Vars(r)["wid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+func (s *FFMService) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := s.webhooks.Delete(mux.Vars(r)["wid"]); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *FFMService) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	dead, err := s.webhooks.DeadLetters(mux.Vars(r)["wid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dead)
+}
+
+func (s *FFMService) handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	queued, err := s.webhooks.Redeliver(mux.Vars(r)["wid"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"queued": queued})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookReplaysPastCursor(t *testing.T) {
+	got := make(chan uint64, 8)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seq, _ := strconv.ParseUint(r.Header.Get("X-Memqosd-Delivery"), 10, 64)
+		got <- seq
+	}))
+	defer receiver.Close()
+
+	// wh-0001 took event 1 before memqosd stopped; 2 and 3 were still queued
+	dir := t.TempDir()
+	states, _ := json.Marshal([]webhookState{{Webhook: Webhook{ID: "wh-0001", URL: receiver.URL, Cursor: 1}}})
+	if err := os.WriteFile(filepath.Join(dir, webhookFile), states, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var journal []byte
+	for seq := uint64(1); seq <= 3; seq++ {
+		line, _ := json.Marshal(Event{Seq: seq, Type: "allocated"})
+		journal = append(append(journal, line...), '\n')
+	}
+	if err := os.WriteFile(filepath.Join(dir, eventJournalFile), journal, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newWebhookHub()
+	if err := h.open(dir, 3); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer h.Close()
+	for _, want := range []uint64{2, 3} {
+		select {
+		case seq := <-got:
+			if seq != want {
+				t.Fatalf("delivered event %d, want %d", seq, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d was not replayed", want)
+		}
+	}
+
+	// New subscriptions start at the latest event
+	hook, err := h.Create(WebhookRequest{URL: receiver.URL})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if hook.Cursor != 3 {
+		t.Errorf("new webhook cursor %d, want 3", hook.Cursor)
+	}
+}
@@ -3,9 +3,9 @@ package ffm
 import (
     "bytes"
     "encoding/json"
-    "fmt"
-    "io"
     "net/http"
+    "net/url"
+    "time"
 )
 
 type AllocateRequest struct {
@@ -17,11 +17,22 @@ type AllocateRequest struct {
     SecurityDomain     string `json:"security_domain"`
     AttestationRequired bool  `json:"attestation_required,omitempty"`
     AttestationTicket   string `json:"attestation_ticket,omitempty"`
+    FromSnapshot        string `json:"from_snapshot,omitempty"` // clone contents from a snapshot
 }
 
 type Handle struct {
-    ID    string `json:"id"`
-    Bytes uint64 `json:"bytes"`
+    ID              string    `json:"id"`
+    Bytes           uint64    `json:"bytes"`
+    LeaseExpiresAt  time.Time `json:"lease_expires_at"`
+    State           string    `json:"state"`
+    RefCount        int       `json:"refcount"`
+}
+
+// Allocation is a newly allocated handle. OwnerDescriptor, for OpenRegion,
+// is only returned here; keep it, as memqosd never serves it again.
+type Allocation struct {
+    Handle
+    OwnerDescriptor string `json:"owner_descriptor"`
 }
 
 type Telemetry struct {
@@ -32,21 +43,21 @@ type Client struct { BaseURL string; HTTP *http.Client }
 
 func New(base string) *Client { return &Client{BaseURL: base, HTTP: &http.Client{}} }
 
-func (c *Client) Allocate(req AllocateRequest) (*Handle, error) {
+func (c *Client) Allocate(req AllocateRequest) (*Allocation, error) {
     b, _ := json.Marshal(req)
     resp, err := c.HTTP.Post(c.BaseURL+"/v1/ffm/alloc", "application/json", bytes.NewBuffer(b))
     if err != nil { return nil, err }
     defer resp.Body.Close()
-    if resp.StatusCode != http.StatusCreated { body,_ := io.ReadAll(resp.Body); return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body)) }
-    var h Handle
-    return &h, json.NewDecoder(resp.Body).Decode(&h)
+    if resp.StatusCode != http.StatusCreated { return nil, decodeError(resp) }
+    var a Allocation
+    return &a, json.NewDecoder(resp.Body).Decode(&a)
 }
 
 func (c *Client) Get(id string) (*Handle, error) {
     resp, err := c.HTTP.Get(c.BaseURL+"/v1/ffm/"+id)
     if err != nil { return nil, err }
     defer resp.Body.Close()
-    if resp.StatusCode != http.StatusOK { body,_ := io.ReadAll(resp.Body); return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body)) }
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
     var h Handle
     return &h, json.NewDecoder(resp.Body).Decode(&h)
 }
@@ -55,8 +66,115 @@ func (c *Client) Telemetry(id string) (*Telemetry, error) {
     resp, err := c.HTTP.Get(c.BaseURL+"/v1/ffm/"+id+"/telemetry")
     if err != nil { return nil, err }
     defer resp.Body.Close()
-    if resp.StatusCode != http.StatusOK { body,_ := io.ReadAll(resp.Body); return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body)) }
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
     var t Telemetry
     return &t, json.NewDecoder(resp.Body).Decode(&t)
 }
 
+
+func (c *Client) Renew(id string, ttlSeconds int) (*Handle, error) {
+    b, _ := json.Marshal(map[string]int{"ttl_s": ttlSeconds})
+    resp, err := c.HTTP.Post(c.BaseURL+"/v1/ffm/"+id+"/renew", "application/json", bytes.NewBuffer(b))
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
+    var h Handle
+    return &h, json.NewDecoder(resp.Body).Decode(&h)
+}
+
+func (c *Client) Free(id string, force bool) (*Handle, error) {
+    url := c.BaseURL+"/v1/ffm/"+id
+    if force { url += "?force=true" }
+    req, err := http.NewRequest(http.MethodDelete, url, nil)
+    if err != nil { return nil, err }
+    resp, err := c.HTTP.Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
+    var h Handle
+    return &h, json.NewDecoder(resp.Body).Decode(&h)
+}
+
+type SyncResult struct {
+    HandleID    string    `json:"handle_id"`
+    Persistence string    `json:"persistence"`
+    Method      string    `json:"method"`
+    SyncedAt    time.Time `json:"synced_at"`
+    DurationMs  float64   `json:"duration_ms"`
+}
+
+// Sync checkpoints a write-back handle or flushes a write-through or durable one
+func (c *Client) Sync(id string) (*SyncResult, error) {
+    resp, err := c.HTTP.Post(c.BaseURL+"/v1/ffm/"+id+"/sync", "application/json", nil)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
+    var r SyncResult
+    return &r, json.NewDecoder(resp.Body).Decode(&r)
+}
+
+type Snapshot struct {
+    ID             string    `json:"id"`
+    Label          string    `json:"label,omitempty"`
+    SourceHandle   string    `json:"source_handle"`
+    Tier           string    `json:"tier"`
+    SecurityDomain string    `json:"security_domain"`
+    Bytes          uint64    `json:"bytes"`
+    Checksum       string    `json:"checksum"`
+    CreatedAt      time.Time `json:"created_at"`
+}
+
+// Snapshot copies a handle's memory into a durable snapshot that new handles
+// can be cloned from with AllocateRequest.FromSnapshot
+func (c *Client) Snapshot(id, label string) (*Snapshot, error) {
+    b, _ := json.Marshal(map[string]string{"label": label})
+    resp, err := c.HTTP.Post(c.BaseURL+"/v1/ffm/"+id+"/snapshot", "application/json", bytes.NewBuffer(b))
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusCreated { return nil, decodeError(resp) }
+    var snap Snapshot
+    return &snap, json.NewDecoder(resp.Body).Decode(&snap)
+}
+
+// Snapshots lists snapshots, all of them when domain is empty
+func (c *Client) Snapshots(domain string) ([]Snapshot, error) {
+    target := c.BaseURL+"/v1/ffm/snapshots"
+    if domain != "" { target += "?"+url.Values{"security_domain": {domain}}.Encode() }
+    resp, err := c.HTTP.Get(target)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
+    var snaps []Snapshot
+    return snaps, json.NewDecoder(resp.Body).Decode(&snaps)
+}
+
+type AttachRequest struct {
+    PID            int    `json:"pid,omitempty"`
+    Pod            string `json:"pod,omitempty"`
+    Tenant         string `json:"tenant,omitempty"`
+    SecurityDomain string `json:"security_domain"`
+}
+
+type Consumer struct {
+    ID         string `json:"id"`
+    Descriptor string `json:"descriptor"`
+}
+
+func (c *Client) Attach(id string, req AttachRequest) (*Consumer, error) {
+    b, _ := json.Marshal(req)
+    resp, err := c.HTTP.Post(c.BaseURL+"/v1/ffm/"+id+"/attach", "application/json", bytes.NewBuffer(b))
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusCreated { return nil, decodeError(resp) }
+    var con Consumer
+    return &con, json.NewDecoder(resp.Body).Decode(&con)
+}
+
+func (c *Client) Detach(id, consumerID string) error {
+    b, _ := json.Marshal(map[string]string{"consumer_id": consumerID})
+    resp, err := c.HTTP.Post(c.BaseURL+"/v1/ffm/"+id+"/detach", "application/json", bytes.NewBuffer(b))
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK { return decodeError(resp) }
+    return nil
+}
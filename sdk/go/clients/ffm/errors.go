@@ -0,0 +1,101 @@
+package ffm
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+)
+
+// Error is an error response from memqosd
+type Error struct {
+    StatusCode int             `json:"-"`
+    Code       string          `json:"code"`
+    Message    string          `json:"message"`
+    Field      string          `json:"field,omitempty"`
+    Retryable  bool            `json:"retryable"`
+    Details    json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+    if e.Field != "" {
+        return fmt.Sprintf("memqosd: %s (%s, field %s, HTTP %d)", e.Message, e.Code, e.Field, e.StatusCode)
+    }
+    return fmt.Sprintf("memqosd: %s (%s, HTTP %d)", e.Message, e.Code, e.StatusCode)
+}
+
+// Is matches errors by code, so errors.Is(err, ffm.ErrNotFound) works
+func (e *Error) Is(target error) bool {
+    t, ok := target.(*Error)
+    return ok && t.Code == e.Code
+}
+
+// Errors by code, for use with errors.Is
+var (
+    ErrInvalidRequest       = &Error{Code: "invalid_request"}
+    ErrNotFound             = &Error{Code: "not_found"}
+    ErrForbidden            = &Error{Code: "forbidden"}
+    ErrHandleBusy           = &Error{Code: "handle_busy"}
+    ErrInsufficientCapacity = &Error{Code: "insufficient_capacity"}
+    ErrQuotaExceeded        = &Error{Code: "quota_exceeded"}
+    ErrUpstream             = &Error{Code: "upstream_error"}
+    ErrUnavailable          = &Error{Code: "unavailable"}
+)
+
+// CapacityDetails explains an insufficient_capacity error
+type CapacityDetails struct {
+    Tier      string `json:"tier"`
+    Resource  string `json:"resource"`
+    Requested uint64 `json:"requested"`
+    Available uint64 `json:"available"`
+    Capacity  uint64 `json:"capacity"`
+}
+
+// QuotaDetails explains a quota_exceeded error
+type QuotaDetails struct {
+    SecurityDomain string `json:"security_domain"`
+    Resource       string `json:"resource"`
+    Tier           string `json:"tier,omitempty"`
+    Requested      uint64 `json:"requested"`
+    Available      uint64 `json:"available"`
+    Limit          uint64 `json:"limit"`
+}
+
+// Capacity returns the details of an insufficient_capacity error
+func (e *Error) Capacity() (*CapacityDetails, bool) {
+    var d CapacityDetails
+    if e.Code != ErrInsufficientCapacity.Code || json.Unmarshal(e.Details, &d) != nil {
+        return nil, false
+    }
+    return &d, true
+}
+
+// Quota returns the details of a quota_exceeded error
+func (e *Error) Quota() (*QuotaDetails, bool) {
+    var d QuotaDetails
+    if e.Code != ErrQuotaExceeded.Code || json.Unmarshal(e.Details, &d) != nil {
+        return nil, false
+    }
+    return &d, true
+}
+
+// IsRetryable reports whether err is a memqosd error that may succeed if
+// the request is retried later
+func IsRetryable(err error) bool {
+    var e *Error
+    return errors.As(err, &e) && e.Retryable
+}
+
+// decodeError turns a failed response into an *Error. Bodies that are not
+// an error envelope, e.g. from a proxy, keep their text as the message.
+func decodeError(resp *http.Response) error {
+    body, _ := io.ReadAll(resp.Body)
+    e := &Error{StatusCode: resp.StatusCode}
+    if json.Unmarshal(body, e) != nil || e.Code == "" {
+        e.Code = "http_error"
+        e.Message = string(body)
+        e.Retryable = resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+    }
+    return e
+}
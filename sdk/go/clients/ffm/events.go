@@ -0,0 +1,67 @@
+package ffm
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Event is a state change of an allocation, from the event journal or a
+// webhook delivery
+type Event struct {
+    Seq            uint64                 `json:"seq"`
+    Type           string                 `json:"type"`
+    HandleID       string                 `json:"handle_id"`
+    SecurityDomain string                 `json:"security_domain,omitempty"`
+    Detail         string                 `json:"detail,omitempty"`
+    Before         map[string]interface{} `json:"before,omitempty"`
+    After          map[string]interface{} `json:"after,omitempty"`
+    At             time.Time              `json:"at"`
+}
+
+type EventPage struct {
+    Events     []Event `json:"events"`
+    NextCursor uint64  `json:"next_cursor"`
+    Truncated  bool    `json:"truncated,omitempty"`
+}
+
+// Events returns up to limit events after since; pass NextCursor as since
+// to read on. A limit of 0 uses the server default.
+func (c *Client) Events(since uint64, limit int) (*EventPage, error) {
+    q := url.Values{"since": {strconv.FormatUint(since, 10)}}
+    if limit > 0 { q.Set("limit", strconv.Itoa(limit)) }
+    resp, err := c.HTTP.Get(c.BaseURL+"/v1/ffm/events?"+q.Encode())
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK { return nil, decodeError(resp) }
+    var page EventPage
+    return &page, json.NewDecoder(resp.Body).Decode(&page)
+}
+
+// DefaultWebhookSkew is a reasonable maxSkew for VerifyWebhook; memqosd
+// signs every delivery attempt afresh, so retries stay within it
+const DefaultWebhookSkew = 5 * time.Minute
+
+// VerifyWebhook checks the X-Memqosd-Signature of a webhook delivery against
+// its X-Memqosd-Timestamp and body, and rejects deliveries whose timestamp
+// is more than maxSkew from now so captured requests cannot be replayed
+func VerifyWebhook(secret string, header http.Header, body []byte, maxSkew time.Duration) bool {
+    timestamp := header.Get("X-Memqosd-Timestamp")
+    unix, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil { return false }
+    if skew := time.Since(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew { return false }
+    sig, ok := strings.CutPrefix(header.Get("X-Memqosd-Signature"), "sha256=")
+    if !ok { return false }
+    want, err := hex.DecodeString(sig)
+    if err != nil { return false }
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,83 @@
+//go:build unix
+
+package ffm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// RegionInfo describes the memory backing a handle
+type RegionInfo struct {
+	Kind string `json:"kind"`
+	Path string `json:"path,omitempty"`
+	Size uint64 `json:"size"`
+}
+
+type fdRequest struct {
+	HandleID   string `json:"handle_id"`
+	Descriptor string `json:"descriptor"`
+}
+
+type fdResponse struct {
+	HandleID string      `json:"handle_id"`
+	Region   *RegionInfo `json:"region,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// OpenRegion fetches the fd backing handle id from memqosd's fd socket so
+// the caller can mmap it. Owners pass the OwnerDescriptor returned by
+// Allocate; consumers of shared handles pass the descriptor they were issued
+// on attach.
+func OpenRegion(socketPath, id, descriptor string) (*os.File, *RegionInfo, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	req, _ := json.Marshal(fdRequest{HandleID: id, Descriptor: descriptor})
+	if _, err := conn.Write(append(req, '\n')); err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fds []int
+	if msgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+		for _, m := range msgs {
+			if rights, err := syscall.ParseUnixRights(&m); err == nil {
+				fds = append(fds, rights...)
+			}
+		}
+	}
+
+	var resp fdResponse
+	if err := json.Unmarshal(bytes.TrimSpace(buf[:n]), &resp); err != nil {
+		closeAll(fds)
+		return nil, nil, err
+	}
+	if resp.Error != "" {
+		closeAll(fds)
+		return nil, nil, fmt.Errorf("memqosd: %s", resp.Error)
+	}
+	if len(fds) != 1 {
+		closeAll(fds)
+		return nil, nil, fmt.Errorf("memqosd sent %d fds, want 1", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), "ffm:"+id), resp.Region, nil
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}